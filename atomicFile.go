@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+/* Replaces the file in one step : after a crash, we find the old file or the new one, never half a file.
+ * The temporary file is synced before the rename, and the directory after it, so that the new file is on the disk when we return.
+ */
+func writeFileAtomically(fileName string, data []byte, perm os.FileMode) error {
+	// Each writer has its own temporary file : the pins and key commands may save a file while the peer saves it too
+	file, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = file.Chmod(perm)
+	if err == nil {
+		_, err = file.Write(data)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	directory, err := os.Open(filepath.Dir(fileName))
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+	return directory.Sync()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	directory := t.TempDir()
+	fileName := filepath.Join(directory, "state.json")
+
+	tests := []struct {
+		content string
+		perm    os.FileMode
+	}{
+		{"first", 0600},
+		{"second, longer than the first", 0600},
+		{"third", 0644},
+	}
+	for _, test := range tests {
+		if err := writeFileAtomically(fileName, []byte(test.content), test.perm); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.content {
+			t.Errorf("the file contains %q, expected %q", data, test.content)
+		}
+		fileInfo, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileInfo.Mode().Perm() != test.perm {
+			t.Errorf("the file has the mode %v, expected %v", fileInfo.Mode().Perm(), test.perm)
+		}
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the directory, expected only the state file", len(entries))
+	}
+
+	if err := writeFileAtomically(filepath.Join(t.TempDir(), "missing", "state.json"), []byte("x"), 0600); err == nil {
+		t.Error("a file was written in a directory that does not exist")
+	}
+}
+
+/* The peer and a command that save the same file at the same time : the file is one of the two, whole */
+func TestWriteFileAtomicallyConcurrently(t *testing.T) {
+	directory := t.TempDir()
+	fileName := filepath.Join(directory, "pins.json")
+	const writers = 8
+
+	var group sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			content := strings.Repeat(fmt.Sprintf("writer %d ", i), 10000)
+			for j := 0; j < 20; j++ {
+				if err := writeFileAtomically(fileName, []byte(content), 0600); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	group.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := strings.Fields(string(data))[:2]
+	if string(data) != strings.Repeat(strings.Join(first, " ")+" ", 10000) {
+		t.Error("the file mixes the contents of several writers")
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the directory, expected only the state file", len(entries))
+	}
+}
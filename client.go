@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -14,14 +17,16 @@ import (
 )
 
 type ServerRegistration struct {
-	Name string `json:"name"`
-	Key  string `json:"key"`
+	Name      string        `json:"name"`
+	Key       string        `json:"key"`
+	Rotations []KeyRotation `json:"rotations,omitempty"` // From a key the server knows to Key, when the key changed
 }
 
 type Peer struct {
-	Username  string    `json:"name"`
-	Addresses []Address `json:"addresses"`
-	Key       string    `json:"key"`
+	Username  string        `json:"name"`
+	Addresses []Address     `json:"addresses"`
+	Key       string        `json:"key"`
+	Rotations []KeyRotation `json:"rotations,omitempty"` // The last rotations of the key of the peer, the last one gives Key
 }
 
 type Address struct {
@@ -29,33 +34,70 @@ type Address struct {
 	Port uint64 `json:"port"`
 }
 
-const DEBUG_MODE = true
-const HOST = "jch.irif.fr:8443"
-const NAME_FOR_SERVER_REGISTRATION = "HugoLeonard"
-const NAME_FILE_PRIVATE_KEY = NAME_FOR_SERVER_REGISTRATION + "_key.priv"
-const MERKLE_TREE_MAX_ARITY = 32
-const UDP_LISTENING_ADDRESS = ":8081"
-
-var datagramId = "idid"
-
 var peers []Peer
-var ThisPeerMerkleTree = CreateTree(CreateMessagesForMerkleTree(33), MERKLE_TREE_MAX_ARITY)
+var ThisPeerMerkleTree *MerkleTree
+var ThisPeerPostStore *PostStore
 var MyPublicKeyEncoded string
 
 func main() {
-	httpClient := CreateHttpClient()
+	/* CONFIGURATION
+	 *  Flags, then the command (none for the peer)
+	 */
+	config, args, err := LoadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration : %v \n", err)
+	}
+	ApplyConfig(config)
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "server":
+			RunDirectoryServer(args[1:])
+		case "post":
+			RunPostCommand(args[1:])
+		case "key":
+			RunKeyCommand(args[1:])
+		case "pins":
+			RunPinsCommand(args[1:])
+		default:
+			log.Fatalf("Unknown command %s \n", args[0])
+		}
+		return
+	}
+
+	/* THE MESSAGES WE PUBLISH
+	 *  The Merkle tree is rebuilt from the post store
+	 */
+	ThisPeerPostStore, err = OpenPostStore(NAME_FILE_POSTS)
+	if err != nil {
+		log.Fatalf("The post store %s could not be opened : %v \n", NAME_FILE_POSTS, err)
+	}
+	ThisPeerMerkleTree = CreateTree(ThisPeerPostStore.Posts(), MERKLE_TREE_MAX_ARITY)
+	thisPeerMerkleTreePosts = len(ThisPeerPostStore.Posts())
+
+	httpClient, err := CreateHttpClient()
+	if err != nil {
+		log.Fatalf("The HTTPS client could not be created : %v \n", err)
+	}
 
 	/* KEY CRYPTOGRAPHY
 	 */
-	fileInfo, err := os.Stat(NAME_FILE_PRIVATE_KEY)
-	myPrivateKey := CreateOrFindPrivateKey(fileInfo, err)
+	myPrivateKey, err := LoadOrCreatePrivateKey(NAME_FILE_PRIVATE_KEY)
+	if err != nil {
+		log.Fatalf("The private key could not be loaded from %s : %v \n", NAME_FILE_PRIVATE_KEY, err)
+	}
 	MyPublicKeyEncoded = CreatePublicKeyEncoded(myPrivateKey)
 
+	knownPeers = NewKnownPeers(NAME_FILE_KNOWN_PEERS)
+
 	/* GET THE UDP ADDRESS OF THE SERVER
 	 *  HTTP GET to /udp-address followed by a JSON decode.
 	 */
 	requestUrl := url.URL{Scheme: "https", Host: HOST, Path: "/udp-address"}
-	httpResponseBody, _ := HttpRequest("GET", httpClient, requestUrl.String(), nil, "%s")
+	httpResponseBody, _, err := HttpRequest("GET", httpClient, requestUrl.String(), nil, "%s")
+	if err != nil {
+		log.Fatalf("The UDP addresses of the server %s could not be obtained : %v \n", HOST, err)
+	}
 
 	var serverUdpAddresses []Address
 	errorMessage := json.Unmarshal(httpResponseBody, &serverUdpAddresses)
@@ -73,26 +115,30 @@ func main() {
 	/* SERVER REGISTRATION
 	 *  A POST REQUEST TO /register
 	 */
-	serverRegistration := ServerRegistration{Name: NAME_FOR_SERVER_REGISTRATION, Key: MyPublicKeyEncoded}
-	jsonEncoding, err := json.Marshal(serverRegistration)
-	if err != nil {
-		log.Fatalf("The method json.Marshal() failed at the stage of encoding the JSON object for server registration :  %v \n", err)
+	if err := RegisterToServer(httpClient, MyPublicKeyEncoded); err != nil {
+		log.Printf("THE REGISTRATION TO THE SERVER FAILED : %v \n", err)
 	}
 
-	requestUrl = url.URL{Scheme: "https", Host: HOST, Path: "/register"}
-	httpResponseBody, _ = HttpRequest("POST", httpClient, requestUrl.String(), jsonEncoding, "%s")
-
 	/* GET THE SERVER'S PUBLIC KEY
 	 * THE PUBLIC KEY THAT THE SERVER USES TO SIGN MESSAGES IS AVAILABLE AT /server-key.
 	 * IF A GET TO THIS URL RETURNS 404, THE SERVER DOES NOT SIGN ITS MESSAGES.
 	 */
 	requestUrl = url.URL{Scheme: "https", Host: HOST, Path: "/server-key"}
-	publicKeyFromServerBytes, _ := HttpRequest("GET", httpClient, requestUrl.String(), nil, "%x")
-	publicKeyFromServer := ConvertBytesToEcdsaPublicKey(publicKeyFromServerBytes)
-	publicKeyFromServerEncoded := base64.RawStdEncoding.EncodeToString(publicKeyFromServerBytes)
+	publicKeyFromServerBytes, statusCode, err := HttpRequest("GET", httpClient, requestUrl.String(), nil, "%x")
+	if err != nil {
+		log.Fatalf("The public key of the server %s could not be obtained : %v \n", HOST, err)
+	}
+	var publicKeyFromServer *ecdsa.PublicKey
+	if statusCode != 404 {
+		publicKeyFromServer, err = ConvertBytesToEcdsaPublicKey(publicKeyFromServerBytes)
+		if err != nil {
+			log.Fatalf("The public key of the server is not valid : %v \n", err)
+		}
+		publicKeyFromServerEncoded := base64.RawStdEncoding.EncodeToString(publicKeyFromServerBytes)
 
-	if DEBUG_MODE {
-		fmt.Printf("Public Key from server as string : %s\n", publicKeyFromServerEncoded)
+		if DEBUG_MODE {
+			fmt.Printf("Public Key from server as string : %s\n", publicKeyFromServerEncoded)
+		}
 	}
 
 	/* HELLO TO EACH OF THE UDP ADDRESSES OF THE SERVER
@@ -108,7 +154,7 @@ func main() {
 
 	// The reading of the received datagrams is done in a separate thread
 
-	go UdpRead(conn, myPrivateKey, serverUdpAddresses, publicKeyFromServer)
+	go UdpRead(conn, myPrivateKey, serverUdpAddresses, publicKeyFromServer, httpClient)
 
 	for _, address := range serverUdpAddresses {
 		var full_address string
@@ -123,10 +169,20 @@ func main() {
 			log.Fatalf("The method net.ResolveUDPAddr() failed with %s address : %v\n", full_address, errorMessage)
 		}
 
-		UdpWrite(conn, datagramId, HELLO_TYPE, serverAddr, nil, myPrivateKey)
+		Handshake(conn, serverAddr, myPrivateKey)
 		//break
 	}
 
+	/* THE PEERS WE FOLLOW
+	 *  Synchronized in the background
+	 */
+	followList, err := LoadFollowList(NAME_FILE_FOLLOWS)
+	if err != nil {
+		log.Fatalf("The follow list %s could not be loaded : %v \n", NAME_FILE_FOLLOWS, err)
+	}
+	go RunFollowSync(conn, httpClient, followList, FOLLOW_SYNC_INTERVAL, myPrivateKey)
+	go RunSessionKeepalive(conn, myPrivateKey)
+
 	fmt.Println()
 	fmt.Printf("WAITING FOR NEW MESSAGES ...\n")
 
@@ -158,7 +214,7 @@ func main() {
 			fmt.Println("SEND HELLO TO PEER ADDRESS : ")
 			fmt.Println("Enter peer address : ")
 			fmt.Scanln(&peerAddress)
-			if !helloToPeerAddress(conn, peerAddress, datagramId, myPrivateKey) {
+			if !helloToPeerAddress(conn, peerAddress, myPrivateKey) {
 				fmt.Printf("The address %s you specified was not found in the list of addresses of the peers known to the client \n", peerAddress)
 			}
 
@@ -168,7 +224,7 @@ func main() {
 			fmt.Println("ROOT REQUEST TO A OPENED SESSION : ")
 			fmt.Println("Enter peer address : ")
 			fmt.Scanln(&peerAddress)
-			if !rootRequestToOpenedSession(conn, peerAddress, datagramId, myPrivateKey) {
+			if !rootRequestToOpenedSession(conn, peerAddress, myPrivateKey) {
 				fmt.Printf("The address %s you specified was not found in the list of addresses of the opened sessions \n", peerAddress)
 			}
 		case 'e':
@@ -177,18 +233,20 @@ func main() {
 			fmt.Println("OBTAIN THE MERKLE TREE FROM ANOTHER PEER WHO GAVE US THE HASH OF ROOT : ")
 			fmt.Println("Enter peer address : ")
 			fmt.Scanln(&peerAddress)
-			if !getMerkleTreeAnotherPeer(conn, peerAddress, datagramId, myPrivateKey) {
+			if !getMerkleTreeAnotherPeer(conn, peerAddress, myPrivateKey) {
 				fmt.Printf("The address %s you specified was not found in the list of addresses of the opened sessions or we don't have the hash of the root  \n", peerAddress)
 			}
 		case 'f':
+			ThisPeerMerkleTreeMutex.RLock()
 			ThisPeerMerkleTree.DepthFirstSearch(0, ThisPeerMerkleTree.PrintNodesData, nil)
+			ThisPeerMerkleTreeMutex.RUnlock()
 		case 'g':
 			var peerAddress string
 			fmt.Println()
 			fmt.Println("DISPLAYING ANOTHER PEER'S MERKLE TREE : ")
 			fmt.Println("Enter peer address : ")
 			fmt.Scanln(&peerAddress)
-			if !printMerkleTreeAnotherPeer(conn, peerAddress, datagramId) {
+			if !printMerkleTreeAnotherPeer(conn, peerAddress) {
 				fmt.Printf("The address %s you specified was not found in the list of addresses of the opened sessions or we don't have a Merkle tree for this session.  \n", peerAddress)
 			}
 		case 'h':
@@ -197,10 +255,120 @@ func main() {
 			fmt.Println("DISPLAYING ANOTHER PEER'S MESSEGES : ")
 			fmt.Println("Enter peer address : ")
 			fmt.Scanln(&peerAddress)
-			if !printLeafFromMerkleTreeAnotherPeer(conn, peerAddress, datagramId) {
+			if !printLeafFromMerkleTreeAnotherPeer(conn, peerAddress) {
 				fmt.Printf("The address %s you specified was not found in the list of addresses of the opened sessions or we don't have a Merkle tree for this session.  \n", peerAddress)
 			}
 
+		case 'j':
+			fmt.Println()
+			fmt.Println("DATAGRAMS REJECTED SINCE THE START : ")
+			PrintRejectedDatagrams()
+			PrintBlocklist()
+		case 'k':
+			fmt.Println()
+			fmt.Println("PUBLISH A MESSAGE : ")
+			fmt.Printf("Enter the message (%d bytes at most) : \n", MESSAGE_BODY_MAX_LENGTH)
+			publishMessage(readLine(), nil)
+		case 'l':
+			fmt.Println()
+			fmt.Println("REPLY TO A MESSAGE : ")
+			fmt.Println("Enter the hash of the message : ")
+			inReplyTo, err := ParseMessageHash(readLine())
+			if err != nil {
+				fmt.Printf("%v \n", err)
+				break
+			}
+			fmt.Printf("Enter the reply (%d bytes at most) : \n", MESSAGE_BODY_MAX_LENGTH)
+			publishMessage(readLine(), inReplyTo)
+		case 'm':
+			fmt.Println()
+			fmt.Println("CONVERSATIONS : ")
+			BuildThreads(CollectMessages()).Print()
+		case 'n':
+			fmt.Println()
+			fmt.Println("TIMELINE : ")
+			ShowTimeline()
+		case 'o':
+			var peerName string
+			fmt.Println()
+			fmt.Println("FOLLOW A PEER : ")
+			fmt.Println("Enter peer name : ")
+			fmt.Scanln(&peerName)
+			if err := followList.Add(peerName); err != nil {
+				fmt.Printf("%v \n", err)
+				break
+			}
+			fmt.Printf("We follow %s, its messages will be downloaded in the background \n", peerName)
+			go func() {
+				if err := SyncFollowedPeer(conn, httpClient, peerName, myPrivateKey); err != nil {
+					log.Printf("SYNCHRONIZATION WITH %s FAILED : %v \n", peerName, err)
+				}
+			}()
+		case 'p':
+			var peerName string
+			fmt.Println()
+			fmt.Println("UNFOLLOW A PEER : ")
+			fmt.Println("Enter peer name : ")
+			fmt.Scanln(&peerName)
+			if err := followList.Remove(peerName); err != nil {
+				fmt.Printf("%v \n", err)
+			}
+		case 'r':
+			fmt.Println()
+			fmt.Println("THE PEERS WE FOLLOW : ")
+			for _, name := range followList.List() {
+				fmt.Println(name)
+			}
+		case 's':
+			fmt.Println()
+			fmt.Println("SESSIONS : ")
+			PrintSessions()
+		case 't':
+			fmt.Println()
+			fmt.Println("PINNED KEYS OF THE PEERS : ")
+			pins, err := knownPeers.List()
+			if err != nil {
+				fmt.Printf("%v \n", err)
+				break
+			}
+			PrintPins(pins)
+		case 'u':
+			var peerName, fingerprint string
+			fmt.Println()
+			fmt.Println("VERIFY THE KEY OF A PEER : ")
+			fmt.Println("Enter peer name : ")
+			fmt.Scanln(&peerName)
+			fmt.Println("Enter the fingerprint given by the peer itself : ")
+			fingerprint = readLine()
+			result, err := knownPeers.Verify(peerName, fingerprint)
+			if err != nil {
+				fmt.Printf("%v \n", err)
+				break
+			}
+			fmt.Println(result)
+		case 'v':
+			var peerName string
+			fmt.Println()
+			fmt.Println("REMOVE THE PIN OF A PEER : ")
+			fmt.Println("Enter peer name : ")
+			fmt.Scanln(&peerName)
+			if err := knownPeers.Remove(peerName); err != nil {
+				fmt.Printf("%v \n", err)
+				break
+			}
+			fmt.Printf("The key of %s is no longer pinned, the next key given by the server will be pinned \n", peerName)
+		case 'w':
+			var peerAddress string
+			fmt.Println()
+			fmt.Println("CLOSE THE SESSION WITH A PEER : ")
+			fmt.Println("Enter peer address : ")
+			fmt.Scanln(&peerAddress)
+			address, err := net.ResolveUDPAddr("udp", peerAddress)
+			if err != nil || !sessionManager.Close(address) {
+				fmt.Printf("There is no session with the address %s \n", peerAddress)
+				break
+			}
+			fmt.Printf("The session with %s is closed, the next request will do the handshake again \n", peerAddress)
 		case 'i':
 			os.Exit(0)
 		default:
@@ -222,8 +390,76 @@ func printMenu() {
 	str += fmt.Sprintln("f - Print our peer's Merkle tree")
 	str += fmt.Sprintln("g - Displaying another peer's Merkle tree")
 	str += fmt.Sprintln("h - Displaying another peer's messages")
+	str += fmt.Sprintln("j - Statistics of rejected datagrams and blocked addresses")
+	str += fmt.Sprintln("k - Publish a message")
+	str += fmt.Sprintln("l - Reply to a message")
+	str += fmt.Sprintln("m - Display the conversations of all the Merkle trees we have")
+	str += fmt.Sprintln("n - Timeline of the messages of all the peers, the most recent first")
+	str += fmt.Sprintln("o - Follow a peer")
+	str += fmt.Sprintln("p - Unfollow a peer")
+	str += fmt.Sprintln("r - List of the peers we follow")
+	str += fmt.Sprintln("s - Sessions and their state (alive, expired, handshaking)")
+	str += fmt.Sprintln("t - Pinned keys of the peers")
+	str += fmt.Sprintln("u - Verify the key of a peer (and accept its new key)")
+	str += fmt.Sprintln("v - Remove the pin of a peer")
+	str += fmt.Sprintln("w - Close the session with a peer")
 	str += fmt.Sprintln("i - Quit")
-	fmt.Printf(str)
+	fmt.Print(str)
+}
+
+/* Reads a whole line on the standard input (fmt.Scanln stops at the first space).
+ * The bytes are read one by one, like fmt.Scanln does, so that nothing is kept in a buffer for the next Scanln.
+ */
+func readLine() string {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if err != nil || (n == 1 && b[0] == '\n') {
+			break
+		}
+		line = append(line, b[:n]...)
+	}
+	return strings.TrimRight(string(line), "\r")
+}
+
+func publishMessage(body string, inReplyTo []byte) {
+	hash, err := PublishMessage(ThisPeerPostStore, body, inReplyTo)
+	if err != nil {
+		fmt.Printf("The message was not published : %v \n", err)
+		return
+	}
+	RefreshThisPeerMerkleTree()
+	fmt.Printf("MESSAGE PUBLISHED, HASH : %x \n", hash)
+}
+
+/* Registration : a POST request to /register with our name and our key.
+ * The rotations of our key are sent with it, so that the server accepts the new key of a name it knows with an old one.
+ */
+func RegisterToServer(client *http.Client, publicKeyEncoded string) error {
+	serverRegistration := ServerRegistration{Name: NAME_FOR_SERVER_REGISTRATION, Key: publicKeyEncoded, Rotations: keyRotationsForRegistration(publicKeyEncoded)}
+	jsonEncoding, err := json.Marshal(serverRegistration)
+	if err != nil {
+		return err
+	}
+
+	requestUrl := url.URL{Scheme: "https", Host: HOST, Path: "/register"}
+	if DEBUG_MODE {
+		fmt.Println()
+		log.Printf("HTTP POST REQUEST : %v \n", requestUrl.String())
+		fmt.Printf("BODY OF THE REQUEST : %s \n", jsonEncoding)
+	}
+	response, err := client.Post(requestUrl.String(), "application/json", bytes.NewReader(jsonEncoding))
+	if err != nil {
+		return explainHttpError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("the server answered %s : %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
 }
 
 /* List of peers known to the server
@@ -232,7 +468,11 @@ func printMenu() {
  */
 func getListPeersKnownToServer(client *http.Client) []byte {
 	requestUrl := url.URL{Scheme: "https", Host: HOST, Path: "/peers"}
-	httpResponseBody, _ := HttpRequest("GET", client, requestUrl.String(), nil, "%s")
+	httpResponseBody, _, err := HttpRequest("GET", client, requestUrl.String(), nil, "%s")
+	if err != nil {
+		fmt.Printf("The list of peers could not be obtained : %v \n", err)
+		return nil
+	}
 	return httpResponseBody
 }
 
@@ -247,7 +487,11 @@ func getPeerAddresses(client *http.Client, peersKnownToServer []byte, peerName s
 	for _, p := range bodyAfterSplit {
 		if peerName == p {
 			peerUrl := requestUrl.String() + "/" + p
-			bodyfromPeer, statusCode := HttpRequest("GET", client, peerUrl, nil, "%s")
+			bodyfromPeer, statusCode, err := HttpRequest("GET", client, peerUrl, nil, "%s")
+			if err != nil {
+				fmt.Printf("%v \n", err)
+				return false
+			}
 
 			if statusCode == 200 {
 				var peer Peer
@@ -256,7 +500,10 @@ func getPeerAddresses(client *http.Client, peersKnownToServer []byte, peerName s
 					log.Fatalf("The method json.Unmarshal() failed at the stage of decoding the json object received as an answer from %s : %v\n", peerUrl, err)
 				}
 
-				peers = append(peers, peer)
+				if err := rememberPeer(peer); err != nil {
+					fmt.Printf("%v \n", err)
+					return false
+				}
 				if DEBUG_MODE {
 					fmt.Printf("Peer key : %s\n", peer.Key)
 
@@ -277,7 +524,7 @@ func getPeerAddresses(client *http.Client, peersKnownToServer []byte, peerName s
 /*
  *
  */
-func helloToPeerAddress(conn net.PacketConn, peerAddress string, datagramId string, privateKey *ecdsa.PrivateKey) bool {
+func helloToPeerAddress(conn net.PacketConn, peerAddress string, privateKey *ecdsa.PrivateKey) bool {
 	for _, peer := range peers {
 		for _, address := range peer.Addresses {
 			var full_address string
@@ -292,7 +539,9 @@ func helloToPeerAddress(conn net.PacketConn, peerAddress string, datagramId stri
 					log.Fatalf("The method net.ResolveUDPAddr() failed with %s address : %v\n", full_address, err)
 				}
 
-				UdpWrite(conn, datagramId, HELLO_TYPE, serverAddr, nil, privateKey)
+				if err := Handshake(conn, serverAddr, privateKey); err != nil {
+					fmt.Printf("The Hello to %s failed : %v \n", peerAddress, err)
+				}
 				return true
 			}
 		}
@@ -303,106 +552,110 @@ func helloToPeerAddress(conn net.PacketConn, peerAddress string, datagramId stri
 /*
  *
  */
-func rootRequestToOpenedSession(conn net.PacketConn, peerAddress string, datagramId string, privateKey *ecdsa.PrivateKey) bool {
-	for _, session := range sessionsWeOpened {
-		if peerAddress == session.FullAddress.String() || peerAddress == fmt.Sprintf("%s:%v", session.FullAddress.IP.String(), session.FullAddress.Port) {
-			UdpWrite(conn, datagramId, ROOT_REQUEST_TYPE, session.FullAddress, nil, privateKey)
-			return true
-		}
+func rootRequestToOpenedSession(conn net.PacketConn, peerAddress string, privateKey *ecdsa.PrivateKey) bool {
+	_, address, found := findSessionWeOpened(peerAddress)
+	if !found {
+		return false
 	}
-	return false
+
+	response, err := UdpWrite(conn, NewDatagramId(), ROOT_REQUEST_TYPE, address, nil, privateKey)
+	if err != nil {
+		fmt.Printf("The root request to %s failed : %v \n", peerAddress, err)
+		return true
+	}
+
+	if root, ok := response.(*ParsedRoot); ok {
+		sessionManager.Update(address, func(session *Session) {
+			updateSessionRoot(session, root.Hash)
+		})
+	}
+	return true
 }
 
-/*
- *
- */
-func getMerkleTreeAnotherPeer(conn net.PacketConn, peerAddress string, datagramId string, privateKey *ecdsa.PrivateKey) bool {
-	for i := 0; i < len(sessionsWeOpened); i++ {
-		if peerAddress == sessionsWeOpened[i].FullAddress.String() || peerAddress == fmt.Sprintf("%s:%v", sessionsWeOpened[i].FullAddress.IP.String(), sessionsWeOpened[i].FullAddress.Port) {
-			if sessionsWeOpened[i].Buffer != nil && len(sessionsWeOpened[i].Buffer) == HASH_LENGTH {
-				writeResult := UdpWrite(conn, datagramId, GET_DATUM_TYPE, sessionsWeOpened[i].FullAddress, sessionsWeOpened[i].Buffer, privateKey)
-				if writeResult {
-					getDatumResult := getDatum(conn, i, datagramId, privateKey)
-					if getDatumResult || true {
-						return true
-					}
-				}
+/* The session we opened with the peer that uses this address (as typed by the user), and the address */
+func findSessionWeOpened(peerAddress string) (Session, *net.UDPAddr, bool) {
+	for _, session := range sessionManager.List() {
+		if !session.WeOpened() {
+			continue
+		}
+		for _, address := range session.Addresses {
+			if peerAddress == address.String() || peerAddress == fmt.Sprintf("%s:%v", address.IP.String(), address.Port) {
+				return session, address, true
 			}
 		}
 	}
-	return false
+	return Session{}, nil, false
 }
 
-/* A recursive function that obtains the parts that are in the Merkle tree of another peer and are not yet in our possession
+/* We keep the root hash the peer gave us until we download the node that this hash represents.
  */
-func getDatum(conn net.PacketConn, sessionIndex int, datagramId string, privateKey *ecdsa.PrivateKey) bool {
-	datagramBody := sessionsWeOpened[sessionIndex].Buffer // We take from the buffer the last node we received
-
-	if len(datagramBody) <= HASH_LENGTH { // Invalid node length
-		return false
-	}
-
-	hash := datagramBody[0:HASH_LENGTH]
-	// If we failed to add the node to the tree (because the hash does not match the content of the node for example)
-	if !sessionsWeOpened[sessionIndex].Merkle.AddNode(hash, datagramBody[HASH_LENGTH:]) {
-		return false
+func updateSessionRoot(session *Session, rootHash []byte) {
+	if session.Merkle == nil {
+		if DEBUG_MODE {
+			fmt.Println()
+			fmt.Printf("So far we have not created a Merkle tree for this session, so we create a Merkle tree now. \n")
+		}
+		session.Merkle = CreateEmptyTree(MERKLE_TREE_MAX_ARITY)
+	} else if bytes.Equal(rootHash, session.Merkle.Root.Hash) {
+		if DEBUG_MODE {
+			fmt.Println()
+			fmt.Printf("The root we got is the same as the root that was stored so far in the Merkle tree for this session. \n")
+		}
+	} else {
+		if DEBUG_MODE {
+			fmt.Println()
+			fmt.Print("The root we got is not the same as the root that was stored so far in the Merkle tree for this session. We will keep the new hash until we get the node that this hash represents.\n")
+			fmt.Print("If the hash matches the node, we will replace the root of the Merkel tree. \n")
+		}
 	}
 
-	// Presentation of the Merkle tree step by step during its construction
-	//sessionsWeOpened[sessionIndex].Merkle.DepthFirstSearch(0, sessionsWeOpened[sessionIndex].Merkle.PrintNodesData, nil)
+	session.RootHash = rootHash
+}
 
-	if datagramBody[HASH_LENGTH+NODE_TYPE_BYTE] == NODE_TYPE_MESSAGE {
-		return true
+/*
+ *
+ */
+func getMerkleTreeAnotherPeer(conn net.PacketConn, peerAddress string, privateKey *ecdsa.PrivateKey) bool {
+	session, address, found := findSessionWeOpened(peerAddress)
+	if !found || session.RootHash == nil {
+		return false
 	}
 
-	if datagramBody[HASH_LENGTH+NODE_TYPE_BYTE] == NODE_TYPE_INTERNAL {
-		// We go through each of the hashes found in the last node we received
-		for i := 1 + HASH_LENGTH; i < len(datagramBody); i += HASH_LENGTH { // 1 for the type byte
-			hashI := datagramBody[i : i+HASH_LENGTH]
-
-			// We are looking for the hash in the Merkle tree. If it does not exist the function DepthFirstSearch() returns nil
-			if sessionsWeOpened[sessionIndex].Merkle.DepthFirstSearch(0, sessionsWeOpened[sessionIndex].Merkle.GetNodeByHash, hashI) == nil {
-
-				writeResult := UdpWrite(conn, datagramId, GET_DATUM_TYPE, sessionsWeOpened[sessionIndex].FullAddress, hashI, privateKey)
-				if writeResult { // The UdpWrite function returns true if we received an answer
-
-					getDatum(conn, sessionIndex, datagramId, privateKey)
-				} else {
-					return false
-				}
-			}
-		}
+	_, _, stats, err := downloadSessionTree(conn, address, session, session.RootHash, privateKey)
+	fmt.Println()
+	fmt.Printf("DOWNLOAD FINISHED : %v \n", stats)
+	if err != nil {
+		fmt.Printf("%v \n", err)
 	}
-
 	return true
 }
 
 /*
  *
  */
-func printMerkleTreeAnotherPeer(conn net.PacketConn, peerAddress string, datagramId string) bool {
-	for i := 0; i < len(sessionsWeOpened); i++ {
-		if peerAddress == sessionsWeOpened[i].FullAddress.String() || peerAddress == fmt.Sprintf("%s:%v", sessionsWeOpened[i].FullAddress.IP.String(), sessionsWeOpened[i].FullAddress.Port) {
-			if sessionsWeOpened[i].Merkle != nil {
-				sessionsWeOpened[i].Merkle.DepthFirstSearch(0, sessionsWeOpened[i].Merkle.PrintNodesData, nil)
-				return true
-			}
-		}
+func printMerkleTreeAnotherPeer(conn net.PacketConn, peerAddress string) bool {
+	session, _, found := findSessionWeOpened(peerAddress)
+	if !found || session.Merkle == nil {
+		return false
 	}
-	return false
+
+	sessionTreesMutex.RLock()
+	session.Merkle.DepthFirstSearch(0, session.Merkle.PrintNodesData, nil)
+	sessionTreesMutex.RUnlock()
+	return true
 }
 
 /*
  *
  */
-func printLeafFromMerkleTreeAnotherPeer(conn net.PacketConn, peerAddress string, datagramId string) bool {
-	for i := 0; i < len(sessionsWeOpened); i++ {
-		if peerAddress == sessionsWeOpened[i].FullAddress.String() || peerAddress == fmt.Sprintf("%s:%v", sessionsWeOpened[i].FullAddress.IP.String(), sessionsWeOpened[i].FullAddress.Port) {
-			if sessionsWeOpened[i].Merkle != nil {
-				sessionsWeOpened[i].Merkle.DepthFirstSearch(0, sessionsWeOpened[i].Merkle.PrintLeaf, nil)
-				return true
-			}
-		}
+func printLeafFromMerkleTreeAnotherPeer(conn net.PacketConn, peerAddress string) bool {
+	session, _, found := findSessionWeOpened(peerAddress)
+	if !found || session.Merkle == nil {
+		return false
 	}
-	return false
+
+	sessionTreesMutex.RLock()
+	session.Merkle.DepthFirstSearch(0, session.Merkle.PrintLeaf, nil)
+	sessionTreesMutex.RUnlock()
+	return true
 }
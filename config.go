@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+/* The configuration of the peer. Each value comes, by increasing priority, from :
+ *  the default values below, the JSON configuration file, the environment variables MICROBLOG_*, the command-line flags.
+ * Several peers with different names can then run on the same machine without editing the source.
+ */
+
+const CONFIG_ENV_PREFIX = "MICROBLOG_"
+const DEFAULT_CONFIG_FILE = "microblog.json" // Read only if it exists, unless another file is given with -config or MICROBLOG_CONFIG
+
+/* An internal node is sent in a single Datum datagram (possibly encrypted) : 1 type byte and the hashes of the children after the hash of the node */
+const MERKLE_TREE_MAX_ARITY_LIMIT = (BUFFER_SIZE - BODY_FIRST_BYTE - HASH_LENGTH - 1 - SIGNATURE_LENGTH - ENCRYPTION_OVERHEAD) / HASH_LENGTH
+
+type Config struct {
+	Name               string `json:"name"`
+	Server             string `json:"server"`
+	CaFile             string `json:"ca_file"`            // PEM bundle of the certificate authorities of the server, instead of the roots of the system
+	ServerFingerprint  string `json:"server_fingerprint"` // SHA-256 of the certificate of the server, in hexadecimal, for a self-hosted server
+	ListenAddress      string `json:"listen_address"`
+	KeyFile            string `json:"key_file"`         // Default : <name>_key.priv
+	PostFile           string `json:"post_file"`        // Default : <name>_posts.log
+	TimelineFile       string `json:"timeline_file"`    // Default : <name>_timeline.json
+	FollowFile         string `json:"follow_file"`      // Default : <name>_follows.json
+	NodeDir            string `json:"node_dir"`         // The directory of the nodes downloaded from the other peers. Default : <name>_nodes
+	KnownPeersFile     string `json:"known_peers_file"` // The keys pinned for the other peers. Default : <name>_known_peers.json
+	FollowInterval     string `json:"follow_interval"`  // The interval between two synchronizations with the peers we follow, for example "5m"
+	MerkleTreeMaxArity int    `json:"merkle_tree_max_arity"`
+	Debug              bool   `json:"debug"`
+	LegacyDates        bool   `json:"legacy_dates"`       // Read the dates written as decimal strings by old peers
+	Extensions         string `json:"extensions"`         // The extensions advertised in the Hello datagrams, comma separated, for example "encryption"
+	SignatureRequired  string `json:"signature_required"` // The types of datagrams that must be signed, comma separated, "all" or "none" (see signaturePolicy.go)
+	UnknownSender      string `json:"unknown_sender"`     // lookup, accept or reject
+	SignatureFailure   string `json:"signature_failure"`  // drop, error or blocklist
+}
+
+var DEFAULT_CONFIG = Config{
+	Name:               "HugoLeonard",
+	Server:             "jch.irif.fr:8443",
+	ListenAddress:      ":8081",
+	MerkleTreeMaxArity: 32,
+	FollowInterval:     "5m",
+	Debug:              true,
+	LegacyDates:        true,
+	Extensions:         "encryption",
+	SignatureRequired:  "hello,hello-reply,root-request,root,send-key,send-key-reply",
+	UnknownSender:      UNKNOWN_SENDER_LOOKUP,
+	SignatureFailure:   SIGNATURE_FAILURE_ERROR,
+}
+
+/* Values of the configuration used everywhere in the peer, set by ApplyConfig() */
+var DEBUG_MODE = DEFAULT_CONFIG.Debug
+var HOST = DEFAULT_CONFIG.Server
+var CA_FILE = DEFAULT_CONFIG.CaFile
+var SERVER_FINGERPRINT = DEFAULT_CONFIG.ServerFingerprint
+var NAME_FOR_SERVER_REGISTRATION = DEFAULT_CONFIG.Name
+var NAME_FILE_PRIVATE_KEY = DEFAULT_CONFIG.Name + "_key.priv"
+var NAME_FILE_KEY_ROTATIONS = NAME_FILE_PRIVATE_KEY + ".rotations.json" // Next to the key file
+var NAME_FILE_POSTS = DEFAULT_CONFIG.Name + "_posts.log"
+var NAME_FILE_TIMELINE = DEFAULT_CONFIG.Name + "_timeline.json"
+var NAME_FILE_FOLLOWS = DEFAULT_CONFIG.Name + "_follows.json"
+var NAME_DIR_NODES = DEFAULT_CONFIG.Name + "_nodes"
+var NAME_FILE_KNOWN_PEERS = DEFAULT_CONFIG.Name + "_known_peers.json"
+var FOLLOW_SYNC_INTERVAL = 5 * time.Minute
+var MERKLE_TREE_MAX_ARITY = DEFAULT_CONFIG.MerkleTreeMaxArity
+var UDP_LISTENING_ADDRESS = DEFAULT_CONFIG.ListenAddress
+var LEGACY_DATES_COMPATIBILITY = DEFAULT_CONFIG.LegacyDates
+var LOCAL_EXTENSIONS = EXTENSION_ENCRYPTION
+
+/* Parses the command-line flags (which come before the command, for example : -name Alice server) and builds the configuration.
+ * Returns the configuration and the remaining arguments.
+ */
+func LoadConfig(flags *flag.FlagSet, args []string) (Config, []string, error) {
+	configFile := flags.String("config", "", "JSON configuration file (default : "+DEFAULT_CONFIG_FILE+" if it exists)")
+	name := flags.String("name", DEFAULT_CONFIG.Name, "name used to register to the server and in the Hello datagrams")
+	server := flags.String("server", DEFAULT_CONFIG.Server, "host:port of the HTTPS server")
+	caFile := flags.String("ca-file", "", "PEM file of the certificate authorities trusted for the server (default : those of the system)")
+	serverFingerprint := flags.String("server-fingerprint", "", "SHA-256 fingerprint of the certificate of the server, in hexadecimal (a self-signed certificate is then accepted)")
+	listenAddress := flags.String("listen", DEFAULT_CONFIG.ListenAddress, "local UDP address")
+	keyFile := flags.String("key-file", "", "file of the private key (default : <name>_key.priv)")
+	postFile := flags.String("post-file", "", "file of the messages we publish (default : <name>_posts.log)")
+	timelineFile := flags.String("timeline-file", "", "file of the last message viewed in the timeline (default : <name>_timeline.json)")
+	followFile := flags.String("follow-file", "", "file of the list of the peers we follow (default : <name>_follows.json)")
+	nodeDir := flags.String("node-dir", "", "directory of the nodes downloaded from the other peers (default : <name>_nodes)")
+	knownPeersFile := flags.String("known-peers-file", "", "file of the keys pinned for the other peers (default : <name>_known_peers.json)")
+	followInterval := flags.String("follow-interval", DEFAULT_CONFIG.FollowInterval, "interval between two synchronizations with the peers we follow")
+	arity := flags.Int("arity", DEFAULT_CONFIG.MerkleTreeMaxArity, "maximum number of children of a node of the Merkle tree")
+	debug := flags.Bool("debug", DEFAULT_CONFIG.Debug, "print debug messages")
+	extensions := flags.String("extensions", DEFAULT_CONFIG.Extensions, "extensions advertised to the other peers, comma separated (\"none\" for none)")
+	signatureRequired := flags.String("signature-required", DEFAULT_CONFIG.SignatureRequired, "types of datagrams that must be signed, comma separated (\"all\" or \"none\")")
+	unknownSender := flags.String("unknown-sender", DEFAULT_CONFIG.UnknownSender, "for a sender whose key we do not know : lookup (its key is asked to the server), accept or reject")
+	signatureFailure := flags.String("signature-failure", DEFAULT_CONFIG.SignatureFailure, "when a signature is missing or invalid : drop, error (an Error datagram is sent) or blocklist (the address of an encrypted session is blocked)")
+	legacyDates := flags.Bool("legacy-dates", DEFAULT_CONFIG.LegacyDates, "read the dates written as decimal strings by old peers")
+
+	if err := flags.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	config := DEFAULT_CONFIG
+
+	// 1. The configuration file
+	fileName, explicit := os.Getenv(CONFIG_ENV_PREFIX+"CONFIG"), false
+	if fileName != "" {
+		explicit = true
+	}
+	if *configFile != "" {
+		fileName, explicit = *configFile, true
+	}
+	if fileName == "" {
+		fileName = DEFAULT_CONFIG_FILE
+	}
+	data, err := os.ReadFile(fileName)
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return Config{}, nil, fmt.Errorf("the configuration file %s is not valid : %v", fileName, err)
+		}
+	} else if explicit || !errors.Is(err, os.ErrNotExist) {
+		return Config{}, nil, err
+	}
+
+	// 2. The environment variables
+	envString := func(key string, value *string) {
+		if env, found := os.LookupEnv(CONFIG_ENV_PREFIX + key); found {
+			*value = env
+		}
+	}
+	envString("NAME", &config.Name)
+	envString("SERVER", &config.Server)
+	envString("CA_FILE", &config.CaFile)
+	envString("SERVER_FINGERPRINT", &config.ServerFingerprint)
+	envString("LISTEN", &config.ListenAddress)
+	envString("KEY_FILE", &config.KeyFile)
+	envString("POST_FILE", &config.PostFile)
+	envString("TIMELINE_FILE", &config.TimelineFile)
+	envString("FOLLOW_FILE", &config.FollowFile)
+	envString("FOLLOW_INTERVAL", &config.FollowInterval)
+	envString("NODE_DIR", &config.NodeDir)
+	envString("KNOWN_PEERS_FILE", &config.KnownPeersFile)
+	envString("EXTENSIONS", &config.Extensions)
+	envString("SIGNATURE_REQUIRED", &config.SignatureRequired)
+	envString("UNKNOWN_SENDER", &config.UnknownSender)
+	envString("SIGNATURE_FAILURE", &config.SignatureFailure)
+	if env, found := os.LookupEnv(CONFIG_ENV_PREFIX + "ARITY"); found {
+		if config.MerkleTreeMaxArity, err = strconv.Atoi(env); err != nil {
+			return Config{}, nil, fmt.Errorf("%sARITY : %v", CONFIG_ENV_PREFIX, err)
+		}
+	}
+	if env, found := os.LookupEnv(CONFIG_ENV_PREFIX + "DEBUG"); found {
+		if config.Debug, err = strconv.ParseBool(env); err != nil {
+			return Config{}, nil, fmt.Errorf("%sDEBUG : %v", CONFIG_ENV_PREFIX, err)
+		}
+	}
+	if env, found := os.LookupEnv(CONFIG_ENV_PREFIX + "LEGACY_DATES"); found {
+		if config.LegacyDates, err = strconv.ParseBool(env); err != nil {
+			return Config{}, nil, fmt.Errorf("%sLEGACY_DATES : %v", CONFIG_ENV_PREFIX, err)
+		}
+	}
+
+	// 3. The flags that were given explicitly
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			config.Name = *name
+		case "server":
+			config.Server = *server
+		case "ca-file":
+			config.CaFile = *caFile
+		case "server-fingerprint":
+			config.ServerFingerprint = *serverFingerprint
+		case "listen":
+			config.ListenAddress = *listenAddress
+		case "key-file":
+			config.KeyFile = *keyFile
+		case "post-file":
+			config.PostFile = *postFile
+		case "timeline-file":
+			config.TimelineFile = *timelineFile
+		case "follow-file":
+			config.FollowFile = *followFile
+		case "follow-interval":
+			config.FollowInterval = *followInterval
+		case "node-dir":
+			config.NodeDir = *nodeDir
+		case "known-peers-file":
+			config.KnownPeersFile = *knownPeersFile
+		case "arity":
+			config.MerkleTreeMaxArity = *arity
+		case "debug":
+			config.Debug = *debug
+		case "legacy-dates":
+			config.LegacyDates = *legacyDates
+		case "extensions":
+			config.Extensions = *extensions
+		case "signature-required":
+			config.SignatureRequired = *signatureRequired
+		case "unknown-sender":
+			config.UnknownSender = *unknownSender
+		case "signature-failure":
+			config.SignatureFailure = *signatureFailure
+		}
+	})
+
+	if config.KeyFile == "" {
+		config.KeyFile = config.Name + "_key.priv"
+	}
+	if config.PostFile == "" {
+		config.PostFile = config.Name + "_posts.log"
+	}
+	if config.TimelineFile == "" {
+		config.TimelineFile = config.Name + "_timeline.json"
+	}
+	if config.FollowFile == "" {
+		config.FollowFile = config.Name + "_follows.json"
+	}
+	if config.NodeDir == "" {
+		config.NodeDir = config.Name + "_nodes"
+	}
+	if config.KnownPeersFile == "" {
+		config.KnownPeersFile = config.Name + "_known_peers.json"
+	}
+
+	return config, flags.Args(), config.Validate()
+}
+
+func (config Config) Validate() error {
+	if config.Name == "" || len(config.Name) > 255 { // The length of the username is a single byte in the Hello datagrams
+		return errors.New("the name must have between 1 and 255 bytes")
+	}
+	if config.Server == "" {
+		return errors.New("the server must not be empty")
+	}
+	if config.ServerFingerprint != "" {
+		if fingerprint, err := hex.DecodeString(normalizeFingerprint(config.ServerFingerprint)); err != nil || len(fingerprint) != sha256.Size {
+			return errors.New("the fingerprint of the server must be the 64 hexadecimal digits of a SHA-256")
+		}
+	}
+	if config.MerkleTreeMaxArity < 2 || config.MerkleTreeMaxArity > MERKLE_TREE_MAX_ARITY_LIMIT {
+		return fmt.Errorf("the arity of the Merkle tree must be between 2 and %d", MERKLE_TREE_MAX_ARITY_LIMIT)
+	}
+	if interval, err := time.ParseDuration(config.FollowInterval); err != nil || interval < 10*time.Second {
+		return errors.New("the follow interval must be a duration of at least 10s, for example 5m")
+	}
+	if _, err := ParseExtensions(config.Extensions); err != nil {
+		return err
+	}
+	if _, err := ParseSignaturePolicy(config.SignatureRequired, config.UnknownSender, config.SignatureFailure); err != nil {
+		return err
+	}
+	return nil
+}
+
+func ApplyConfig(config Config) {
+	DEBUG_MODE = config.Debug
+	HOST = config.Server
+	CA_FILE = config.CaFile
+	SERVER_FINGERPRINT = normalizeFingerprint(config.ServerFingerprint)
+	NAME_FOR_SERVER_REGISTRATION = config.Name
+	NAME_FILE_PRIVATE_KEY = config.KeyFile
+	NAME_FILE_KEY_ROTATIONS = config.KeyFile + ".rotations.json"
+	NAME_FILE_POSTS = config.PostFile
+	NAME_FILE_TIMELINE = config.TimelineFile
+	NAME_FILE_FOLLOWS = config.FollowFile
+	NAME_DIR_NODES = config.NodeDir
+	NAME_FILE_KNOWN_PEERS = config.KnownPeersFile
+	FOLLOW_SYNC_INTERVAL, _ = time.ParseDuration(config.FollowInterval) // Checked by Validate()
+	MERKLE_TREE_MAX_ARITY = config.MerkleTreeMaxArity
+	UDP_LISTENING_ADDRESS = config.ListenAddress
+	LEGACY_DATES_COMPATIBILITY = config.LegacyDates
+	LOCAL_EXTENSIONS, _ = ParseExtensions(config.Extensions) // Checked by Validate()
+
+	var err error
+	if SIGNATURE_POLICY, err = ParseSignaturePolicy(config.SignatureRequired, config.UnknownSender, config.SignatureFailure); err != nil {
+		log.Fatalf("Invalid signature policy : %v \n", err)
+	}
+}
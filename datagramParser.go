@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/* Errors returned by ParseDatagram.
+ * Each malformed case has its own error, so that the caller can use errors.Is() to decide what to do with the datagram.
+ */
+var ErrDatagramTooShort = errors.New("the datagram is shorter than the Id, Type and Length fields")
+var ErrDatagramTruncated = errors.New("the Length field is larger than the received datagram")
+var ErrInvalidSignatureLength = errors.New("the bytes after the body do not form a signature")
+var ErrUnknownDatagramType = errors.New("unknown datagram type")
+var ErrInvalidBodyLength = errors.New("invalid body length for this datagram type")
+var ErrInvalidUsernameLength = errors.New("the username length does not match the body length")
+var ErrInvalidNodeData = errors.New("invalid node data")
+
+type DatagramError struct {
+	Err          error // One of the errors above
+	DatagramType int
+	Detail       string
+}
+
+func (datagramError *DatagramError) Error() string {
+	if datagramError.Detail == "" {
+		return fmt.Sprintf("datagram of type %d : %v", datagramError.DatagramType, datagramError.Err)
+	}
+	return fmt.Sprintf("datagram of type %d : %v (%s)", datagramError.DatagramType, datagramError.Err, datagramError.Detail)
+}
+
+func (datagramError *DatagramError) Unwrap() error {
+	return datagramError.Err
+}
+
+/* The fields common to all datagrams.
+ * Body, Signature and Signed are sub-slices of the buffer given to ParseDatagram().
+ */
+type DatagramHeader struct {
+	Id        []byte
+	Type      int
+	Length    int    // The value of the Length field, checked against the real size of the datagram
+	Body      []byte // Exactly Length bytes
+	Signature []byte // nil if the datagram is not signed
+	Signed    []byte // The bytes covered by the signature : Id, Type, Length and Body
+}
+
+type Datagram interface {
+	Header() *DatagramHeader
+}
+
+func (header *DatagramHeader) Header() *DatagramHeader {
+	return header
+}
+
+type ParsedHello struct {
+	DatagramHeader
+	Flags    uint32
+	Username string
+}
+
+type ParsedHelloReply struct {
+	ParsedHello
+}
+
+type ParsedRootRequest struct {
+	DatagramHeader
+}
+
+type ParsedRoot struct {
+	DatagramHeader
+	Hash []byte
+}
+
+type ParsedGetDatum struct {
+	DatagramHeader
+	Hash []byte
+}
+
+type ParsedDatum struct {
+	DatagramHeader
+	Hash  []byte
+	Value []byte // The node : a type byte followed by a message or by the hashes of the children
+}
+
+type ParsedNoDatum struct {
+	DatagramHeader
+	Hash []byte
+}
+
+type ParsedSendKey struct {
+	DatagramHeader
+	Key []byte
+}
+
+type ParsedSendKeyReply struct {
+	ParsedSendKey
+}
+
+type ParsedError struct {
+	DatagramHeader
+	Message string
+}
+
+/* A function that receives the bytes actually read from the socket and returns the corresponding typed datagram.
+ * The Length field is checked against the real size of the datagram : after the body there is either nothing,
+ * or exactly one signature.
+ */
+func ParseDatagram(datagram []byte) (Datagram, error) {
+	if len(datagram) < DATAGRAM_MIN_LENGTH {
+		return nil, &DatagramError{Err: ErrDatagramTooShort, DatagramType: -1, Detail: fmt.Sprintf("%d bytes", len(datagram))}
+	}
+
+	header := DatagramHeader{
+		Id:     datagram[ID_FIRST_BYTE : ID_FIRST_BYTE+ID_LENGTH],
+		Type:   int(datagram[TYPE_BYTE]),
+		Length: int(binary.BigEndian.Uint16(datagram[LENGTH_FIRST_BYTE : LENGTH_FIRST_BYTE+2])),
+	}
+
+	bodyEnd := BODY_FIRST_BYTE + header.Length
+	if bodyEnd > len(datagram) {
+		return nil, &DatagramError{Err: ErrDatagramTruncated, DatagramType: header.Type,
+			Detail: fmt.Sprintf("Length : %d, body bytes received : %d", header.Length, len(datagram)-BODY_FIRST_BYTE)}
+	}
+
+	header.Body = datagram[BODY_FIRST_BYTE:bodyEnd]
+	header.Signed = datagram[:bodyEnd]
+
+	switch len(datagram) - bodyEnd {
+	case 0:
+	case SIGNATURE_LENGTH:
+		header.Signature = datagram[bodyEnd:]
+	default:
+		return nil, &DatagramError{Err: ErrInvalidSignatureLength, DatagramType: header.Type, Detail: fmt.Sprintf("%d bytes", len(datagram)-bodyEnd)}
+	}
+
+	switch header.Type {
+	case HELLO_TYPE, HELLO_REPLY_TYPE:
+		hello, err := parseHelloBody(header)
+		if err != nil {
+			return nil, err
+		}
+		if header.Type == HELLO_REPLY_TYPE {
+			return &ParsedHelloReply{ParsedHello: *hello}, nil
+		}
+		return hello, nil
+
+	case ROOT_REQUEST_TYPE:
+		if header.Length != ROOT_REQUEST_BODY_LENGTH {
+			return nil, invalidBodyLength(header, ROOT_REQUEST_BODY_LENGTH)
+		}
+		return &ParsedRootRequest{DatagramHeader: header}, nil
+
+	case ROOT_TYPE:
+		if header.Length != ROOT_BODY_LENGTH {
+			return nil, invalidBodyLength(header, ROOT_BODY_LENGTH)
+		}
+		return &ParsedRoot{DatagramHeader: header, Hash: header.Body}, nil
+
+	case GET_DATUM_TYPE:
+		if header.Length != GET_DATUM_BODY_LENGTH {
+			return nil, invalidBodyLength(header, GET_DATUM_BODY_LENGTH)
+		}
+		return &ParsedGetDatum{DatagramHeader: header, Hash: header.Body}, nil
+
+	case NO_DATUM_TYPE:
+		if header.Length != NO_DATUM_BODY_LENGTH {
+			return nil, invalidBodyLength(header, NO_DATUM_BODY_LENGTH)
+		}
+		return &ParsedNoDatum{DatagramHeader: header, Hash: header.Body}, nil
+
+	case DATUM_TYPE:
+		if header.Length <= HASH_LENGTH { // At least the hash and the type byte of the node
+			return nil, &DatagramError{Err: ErrInvalidBodyLength, DatagramType: header.Type,
+				Detail: fmt.Sprintf("Length : %d, expected more than %d", header.Length, HASH_LENGTH)}
+		}
+		value := header.Body[HASH_LENGTH:]
+		if err := ValidateNodeData(value); err != nil {
+			return nil, &DatagramError{Err: ErrInvalidNodeData, DatagramType: header.Type, Detail: err.Error()}
+		}
+		return &ParsedDatum{DatagramHeader: header, Hash: header.Body[:HASH_LENGTH], Value: value}, nil
+
+	case SEND_KEY_HELLO_TYPE, SEND_KEY_HELLO_REPLY_TYPE:
+		sendKey := &ParsedSendKey{DatagramHeader: header, Key: header.Body}
+		if header.Type == SEND_KEY_HELLO_REPLY_TYPE {
+			return &ParsedSendKeyReply{ParsedSendKey: *sendKey}, nil
+		}
+		return sendKey, nil
+
+	case ERROR_TYPE:
+		return &ParsedError{DatagramHeader: header, Message: string(header.Body)}, nil
+	}
+
+	return nil, &DatagramError{Err: ErrUnknownDatagramType, DatagramType: header.Type}
+}
+
+/* Hello and HelloReply : Flags (4 bytes), Username Length (1 byte), Username */
+func parseHelloBody(header DatagramHeader) (*ParsedHello, error) {
+	if header.Length < HELLO_DATAGRAM_BODY_MIN_LENGTH {
+		return nil, &DatagramError{Err: ErrInvalidBodyLength, DatagramType: header.Type,
+			Detail: fmt.Sprintf("Length : %d, expected at least %d", header.Length, HELLO_DATAGRAM_BODY_MIN_LENGTH)}
+	}
+
+	usernameLength := int(header.Body[USER_NAME_LENGTH_BYTE-BODY_FIRST_BYTE])
+	if HELLO_DATAGRAM_BODY_MIN_LENGTH+usernameLength != header.Length {
+		return nil, &DatagramError{Err: ErrInvalidUsernameLength, DatagramType: header.Type,
+			Detail: fmt.Sprintf("Username Length : %d, Length : %d", usernameLength, header.Length)}
+	}
+
+	flags := header.Body[FLAGS_FIRST_BYTE-BODY_FIRST_BYTE : FLAGS_FIRST_BYTE-BODY_FIRST_BYTE+FLAGS_LENGTH]
+	username := header.Body[USER_NAME_FIRST_BYTE-BODY_FIRST_BYTE:]
+
+	return &ParsedHello{DatagramHeader: header, Flags: binary.BigEndian.Uint32(flags), Username: string(username)}, nil
+}
+
+func invalidBodyLength(header DatagramHeader, expectedLength int) error {
+	return &DatagramError{Err: ErrInvalidBodyLength, DatagramType: header.Type,
+		Detail: fmt.Sprintf("Length : %d, expected %d", header.Length, expectedLength)}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+/* A datagram whose Length field is length, followed by trailer bytes in place of a signature */
+func rawDatagram(datagramType int, length int, body []byte, trailer int) []byte {
+	datagram := make([]byte, BODY_FIRST_BYTE, BODY_FIRST_BYTE+len(body)+trailer)
+	copy(datagram, "abcd")
+	datagram[TYPE_BYTE] = byte(datagramType)
+	binary.BigEndian.PutUint16(datagram[LENGTH_FIRST_BYTE:], uint16(length))
+	datagram = append(datagram, body...)
+	return append(datagram, bytes.Repeat([]byte{7}, trailer)...)
+}
+
+func helloBody(usernameLength int, username string) []byte {
+	body := []byte{0, 0, 0, 1, byte(usernameLength)}
+	return append(body, username...)
+}
+
+func TestParseDatagram(t *testing.T) {
+	hash := bytes.Repeat([]byte{1}, HASH_LENGTH)
+	message := CreateMessage("hello", inReplyToZeroes())
+	internalNode := append([]byte{NODE_TYPE_INTERNAL}, hash...)
+
+	tests := []struct {
+		name     string
+		buf      []byte
+		expected error // nil if the datagram is valid
+	}{
+		{"empty", nil, ErrDatagramTooShort},
+		{"id only", []byte("abcd"), ErrDatagramTooShort},
+		{"no length", []byte("abcd\x01\x00"), ErrDatagramTooShort},
+		{"root request", rawDatagram(ROOT_REQUEST_TYPE, 0, nil, 0), nil},
+		{"signed root request", rawDatagram(ROOT_REQUEST_TYPE, 0, nil, SIGNATURE_LENGTH), nil},
+		{"root request with a body", rawDatagram(ROOT_REQUEST_TYPE, 1, []byte{0}, 0), ErrInvalidBodyLength},
+		{"truncated", rawDatagram(ROOT_TYPE, HASH_LENGTH, hash[:10], 0), ErrDatagramTruncated},
+		{"length 65535", rawDatagram(ERROR_TYPE, 0xffff, []byte("error"), 0), ErrDatagramTruncated},
+		{"short signature", rawDatagram(ROOT_TYPE, HASH_LENGTH, hash, SIGNATURE_LENGTH-1), ErrInvalidSignatureLength},
+		{"long signature", rawDatagram(ROOT_TYPE, HASH_LENGTH, hash, SIGNATURE_LENGTH+1), ErrInvalidSignatureLength},
+		{"one byte after the body", rawDatagram(ROOT_TYPE, HASH_LENGTH, hash, 1), ErrInvalidSignatureLength},
+		{"unknown type", rawDatagram(3, 0, nil, 0), ErrUnknownDatagramType},
+		{"unknown reply type", rawDatagram(255, 0, nil, 0), ErrUnknownDatagramType},
+		{"root", rawDatagram(ROOT_TYPE, HASH_LENGTH, hash, SIGNATURE_LENGTH), nil},
+		{"short root", rawDatagram(ROOT_TYPE, HASH_LENGTH-1, hash[1:], 0), ErrInvalidBodyLength},
+		{"get datum", rawDatagram(GET_DATUM_TYPE, HASH_LENGTH, hash, 0), nil},
+		{"long get datum", rawDatagram(GET_DATUM_TYPE, HASH_LENGTH+1, append(hash, 0), 0), ErrInvalidBodyLength},
+		{"no datum", rawDatagram(NO_DATUM_TYPE, HASH_LENGTH, hash, 0), nil},
+		{"empty no datum", rawDatagram(NO_DATUM_TYPE, 0, nil, 0), ErrInvalidBodyLength},
+		{"datum of a message", rawDatagram(DATUM_TYPE, HASH_LENGTH+len(message), append(hash, message...), 0), nil},
+		{"datum of an internal node", rawDatagram(DATUM_TYPE, HASH_LENGTH+len(internalNode), append(hash, internalNode...), 0), nil},
+		{"datum without node", rawDatagram(DATUM_TYPE, HASH_LENGTH, hash, 0), ErrInvalidBodyLength},
+		{"datum without hash", rawDatagram(DATUM_TYPE, 10, hash[:10], 0), ErrInvalidBodyLength},
+		{"datum of an unknown node", rawDatagram(DATUM_TYPE, HASH_LENGTH+1, append(hash, 9), 0), ErrInvalidNodeData},
+		{"datum of a cut message", rawDatagram(DATUM_TYPE, HASH_LENGTH+len(message)-1, append(hash, message[:len(message)-1]...), 0), ErrInvalidNodeData},
+		{"datum of a cut internal node", rawDatagram(DATUM_TYPE, HASH_LENGTH+10, append(hash, internalNode[:10]...), 0), ErrInvalidNodeData},
+		{"hello", rawDatagram(HELLO_TYPE, 8, helloBody(3, "bob"), SIGNATURE_LENGTH), nil},
+		{"hello without name", rawDatagram(HELLO_TYPE, 5, helloBody(0, ""), 0), nil},
+		{"hello reply", rawDatagram(HELLO_REPLY_TYPE, 8, helloBody(3, "bob"), 0), nil},
+		{"hello without flags", rawDatagram(HELLO_TYPE, 4, helloBody(0, "")[:4], 0), ErrInvalidBodyLength},
+		{"username longer than the body", rawDatagram(HELLO_TYPE, 8, helloBody(200, "bob"), 0), ErrInvalidUsernameLength},
+		{"username shorter than the body", rawDatagram(HELLO_REPLY_TYPE, 8, helloBody(2, "bob"), 0), ErrInvalidUsernameLength},
+		{"send key", rawDatagram(SEND_KEY_HELLO_TYPE, 64, bytes.Repeat([]byte{2}, 64), 0), nil},
+		{"error", rawDatagram(ERROR_TYPE, 5, []byte("error"), SIGNATURE_LENGTH), nil},
+		{"empty error", rawDatagram(ERROR_TYPE, 0, nil, 0), nil},
+	}
+	for _, test := range tests {
+		datagram, err := ParseDatagram(test.buf)
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("%s : %v", test.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, test.expected) || datagram != nil {
+			t.Errorf("%s : datagram %v, error %v, expected %v", test.name, datagram, err, test.expected)
+		}
+		var datagramError *DatagramError
+		if !errors.As(err, &datagramError) {
+			t.Errorf("%s : the error %v is not a DatagramError", test.name, err)
+		}
+	}
+}
+
+/* The fields of the parsed datagram are the bytes of the buffer */
+func TestParseDatagramFields(t *testing.T) {
+	buf := rawDatagram(HELLO_REPLY_TYPE, 10, helloBody(5, "alice"), SIGNATURE_LENGTH)
+	copy(buf, "wxyz")
+
+	datagram, err := ParseDatagram(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, ok := datagram.(*ParsedHelloReply)
+	if !ok {
+		t.Fatalf("%T, expected a HelloReply", datagram)
+	}
+	header := reply.Header()
+	if string(header.Id) != "wxyz" || header.Type != HELLO_REPLY_TYPE || header.Length != 10 || reply.Username != "alice" || reply.Flags != 1 {
+		t.Errorf("Id %q, Type %d, Length %d, Username %q, Flags %d", header.Id, header.Type, header.Length, reply.Username, reply.Flags)
+	}
+	if !bytes.Equal(header.Signature, buf[len(buf)-SIGNATURE_LENGTH:]) || !bytes.Equal(header.Signed, buf[:len(buf)-SIGNATURE_LENGTH]) {
+		t.Error("the signature is not the end of the datagram")
+	}
+
+	hash := bytes.Repeat([]byte{3}, HASH_LENGTH)
+	datagram, err = ParseDatagram(rawDatagram(GET_DATUM_TYPE, HASH_LENGTH, hash, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getDatum, ok := datagram.(*ParsedGetDatum); !ok || !bytes.Equal(getDatum.Hash, hash) || getDatum.Header().Signature != nil {
+		t.Errorf("%v, expected a GetDatum of %x without signature", datagram, hash)
+	}
+}
+
+/* Any input : an error or a datagram whose fields are inside the buffer, never a panic */
+func FuzzParseDatagram(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(rawDatagram(HELLO_TYPE, 8, helloBody(3, "bob"), SIGNATURE_LENGTH))
+	f.Add(rawDatagram(DATUM_TYPE, HASH_LENGTH+1, append(bytes.Repeat([]byte{1}, HASH_LENGTH), NODE_TYPE_INTERNAL), 0))
+	f.Add(rawDatagram(ERROR_TYPE, 0xffff, nil, 0))
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		datagram, err := ParseDatagram(buf)
+		if err != nil {
+			return
+		}
+		header := datagram.Header()
+		if len(header.Body) != header.Length || len(header.Signed) != BODY_FIRST_BYTE+header.Length {
+			t.Errorf("Length %d, body of %d bytes, %d bytes signed", header.Length, len(header.Body), len(header.Signed))
+		}
+		if len(header.Signed)+len(header.Signature) != len(buf) {
+			t.Errorf("%d bytes signed and %d of signature in a datagram of %d bytes", len(header.Signed), len(header.Signature), len(buf))
+		}
+	})
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* The directory server (serveur de rendez-vous) : the same HTTP and UDP interface as jch.irif.fr,
+ * so that a team can run its own server and test the peers offline.
+ *
+ * HTTPS : GET /udp-address, POST /register, GET /server-key, GET /peers, GET /peers/<name>
+ * UDP   : answers Hello with a signed HelloReply and records the address the Hello came from. The other datagrams are dropped :
+ *         an answer could be sent to the forged source address of a datagram.
+ * A name keeps the key it was registered with, unless the registration brings the rotations from that key to the new one (see keyRotation.go).
+ * A name registered without a key gets the first key it is registered with.
+ */
+
+const DIRECTORY_SERVER_NAME = "server"             // The username in the HelloReply datagrams of the server
+const DIRECTORY_ADDRESS_TIMEOUT = 55 * time.Minute // An address is forgotten if no Hello came from it for this long
+const DIRECTORY_MAX_REGISTRATION_BODY = 16384      // Maximum size of the body of a POST to /register (with KEY_ROTATIONS_MAX rotations)
+const DIRECTORY_CERTIFICATE_VALIDITY = 365 * 24 * time.Hour
+
+type directoryPeer struct {
+	Name      string
+	Key       string               // base64 of the 64 bytes of the public key, empty if the peer does not sign its messages
+	Addresses map[string]time.Time // "ip:port" -> time of the last Hello from this address
+	Rotations []KeyRotation        // The last rotations of the key, given with the peer
+}
+
+type DirectoryServer struct {
+	mutex        sync.Mutex
+	peers        map[string]*directoryPeer
+	privateKey   *ecdsa.PrivateKey
+	udpAddresses []Address // The addresses returned by /udp-address
+}
+
+func RunDirectoryServer(args []string) {
+	flags := flag.NewFlagSet("server", flag.ExitOnError)
+	httpAddress := flags.String("http", ":8443", "address of the HTTPS server")
+	udpAddress := flags.String("udp", ":8082", "address of the UDP server")
+	advertise := flags.String("advertise", "", "comma separated ip:port list returned by /udp-address (default : 127.0.0.1 and the port of -udp)")
+	keyFile := flags.String("key", "server_key.pem", "the private key used to sign the datagrams of the server (created if it does not exist)")
+	certFile := flags.String("cert", "server_cert.pem", "TLS certificate (a self-signed certificate is created if it does not exist)")
+	tlsKeyFile := flags.String("tls-key", "server_tls_key.pem", "TLS private key (created with the certificate)")
+	hostnames := flags.String("hostname", "localhost", "comma separated host names for the self-signed certificate")
+	flags.Parse(args)
+
+	privateKey, err := loadOrCreateServerKey(*keyFile)
+	if err != nil {
+		log.Fatalf("The private key of the server could not be loaded from %s : %v \n", *keyFile, err)
+	}
+
+	server := &DirectoryServer{peers: make(map[string]*directoryPeer), privateKey: privateKey}
+
+	server.udpAddresses, err = advertisedAddresses(*advertise, *udpAddress)
+	if err != nil {
+		log.Fatalf("Invalid UDP address to advertise : %v \n", err)
+	}
+
+	certificate, err := loadOrCreateCertificate(*certFile, *tlsKeyFile, strings.Split(*hostnames, ","))
+	if err != nil {
+		log.Fatalf("The TLS certificate could not be loaded : %v \n", err)
+	}
+	fingerprint := sha256.Sum256(certificate.Certificate[0])
+	log.Printf("TLS CERTIFICATE %s, SHA-256 FINGERPRINT : %x \n", *certFile, fingerprint)
+
+	conn, err := net.ListenPacket("udp", *udpAddress)
+	if err != nil {
+		log.Fatalf("The method net.ListenPacket() failed with %s address : %v\n", *udpAddress, err)
+	}
+	log.Printf("UDP : LISTENING TO %s \n", *udpAddress)
+	go server.udpLoop(conn)
+
+	httpServer := &http.Server{
+		Addr:              *httpAddress,
+		Handler:           server.handler(),
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{certificate}},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("HTTPS : LISTENING TO %s \n", *httpAddress)
+	log.Fatal(httpServer.ListenAndServeTLS("", ""))
+}
+
+/******************************************** HTTP ********************************************/
+
+func (server *DirectoryServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/udp-address", server.handleUdpAddress)
+	mux.HandleFunc("/register", server.handleRegister)
+	mux.HandleFunc("/server-key", server.handleServerKey)
+	mux.HandleFunc("/peers", server.handlePeers)
+	mux.HandleFunc("/peers/", server.handlePeer)
+	return mux
+}
+
+func (server *DirectoryServer) handleUdpAddress(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(server.udpAddresses)
+}
+
+func (server *DirectoryServer) handleRegister(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(request.Body, DIRECTORY_MAX_REGISTRATION_BODY))
+	if err != nil {
+		http.Error(writer, "could not read the body", http.StatusBadRequest)
+		return
+	}
+
+	var registration ServerRegistration
+	if err := json.Unmarshal(body, &registration); err != nil {
+		http.Error(writer, "invalid JSON : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validatePeerName(registration.Name); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if registration.Key != "" {
+		keyBytes, err := base64.RawStdEncoding.DecodeString(registration.Key)
+		if err == nil {
+			_, err = ConvertBytesToEcdsaPublicKey(keyBytes)
+		}
+		if err != nil {
+			http.Error(writer, "invalid key : "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The rotations must lead to the key of the registration
+	if len(registration.Rotations) > KEY_ROTATIONS_MAX {
+		http.Error(writer, fmt.Sprintf("at most %d rotations", KEY_ROTATIONS_MAX), http.StatusBadRequest)
+		return
+	}
+	if len(registration.Rotations) > 0 {
+		key, err := FollowKeyRotations(registration.Name, registration.Rotations[0].OldKey, registration.Rotations)
+		if err != nil {
+			http.Error(writer, "invalid rotations : "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if key != registration.Key {
+			http.Error(writer, "the rotations do not lead to the key of the registration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	peer, found := server.peers[registration.Name]
+	if found && peer.Key == "" && registration.Key != "" {
+		// The first key of the name : there is no old key to sign a rotation
+		peer.Key = registration.Key
+		peer.Addresses = make(map[string]time.Time) // They were given by Hello datagrams that were not signed
+		log.Printf("FIRST KEY FOR %s \n", registration.Name)
+	} else if found && peer.Key != registration.Key {
+		// Only the old key can hand the name over to a new one
+		key, _ := FollowKeyRotations(registration.Name, peer.Key, registration.Rotations)
+		if key != registration.Key {
+			http.Error(writer, "this name is already registered with another key", http.StatusConflict)
+			return
+		}
+		peer.Key = registration.Key
+		peer.Addresses = make(map[string]time.Time) // They were given by Hello datagrams signed with the old key
+		log.Printf("NEW KEY FOR %s (KEY ROTATION) \n", registration.Name)
+	}
+	if !found {
+		peer = &directoryPeer{Name: registration.Name, Key: registration.Key, Addresses: make(map[string]time.Time)}
+		server.peers[registration.Name] = peer
+		log.Printf("REGISTRATION OF %s \n", registration.Name)
+	}
+	peer.Rotations = mergeKeyRotations(peer.Rotations, registration.Rotations)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+/* The rotations we know, followed by the new ones, at most KEY_ROTATIONS_MAX */
+func mergeKeyRotations(known []KeyRotation, rotations []KeyRotation) []KeyRotation {
+	for _, rotation := range rotations {
+		found := false
+		for _, knownRotation := range known {
+			if knownRotation.OldKey == rotation.OldKey && knownRotation.NewKey == rotation.NewKey {
+				found = true
+				break
+			}
+		}
+		if !found {
+			known = append(known, rotation)
+		}
+	}
+	if len(known) > KEY_ROTATIONS_MAX {
+		known = known[len(known)-KEY_ROTATIONS_MAX:]
+	}
+	return known
+}
+
+func (server *DirectoryServer) handleServerKey(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	publicKey64Bytes := make([]byte, 64)
+	server.privateKey.PublicKey.X.FillBytes(publicKey64Bytes[:32])
+	server.privateKey.PublicKey.Y.FillBytes(publicKey64Bytes[32:])
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Write(publicKey64Bytes)
+}
+
+/* The names of the peers that have at least one recent address, one per line */
+func (server *DirectoryServer) handlePeers(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	server.mutex.Lock()
+	var names []string
+	for name, peer := range server.peers {
+		if len(server.liveAddresses(peer)) > 0 {
+			names = append(names, name)
+		}
+	}
+	server.mutex.Unlock()
+
+	sort.Strings(names)
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintln(writer, name)
+	}
+}
+
+func (server *DirectoryServer) handlePeer(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(request.URL.Path, "/peers/")
+
+	server.mutex.Lock()
+	peer, found := server.peers[name]
+	var response Peer
+	if found {
+		response = Peer{Username: peer.Name, Addresses: server.liveAddresses(peer), Key: peer.Key, Rotations: peer.Rotations}
+	}
+	server.mutex.Unlock()
+
+	if !found || len(response.Addresses) == 0 {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(response)
+}
+
+/* The addresses from which the peer sent a Hello recently. The caller must hold server.mutex. */
+func (server *DirectoryServer) liveAddresses(peer *directoryPeer) []Address {
+	addresses := []Address{}
+	for fullAddress, lastHello := range peer.Addresses {
+		if time.Since(lastHello) > DIRECTORY_ADDRESS_TIMEOUT {
+			delete(peer.Addresses, fullAddress)
+			continue
+		}
+		udpAddress, err := net.ResolveUDPAddr("udp", fullAddress)
+		if err != nil {
+			continue
+		}
+		addresses = append(addresses, Address{Ip: udpAddress.IP.String(), Port: uint64(udpAddress.Port)})
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].Ip < addresses[j].Ip || (addresses[i].Ip == addresses[j].Ip && addresses[i].Port < addresses[j].Port)
+	})
+	return addresses
+}
+
+func validatePeerName(name string) error {
+	if name == "" || len(name) > 255 { // The username length must fit in one byte of the Hello datagram
+		return errors.New("the name must have between 1 and 255 bytes")
+	}
+	if strings.ContainsAny(name, "/\n\r") {
+		return errors.New("the name must not contain '/' or a line break")
+	}
+	return nil
+}
+
+/******************************************** UDP ********************************************/
+
+func (server *DirectoryServer) udpLoop(conn net.PacketConn) {
+	for {
+		buf := make([]byte, BUFFER_SIZE)
+		n, address, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("The method conn.ReadFrom() failed in udpLoop() : %v \n", err)
+			continue
+		}
+		buf = buf[:n]
+
+		udpAddress, ok := address.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		datagram, err := ParseDatagram(buf)
+		if err != nil {
+			log.Printf("INVALID DATAGRAM FROM %s : %v \n", udpAddress.String(), err)
+			continue
+		}
+
+		// Only a Hello is answered
+		if hello, ok := datagram.(*ParsedHello); ok {
+			if err := server.recordHello(hello, buf, udpAddress); err != nil {
+				log.Printf("HELLO FROM %s REFUSED : %v \n", udpAddress.String(), err)
+				server.answerError(conn, udpAddress, hello.Id, err.Error())
+				continue
+			}
+			reply := HelloOrHelloReplyDatagram(false, string(hello.Id), DIRECTORY_SERVER_NAME, 0, server.privateKey) // The server implements no extension
+			if _, err := conn.WriteTo(reply, udpAddress); err != nil {
+				log.Printf("The method WriteTo failed in udpLoop() to %s : %v \n", udpAddress.String(), err)
+			}
+		}
+	}
+}
+
+/* A Hello must come from a registered peer and be signed with its key (if it registered one) */
+func (server *DirectoryServer) recordHello(hello *ParsedHello, buf []byte, address *net.UDPAddr) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	peer, found := server.peers[hello.Username]
+	if !found {
+		return fmt.Errorf("the peer %s is not registered (POST /register first)", hello.Username)
+	}
+
+	if peer.Key != "" {
+		if err := verifyPeerSignature(buf, Peer{Username: peer.Name, Key: peer.Key}); err != nil {
+			return err
+		}
+	}
+
+	if _, known := peer.Addresses[address.String()]; !known {
+		log.Printf("NEW ADDRESS FOR %s : %s \n", peer.Name, address.String())
+	}
+	peer.Addresses[address.String()] = time.Now()
+	return nil
+}
+
+/* The Error datagram in response to a Hello we refuse */
+func (server *DirectoryServer) answerError(conn net.PacketConn, address *net.UDPAddr, id []byte, message string) {
+	errorDatagram := ErrorDatagram(string(id), []byte(message), server.privateKey)
+	if _, err := conn.WriteTo(errorDatagram, address); err != nil {
+		log.Printf("The method WriteTo failed in udpLoop() to %s : %v \n", address.String(), err)
+	}
+}
+
+/******************************************** KEYS AND CERTIFICATE ********************************************/
+
+func advertisedAddresses(advertise string, udpListeningAddress string) ([]Address, error) {
+	if advertise == "" {
+		_, port, err := net.SplitHostPort(udpListeningAddress)
+		if err != nil {
+			return nil, err
+		}
+		advertise = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	var addresses []Address
+	for _, fullAddress := range strings.Split(advertise, ",") {
+		host, port, err := net.SplitHostPort(strings.TrimSpace(fullAddress))
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("%s is not an IP address", host)
+		}
+		portNumber, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, Address{Ip: host, Port: portNumber})
+	}
+	return addresses, nil
+}
+
+func loadOrCreateServerKey(fileName string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("NEW PRIVATE KEY FOR THE SERVER : %s \n", fileName)
+		return privateKey, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, errors.New("no EC PRIVATE KEY block in the file")
+	}
+	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if privateKey.Curve != elliptic.P256() {
+		return nil, errors.New("the key is not a P-256 key")
+	}
+	return privateKey, nil
+}
+
+/* If the certificate does not exist, we create a self-signed one. Its fingerprint is logged at startup. */
+func loadOrCreateCertificate(certFile string, keyFile string, hostnames []string) (tls.Certificate, error) {
+	if _, err := os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+
+		template := x509.Certificate{
+			SerialNumber:          serialNumber,
+			Subject:               pkix.Name{CommonName: hostnames[0]},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(DIRECTORY_CERTIFICATE_VALIDITY),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		}
+		for _, hostname := range hostnames {
+			if ip := net.ParseIP(hostname); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else if hostname != "" {
+				template.DNSNames = append(template.DNSNames, hostname)
+			}
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		keyDer, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Printf("NEW SELF-SIGNED CERTIFICATE : %s \n", certFile)
+	}
+
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* A directory server with its HTTP interface and its UDP socket, and the socket of a peer */
+type testDirectory struct {
+	server   *DirectoryServer
+	url      string
+	address  *net.UDPAddr
+	peerConn net.PacketConn
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	t.Helper()
+	server := &DirectoryServer{peers: make(map[string]*directoryPeer), privateKey: testPrivateKey(t)}
+	httpServer := httptest.NewServer(server.handler())
+	t.Cleanup(httpServer.Close)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go server.udpLoop(conn)
+
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peerConn.Close() })
+	return &testDirectory{server: server, url: httpServer.URL, address: conn.LocalAddr().(*net.UDPAddr), peerConn: peerConn}
+}
+
+func (directory *testDirectory) register(t *testing.T, registration ServerRegistration) int {
+	t.Helper()
+	body, err := json.Marshal(registration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.Post(directory.url+"/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+/* The names listed by /peers */
+func (directory *testDirectory) peers(t *testing.T) []string {
+	t.Helper()
+	response, err := http.Get(directory.url + "/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var body bytes.Buffer
+	body.ReadFrom(response.Body)
+	return strings.Fields(body.String())
+}
+
+/* The peer of /peers/<name>, nil if it is not found */
+func (directory *testDirectory) peer(t *testing.T, name string) *Peer {
+	t.Helper()
+	response, err := http.Get(directory.url + "/peers/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	var peer Peer
+	if err := json.NewDecoder(response.Body).Decode(&peer); err != nil {
+		t.Fatal(err)
+	}
+	return &peer
+}
+
+/* Sends the datagram to the server and returns its answer, or nil */
+func (directory *testDirectory) send(t *testing.T, datagram []byte) []byte {
+	t.Helper()
+	if _, err := directory.peerConn.WriteTo(datagram, directory.address); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, BUFFER_SIZE)
+	directory.peerConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	n, _, err := directory.peerConn.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func (directory *testDirectory) hello(t *testing.T, name string, privateKey *ecdsa.PrivateKey) Datagram {
+	t.Helper()
+	answer := directory.send(t, HelloOrHelloReplyDatagram(true, NewDatagramId(), name, 0, privateKey))
+	if answer == nil {
+		t.Fatalf("the Hello of %s is not answered", name)
+	}
+	datagram, err := ParseDatagram(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifySignature(answer, &directory.server.privateKey.PublicKey) {
+		t.Error("the answer of the server is not signed with its key")
+	}
+	return datagram
+}
+
+func TestDirectoryServer(t *testing.T) {
+	directory := newTestDirectory(t)
+	rotations, privateKeys := testKeyRotations(t, "alice", 1)
+	oldKey, newKey := CreatePublicKeyEncoded(privateKeys[0]), CreatePublicKeyEncoded(privateKeys[1])
+	peerAddress := directory.peerConn.LocalAddr().(*net.UDPAddr)
+
+	if status := directory.register(t, ServerRegistration{Name: "alice", Key: oldKey}); status != http.StatusNoContent {
+		t.Fatalf("the registration ended with %d", status)
+	}
+	if names := directory.peers(t); len(names) != 0 || directory.peer(t, "alice") != nil {
+		t.Fatalf("a peer without address is listed : %v", names)
+	}
+
+	// The Hello gives the address of the peer
+	if _, ok := directory.hello(t, "alice", privateKeys[0]).(*ParsedHelloReply); !ok {
+		t.Fatal("the Hello is not answered with a HelloReply")
+	}
+	if names := directory.peers(t); len(names) != 1 || names[0] != "alice" {
+		t.Errorf("/peers is %v, expected alice", names)
+	}
+	peer := directory.peer(t, "alice")
+	if peer == nil || peer.Key != oldKey || len(peer.Addresses) != 1 || peer.Addresses[0].Port != uint64(peerAddress.Port) {
+		t.Fatalf("/peers/alice is %+v", peer)
+	}
+
+	// A Hello signed with another key, or from a name that is not registered, is refused
+	if _, ok := directory.hello(t, "alice", privateKeys[1]).(*ParsedError); !ok {
+		t.Error("the Hello signed with another key is accepted")
+	}
+	if _, ok := directory.hello(t, "bob", privateKeys[0]).(*ParsedError); !ok {
+		t.Error("the Hello of a name that is not registered is accepted")
+	}
+
+	// Only the rotations from the old key give the name to the new key
+	if status := directory.register(t, ServerRegistration{Name: "alice", Key: newKey}); status != http.StatusConflict {
+		t.Errorf("the registration with another key ended with %d", status)
+	}
+	if status := directory.register(t, ServerRegistration{Name: "alice", Key: newKey, Rotations: rotations}); status != http.StatusNoContent {
+		t.Fatalf("the registration with the rotation ended with %d", status)
+	}
+	if directory.peer(t, "alice") != nil {
+		t.Error("the addresses given with the old key are kept")
+	}
+	if _, ok := directory.hello(t, "alice", privateKeys[0]).(*ParsedError); !ok {
+		t.Error("the Hello signed with the old key is accepted")
+	}
+	directory.hello(t, "alice", privateKeys[1])
+	peer = directory.peer(t, "alice")
+	if peer == nil || peer.Key != newKey || len(peer.Rotations) != 1 {
+		t.Errorf("/peers/alice is %+v, expected the new key and its rotation", peer)
+	}
+}
+
+/* A name registered without a key gets the first key it is registered with, and keeps it */
+func TestDirectoryServerFirstKey(t *testing.T) {
+	directory := newTestDirectory(t)
+	privateKey, otherPrivateKey := testPrivateKey(t), testPrivateKey(t)
+	key := CreatePublicKeyEncoded(privateKey)
+
+	tests := []struct {
+		name     string
+		key      string
+		expected int
+	}{
+		{"without a key", "", http.StatusNoContent},
+		{"first key", key, http.StatusNoContent},
+		{"same key", key, http.StatusNoContent},
+		{"without a key again", "", http.StatusConflict},
+		{"another key", CreatePublicKeyEncoded(otherPrivateKey), http.StatusConflict},
+	}
+	for _, test := range tests {
+		if status := directory.register(t, ServerRegistration{Name: "bob", Key: test.key}); status != test.expected {
+			t.Errorf("%s : the registration ended with %d, expected %d", test.name, status, test.expected)
+		}
+	}
+
+	directory.hello(t, "bob", privateKey)
+	if peer := directory.peer(t, "bob"); peer == nil || peer.Key != key {
+		t.Errorf("/peers/bob is %+v, expected the first key", peer)
+	}
+}
+
+/* The server only answers Hello : an answer to another datagram could be sent to a forged address */
+func TestDirectoryServerDropsOtherDatagrams(t *testing.T) {
+	directory := newTestDirectory(t)
+	privateKey := testPrivateKey(t)
+
+	datagrams := map[string][]byte{
+		"RootRequest": RootRequestDatagram(NewDatagramId(), privateKey),
+		"GetDatum":    GetDatumDatagram(NewDatagramId(), make([]byte, HASH_LENGTH), privateKey),
+		"Error":       ErrorDatagram(NewDatagramId(), []byte("error"), privateKey),
+		"invalid":     []byte("not a datagram"),
+	}
+	for name, datagram := range datagrams {
+		if answer := directory.send(t, datagram); answer != nil {
+			t.Errorf("the %s datagram is answered", name)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const DOWNLOAD_WINDOW = 16 // The number of GetDatum requests that can be outstanding at the same time to a single peer
+const DOWNLOAD_PROGRESS_INTERVAL = time.Second
+const DOWNLOAD_MAX_HANDSHAKES = 2 // The number of times we do the handshake again during a download when the peer forgot our session
+
+/* Like UdpWrite : 2 + 4 + 8 + 16 seconds before giving up on a node. Variables, so that the tests do not wait. */
+var DOWNLOAD_MAX_ATTEMPTS = 4
+var DOWNLOAD_FIRST_TIMEOUT = 2 * time.Second
+
+type DownloadStats struct {
+	NodesFetched   int // Nodes received and added to the Merkle tree
+	NodesSkipped   int // Nodes we already had in the tree (incremental update)
+	NodesFromStore int // Nodes read from the node store, downloaded during a previous run
+	NodesMissing   int // Nodes for which the peer answered NoDatum
+	NodesFailed    int // Nodes with no answer after DOWNLOAD_MAX_ATTEMPTS, or that could not be added to the tree
+	Retries        int
+	Handshakes     int // Handshakes done again because the peer forgot our session
+	BytesReceived  int
+	Duration       time.Duration
+}
+
+func (stats DownloadStats) String() string {
+	return fmt.Sprintf("%d nodes fetched, %d already known, %d from the node store, %d missing (NoDatum), %d failed, %d retries, %d handshakes, %d bytes received in %v",
+		stats.NodesFetched, stats.NodesSkipped, stats.NodesFromStore, stats.NodesMissing, stats.NodesFailed, stats.Retries, stats.Handshakes, stats.BytesReceived, stats.Duration.Round(time.Millisecond))
+}
+
+/* A GetDatum request that has been sent and for which we are waiting for a Datum or a NoDatum */
+type pendingDatum struct {
+	Hash     []byte
+	Datagram []byte
+	Attempts int
+	SentAt   time.Time // The last attempt
+	Deadline time.Time
+}
+
+/* Downloads the nodes of the Merkle tree of another peer that we do not have yet, starting from the root hash.
+ * Instead of waiting for the answer to each GetDatum before sending the next one, up to window requests are outstanding at the same time.
+ * Each answer is added to the tree with MerkleTree.AddNode(), and the hashes of the children of an internal node are queued in turn.
+ * A request without answer is sent again with an exponentially growing timeout.
+ * The nodes found in the node store (if store is not nil) are not requested, and the nodes we receive are added to it.
+ */
+func DownloadMerkleTree(conn net.PacketConn, address *net.UDPAddr, merkle *MerkleTree, rootHash []byte, window int, store *NodeStore, privateKey *ecdsa.PrivateKey) (DownloadStats, error) {
+	var stats DownloadStats
+	start := time.Now()
+	lastProgress := start
+
+	if window < 1 {
+		window = 1
+	}
+
+	lastHandshake := time.Time{} // The requests sent before were sent without a session if the peer answered that it forgot it
+	queue := [][]byte{rootHash}
+	pending := make(map[string]*pendingDatum) // Key : the id of the request
+	responses := make(chan Datagram, window)
+
+	// When we leave, the requests that are still outstanding must no longer be waited for
+	defer func() {
+		if store != nil {
+			if err := store.Sync(); err != nil {
+				log.Printf("The method Sync() failed in DownloadMerkleTree() : %v \n", err)
+			}
+		}
+
+		mutex.Lock()
+		for id := range pending {
+			j := sliceContainsWaitingResponse(waitingResponses, address.String(), []byte(id))
+			if j != -1 {
+				waitingResponses = append(waitingResponses[:j], waitingResponses[j+1:]...)
+			}
+		}
+		mutex.Unlock()
+	}()
+
+	for len(queue) > 0 || len(pending) > 0 {
+
+		// We fill the window
+		for len(pending) < window && len(queue) > 0 {
+			hash := queue[0]
+			queue = queue[1:]
+
+			// A node we already have, except for a new root that is a node of the current tree
+			if merkle.FindNode(hash) != nil && (!bytes.Equal(hash, rootHash) || bytes.Equal(hash, merkle.Root.Hash)) {
+				stats.NodesSkipped++
+				continue
+			}
+
+			// A node we downloaded during a previous run
+			if store != nil {
+				if nodeData := store.Get(hash); nodeData != nil && merkle.AddNode(hash, nodeData) {
+					stats.NodesFromStore++
+					queue = append(queue, childHashes(nodeData)...)
+					continue
+				}
+			}
+
+			id := NewDatagramId()
+			datagram, responseOptions := buildDatagram(conn, id, GET_DATUM_TYPE, address, hash, privateKey)
+
+			mutex.Lock()
+			waitingResponses = append(waitingResponses, WaitingResponse{FullAddress: address, DatagramTypes: responseOptions, Id: []byte(id), Responses: responses})
+			mutex.Unlock()
+
+			pending[id] = &pendingDatum{Hash: hash, Datagram: datagram, Attempts: 1, SentAt: time.Now(), Deadline: time.Now().Add(DOWNLOAD_FIRST_TIMEOUT)}
+			writeDatagram(conn, datagram, address, DOWNLOAD_FIRST_TIMEOUT.Seconds())
+		}
+
+		if len(pending) == 0 {
+			continue
+		}
+
+		nextDeadline := time.Time{}
+		for _, request := range pending {
+			if nextDeadline.IsZero() || request.Deadline.Before(nextDeadline) {
+				nextDeadline = request.Deadline
+			}
+		}
+
+		select {
+		case datagram := <-responses:
+			id := string(datagram.Header().Id)
+			request, found := pending[id]
+			if !found {
+				continue
+			}
+			delete(pending, id)
+			stats.BytesReceived += len(datagram.Header().Signed) + len(datagram.Header().Signature)
+
+			switch datagram := datagram.(type) {
+			case *ParsedNoDatum:
+				stats.NodesMissing++
+
+			case *ParsedError:
+				// The peer forgot our session : we do the handshake again (once for all the requests sent before) and ask again for the node
+				if isNoHandshakeError(datagram.Message) {
+					if request.SentAt.Before(lastHandshake) {
+						queue = append(queue, request.Hash)
+						continue
+					}
+					if stats.Handshakes < DOWNLOAD_MAX_HANDSHAKES {
+						stats.Handshakes++
+						if err := Handshake(conn, address, privateKey); err == nil {
+							lastHandshake = time.Now()
+							queue = append(queue, request.Hash)
+							continue
+						}
+					}
+				}
+				if DEBUG_MODE {
+					log.Printf("THE PEER %s ANSWERED WITH AN ERROR TO OUR REQUEST FOR THE NODE %x : %s \n", address.String(), request.Hash, datagram.Message)
+				}
+				stats.NodesFailed++
+
+			case *ParsedDatum:
+				// If we failed to add the node to the tree (because the hash does not match the content of the node for example)
+				if !bytes.Equal(datagram.Hash, request.Hash) || !merkle.AddNode(datagram.Hash, datagram.Value) {
+					stats.NodesFailed++
+					continue
+				}
+				stats.NodesFetched++
+
+				if store != nil {
+					if err := store.Put(datagram.Hash, datagram.Value); err != nil {
+						log.Printf("The method Put() failed in DownloadMerkleTree() : %v \n", err)
+					}
+				}
+				queue = append(queue, childHashes(datagram.Value)...)
+			}
+
+		case <-time.After(time.Until(nextDeadline)):
+			now := time.Now()
+			for id, request := range pending {
+				if request.Deadline.After(now) {
+					continue
+				}
+
+				if request.Attempts == DOWNLOAD_MAX_ATTEMPTS {
+					if DEBUG_MODE {
+						log.Printf("AFTER %d ATTEMPTS, WE DID NOT GET THE NODE %x FROM %s \n", request.Attempts, request.Hash, address.String())
+					}
+					mutex.Lock()
+					j := sliceContainsWaitingResponse(waitingResponses, address.String(), []byte(id))
+					if j != -1 {
+						waitingResponses = append(waitingResponses[:j], waitingResponses[j+1:]...)
+					}
+					mutex.Unlock()
+					delete(pending, id)
+					stats.NodesFailed++
+					continue
+				}
+
+				// Exponential growth of the timeout, as in UdpWrite()
+				timeOut := DOWNLOAD_FIRST_TIMEOUT << request.Attempts
+				request.Attempts++
+				request.SentAt = now
+				request.Deadline = now.Add(timeOut)
+				stats.Retries++
+				writeDatagram(conn, request.Datagram, address, timeOut.Seconds())
+			}
+		}
+
+		if time.Since(lastProgress) >= DOWNLOAD_PROGRESS_INTERVAL {
+			lastProgress = time.Now()
+			fmt.Printf("DOWNLOAD FROM %s : %d nodes fetched, %d requests in flight, %d hashes queued, %d retries \n",
+				address.String(), stats.NodesFetched, len(pending), len(queue), stats.Retries)
+		}
+	}
+
+	stats.Duration = time.Since(start)
+
+	if stats.NodesMissing > 0 || stats.NodesFailed > 0 {
+		return stats, fmt.Errorf("the Merkle tree of %s is incomplete : %d nodes missing, %d nodes failed", address.String(), stats.NodesMissing, stats.NodesFailed)
+	}
+	return stats, nil
+}
+
+/* The hashes of the children of a node, none if it is a message */
+func childHashes(nodeData []byte) [][]byte {
+	var hashes [][]byte
+	if len(nodeData) != 0 && nodeData[NODE_TYPE_BYTE] == NODE_TYPE_INTERNAL {
+		for i := NODE_TYPE_BYTE + 1; i+HASH_LENGTH <= len(nodeData); i += HASH_LENGTH {
+			hashes = append(hashes, nodeData[i:i+HASH_LENGTH])
+		}
+	}
+	return hashes
+}
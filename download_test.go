@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+/* A peer that serves the nodes of merkleTree. The GetDatum are answered together once no new one arrived for a moment :
+ * the number of requests of each batch, all outstanding at the same time, is sent on batches.
+ */
+func runBatchingTreePeer(conn net.PacketConn, merkleTree *MerkleTree, privateKey *ecdsa.PrivateKey, batches chan<- int) {
+	buf := make([]byte, BUFFER_SIZE)
+	answers := make(map[string][]byte) // Key : the id of the request, the attempts of a request are counted once
+	var address net.Addr
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, from, err := conn.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if len(answers) > 0 {
+				batches <- len(answers)
+				for _, answer := range answers {
+					conn.WriteTo(answer, address)
+				}
+				answers = make(map[string][]byte)
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		datagram, err := ParseDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		getDatum, ok := datagram.(*ParsedGetDatum)
+		if !ok {
+			continue
+		}
+		address = from
+		id := string(getDatum.Header().Id)
+		answers[id] = NoDatumDatagram(id, getDatum.Hash, privateKey)
+		if node := merkleTree.FindNode(getDatum.Hash); node != nil {
+			answers[id] = testDatumDatagram(id, node, privateKey)
+		}
+	}
+}
+
+/* No more than window requests are outstanding at the same time */
+func TestDownloadWindow(t *testing.T) {
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	conn, peerAddress, privateKey := testSessionWithPeer(t, peerConn)
+	source := CreateTree(testMessages(40), 4)
+	batches := make(chan int, 1000)
+	go runBatchingTreePeer(peerConn, source, testPrivateKey(t), batches)
+
+	const window = 3
+	downloaded := CreateEmptyTree(4)
+	stats, err := DownloadMerkleTree(conn, peerAddress, downloaded, source.Root.Hash, window, nil, privateKey)
+	if err != nil || countLeaves(downloaded) != 40 {
+		t.Fatalf("%d messages downloaded (%v), expected 40", countLeaves(downloaded), err)
+	}
+	if stats.Retries != 0 {
+		t.Errorf("%d retries, expected none", stats.Retries)
+	}
+
+	largest := 0
+	for len(batches) > 0 {
+		largest = max(largest, <-batches)
+	}
+	if largest != window {
+		t.Errorf("at most %d requests were outstanding, expected %d", largest, window)
+	}
+}
+
+/* A node without answer is requested again with a timeout that doubles each time, then given up */
+func TestDownloadAttempts(t *testing.T) {
+	previousAttempts, previousTimeout := DOWNLOAD_MAX_ATTEMPTS, DOWNLOAD_FIRST_TIMEOUT
+	defer func() { DOWNLOAD_MAX_ATTEMPTS, DOWNLOAD_FIRST_TIMEOUT = previousAttempts, previousTimeout }()
+	DOWNLOAD_MAX_ATTEMPTS, DOWNLOAD_FIRST_TIMEOUT = 4, 20*time.Millisecond
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	conn, peerAddress, privateKey := testSessionWithPeer(t, peerConn)
+	received := make(chan receivedDatagram, 100)
+	go runSilentPeer(peerConn, received)
+
+	rootHash := CreateTree(testMessages(1), 4).Root.Hash
+	stats, err := DownloadMerkleTree(conn, peerAddress, CreateEmptyTree(4), rootHash, DOWNLOAD_WINDOW, nil, privateKey)
+	if err == nil || stats.NodesFailed != 1 || stats.Retries != DOWNLOAD_MAX_ATTEMPTS-1 {
+		t.Errorf("the download ended with %v (%v), expected 1 node failed after %d retries", err, stats, DOWNLOAD_MAX_ATTEMPTS-1)
+	}
+	checkAttempts(t, received, DOWNLOAD_MAX_ATTEMPTS, DOWNLOAD_FIRST_TIMEOUT)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* The extensions of the protocol : one bit each in the Flags field of Hello and HelloReply.
+ * Each peer advertises the extensions it supports, and an extension is used in a session only if both peers advertised it.
+ * A peer that advertises none (flags 0) is still served with the base protocol.
+ * Only the extensions this peer implements, and the bit of its first versions, are named here :
+ * the other bits are shown as unknown, and never negotiated since we do not advertise them.
+ * The first versions of this peer sent the bit 3 ({0, 0, 0, 8}) for an encryption (AES-CFB) that is no longer implemented :
+ * the current encryption (see sessionCrypto.go) has its own bit, so that the two are never mixed.
+ */
+
+type Extensions uint32
+
+const EXTENSION_LEGACY_ENCRYPTION Extensions = 1 << 3
+const EXTENSION_ENCRYPTION Extensions = 1 << 4
+
+var EXTENSION_NAMES = []struct {
+	Extension Extensions
+	Name      string
+}{
+	{EXTENSION_LEGACY_ENCRYPTION, "legacy-encryption"},
+	{EXTENSION_ENCRYPTION, "encryption"},
+}
+
+/* The extensions this peer implements : it can only advertise these ones */
+const IMPLEMENTED_EXTENSIONS = EXTENSION_ENCRYPTION
+
+func (extensions Extensions) Has(extension Extensions) bool {
+	return extensions&extension == extension
+}
+
+/* The extensions both peers support */
+func (extensions Extensions) Negotiate(peerExtensions Extensions) Extensions {
+	return extensions & peerExtensions
+}
+
+func (extensions Extensions) String() string {
+	var names []string
+	for _, extension := range EXTENSION_NAMES {
+		if extensions.Has(extension.Extension) {
+			names = append(names, extension.Name)
+			extensions &^= extension.Extension
+		}
+	}
+	if extensions != 0 {
+		names = append(names, fmt.Sprintf("unknown (%#x)", uint32(extensions)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+/* Parses a comma separated list of names of extensions ("" or "none" for none). Only the extensions this peer implements are accepted. */
+func ParseExtensions(list string) (Extensions, error) {
+	var extensions Extensions
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+
+		found := false
+		for _, extension := range EXTENSION_NAMES {
+			if extension.Name == name {
+				extensions |= extension.Extension
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown extension %q", name)
+		}
+	}
+
+	if !IMPLEMENTED_EXTENSIONS.Has(extensions) {
+		return 0, fmt.Errorf("this peer does not implement the extensions %v", extensions&^IMPLEMENTED_EXTENSIONS)
+	}
+	return extensions, nil
+}
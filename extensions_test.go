@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseExtensions(t *testing.T) {
+	tests := []struct {
+		list     string
+		expected Extensions
+		valid    bool
+	}{
+		{"", 0, true},
+		{"none", 0, true},
+		{"encryption", EXTENSION_ENCRYPTION, true},
+		{" encryption , none", EXTENSION_ENCRYPTION, true},
+		{"legacy-encryption", 0, false}, // Named, but no longer implemented
+		{"nat-traversal", 0, false},
+		{"compression", 0, false},
+		{"unknown", 0, false},
+	}
+	for _, test := range tests {
+		extensions, err := ParseExtensions(test.list)
+		if (err == nil) != test.valid || extensions != test.expected {
+			t.Errorf("ParseExtensions(%q) = %v, %v, expected %v (valid %v)", test.list, extensions, err, test.expected, test.valid)
+		}
+	}
+}
+
+/* The encryption is used in a session only if both peers advertise it */
+func TestNegotiateExtensions(t *testing.T) {
+	previous := LOCAL_EXTENSIONS
+	defer func() { LOCAL_EXTENSIONS = previous }()
+
+	tests := []struct {
+		name      string
+		local     string
+		peer      Extensions
+		encrypted bool
+	}{
+		{"both peers", "encryption", EXTENSION_ENCRYPTION, true},
+		{"this peer only", "encryption", 0, false},
+		{"the other peer only", "none", EXTENSION_ENCRYPTION, false},
+		{"neither", "none", 0, false},
+		{"the other peer with unknown bits", "encryption", EXTENSION_ENCRYPTION | 1<<0 | 1<<31, true},
+		{"the other peer with the legacy encryption only", "encryption", EXTENSION_LEGACY_ENCRYPTION, false},
+	}
+	for _, test := range tests {
+		local, err := ParseExtensions(test.local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if negotiated := local.Negotiate(test.peer); negotiated.Has(EXTENSION_ENCRYPTION) != test.encrypted || !local.Has(negotiated) {
+			t.Errorf("%s : %v negotiated with %v gives %v", test.name, local, test.peer, negotiated)
+		}
+
+		// The sessions opened by the peer, and the ones we opened
+		LOCAL_EXTENSIONS = local
+		manager := NewSessionManager()
+		accepted := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+		opened := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10002}
+		manager.Accept("", test.peer, accepted)
+		manager.Open("", "peer", test.peer, opened)
+		for _, address := range []*net.UDPAddr{accepted, opened} {
+			session, _ := manager.Find(address)
+			if session.Extensions.Has(EXTENSION_ENCRYPTION) != test.encrypted || session.PeerExtensions != test.peer {
+				t.Errorf("%s : the session of %s has the extensions %v (the peer advertised %v)", test.name, address, session.Extensions, session.PeerExtensions)
+			}
+		}
+	}
+}
+
+func TestExtensionsString(t *testing.T) {
+	tests := []struct {
+		extensions Extensions
+		expected   string
+	}{
+		{0, "none"},
+		{EXTENSION_ENCRYPTION, "encryption"},
+		{EXTENSION_LEGACY_ENCRYPTION | EXTENSION_ENCRYPTION, "legacy-encryption, encryption"},
+		{EXTENSION_ENCRYPTION | 1<<0, "encryption, unknown (0x1)"},
+	}
+	for _, test := range tests {
+		if text := test.extensions.String(); text != test.expected {
+			t.Errorf("%#x is shown as %q, expected %q", uint32(test.extensions), text, test.expected)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* The peers we follow, by name. Their list is saved in NAME_FILE_FOLLOWS.
+ * A background goroutine finds their addresses with the server (/peers/<name>), does Hello and RootRequest,
+ * downloads the nodes of their Merkle tree that changed, and prints a notification for each new message.
+ */
+
+const FOLLOW_SYNC_JITTER = 0.2 // The interval between two synchronizations varies by +/- 20%, so that the peers do not all synchronize at the same time
+const NOTIFICATION_BODY_LENGTH = 60
+
+type FollowList struct {
+	mutex    sync.Mutex
+	fileName string
+	names    []string
+}
+
+type followListFile struct {
+	Follows []string `json:"follows"`
+}
+
+/* Protects the trees of the sessions : RLock to read one, Lock to replace one. The trees are not changed in place :
+ * a download works on a copy, without the lock, so that a slow peer does not block the other downloads and the menus.
+ */
+var sessionTreesMutex sync.RWMutex
+
+/* Downloads the tree of the peer at address into a copy of the tree of the session, which replaces it at the end (even incomplete).
+ * If another download replaced the tree of the session in the meantime, ours is dropped : its nodes are in the node store anyway.
+ * Returns the tree of the session before the download and the tree downloaded.
+ */
+func downloadSessionTree(conn net.PacketConn, address *net.UDPAddr, session Session, rootHash []byte, privateKey *ecdsa.PrivateKey) (*MerkleTree, *MerkleTree, DownloadStats, error) {
+	previous := session.Merkle
+	sessionTreesMutex.RLock()
+	merkleTree := previous.Copy()
+	sessionTreesMutex.RUnlock()
+
+	stats, err := DownloadMerkleTree(conn, address, merkleTree, rootHash, DOWNLOAD_WINDOW, nodeStoreForSession(&session), privateKey)
+
+	sessionTreesMutex.Lock()
+	sessionManager.Update(address, func(sessionWithPeer *Session) {
+		if sessionWithPeer.Merkle == previous {
+			sessionWithPeer.Merkle = merkleTree
+		}
+	})
+	sessionTreesMutex.Unlock()
+	return previous, merkleTree, stats, err
+}
+
+func LoadFollowList(fileName string) (*FollowList, error) {
+	followList := &FollowList{fileName: fileName}
+
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return followList, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file followListFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("the follow list %s is not valid : %v", fileName, err)
+	}
+	followList.names = file.Follows
+	return followList, nil
+}
+
+func (followList *FollowList) save() error {
+	data, err := json.MarshalIndent(followListFile{Follows: followList.names}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(followList.fileName, data, 0600)
+}
+
+func (followList *FollowList) Add(name string) error {
+	if err := validatePeerName(name); err != nil {
+		return err
+	}
+
+	followList.mutex.Lock()
+	defer followList.mutex.Unlock()
+
+	for _, followed := range followList.names {
+		if followed == name {
+			return fmt.Errorf("we already follow %s", name)
+		}
+	}
+	followList.names = append(followList.names, name)
+	sort.Strings(followList.names)
+	return followList.save()
+}
+
+func (followList *FollowList) Remove(name string) error {
+	followList.mutex.Lock()
+	defer followList.mutex.Unlock()
+
+	for i, followed := range followList.names {
+		if followed == name {
+			followList.names = append(followList.names[:i], followList.names[i+1:]...)
+			return followList.save()
+		}
+	}
+	return fmt.Errorf("we do not follow %s", name)
+}
+
+func (followList *FollowList) List() []string {
+	followList.mutex.Lock()
+	defer followList.mutex.Unlock()
+	return append([]string{}, followList.names...)
+}
+
+/******************************************** BACKGROUND SYNCHRONIZATION ********************************************/
+
+/* Synchronizes the followed peers every interval (with jitter), until the program stops */
+func RunFollowSync(conn net.PacketConn, httpClient *http.Client, followList *FollowList, interval time.Duration, privateKey *ecdsa.PrivateKey) {
+	for {
+		for _, name := range followList.List() {
+			if err := SyncFollowedPeer(conn, httpClient, name, privateKey); err != nil {
+				log.Printf("SYNCHRONIZATION WITH %s FAILED : %v \n", name, err)
+			}
+		}
+
+		jitter := (rand.Float64()*2 - 1) * FOLLOW_SYNC_JITTER
+		time.Sleep(time.Duration(float64(interval) * (1 + jitter)))
+	}
+}
+
+/* Finds the addresses of the peer, opens a session with the first address that answers, and downloads its Merkle tree if the root changed */
+func SyncFollowedPeer(conn net.PacketConn, httpClient *http.Client, name string, privateKey *ecdsa.PrivateKey) error {
+	peer, err := LookupPeer(httpClient, name)
+	if err != nil {
+		return err
+	}
+	if err := rememberPeer(peer); err != nil {
+		return err
+	}
+
+	var lastErr error = errors.New("the server does not know any address for this peer")
+	for _, address := range peer.Addresses {
+		udpAddress, err := net.ResolveUDPAddr("udp", net.JoinHostPort(address.Ip, fmt.Sprint(address.Port)))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		lastErr = syncFollowedPeerAddress(conn, name, udpAddress, privateKey)
+		if lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func syncFollowedPeerAddress(conn net.PacketConn, name string, udpAddress *net.UDPAddr, privateKey *ecdsa.PrivateKey) error {
+	// Hello if we do not have a session with this address yet
+	if session, found := sessionManager.Find(udpAddress); !found || session.State() != SESSION_STATE_ALIVE {
+		if err := Handshake(conn, udpAddress, privateKey); err != nil {
+			return err
+		}
+	}
+
+	response, err := UdpWrite(conn, NewDatagramId(), ROOT_REQUEST_TYPE, udpAddress, nil, privateKey)
+	if err != nil {
+		return err
+	}
+	root, ok := response.(*ParsedRoot)
+	if !ok {
+		return fmt.Errorf("unexpected answer of type %d to our RootRequest", response.Header().Type)
+	}
+
+	var session Session
+	if !sessionManager.Update(udpAddress, func(sessionWithPeer *Session) {
+		updateSessionRoot(sessionWithPeer, root.Hash)
+		session = sessionWithPeer.copy()
+	}) {
+		return errors.New("no session with the peer")
+	}
+	if bytes.Equal(session.Merkle.Root.Hash, root.Hash) {
+		return nil
+	}
+
+	previous, merkleTree, stats, err := downloadSessionTree(conn, udpAddress, session, root.Hash, privateKey)
+	if DEBUG_MODE {
+		log.Printf("SYNCHRONIZATION WITH %s (%s) : %v \n", name, udpAddress.String(), stats)
+	}
+
+	notifyNewMessages(name, merkleTree, messageHashes(previous))
+	return err
+}
+
+/* The hashes of the messages (leaves) of a tree */
+func messageHashes(merkleTree *MerkleTree) map[[HASH_LENGTH]byte]bool {
+	hashes := make(map[[HASH_LENGTH]byte]bool)
+	merkleTree.DepthFirstSearch(0, func(nodeHeight int, merkleNode *MerkleNode, hashSearch []byte) bool {
+		if key, ok := hashKey(merkleNode.Hash); ok && len(merkleNode.Data) != 0 && merkleNode.Data[NODE_TYPE_BYTE] == NODE_TYPE_MESSAGE {
+			hashes[key] = true
+		}
+		return false
+	}, nil)
+	return hashes
+}
+
+func notifyNewMessages(name string, merkleTree *MerkleTree, knownMessages map[[HASH_LENGTH]byte]bool) {
+	for key := range messageHashes(merkleTree) {
+		if knownMessages[key] {
+			continue
+		}
+		message, err := ParseMessage(merkleTree.FindNode(key[:]).Data)
+		if err != nil {
+			continue
+		}
+		body := []rune(strings.ReplaceAll(string(message.Body), "\n", " "))
+		if len(body) > NOTIFICATION_BODY_LENGTH {
+			body = append(body[:NOTIFICATION_BODY_LENGTH], []rune("...")...)
+		}
+		fmt.Printf("\n*** NEW MESSAGE FROM %s (%s) : %s \n", name, message.DateString(), string(body))
+	}
+}
+
+/* GET /peers/<name>. After an error, the background synchronization tries again later. */
+func LookupPeer(httpClient *http.Client, name string) (Peer, error) {
+	requestUrl := url.URL{Scheme: "https", Host: HOST, Path: "/peers/" + name}
+	response, err := httpClient.Get(requestUrl.String())
+	if err != nil {
+		return Peer{}, explainHttpError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return Peer{}, fmt.Errorf("the server does not know the peer %s", name)
+	}
+	if response.StatusCode != http.StatusOK {
+		return Peer{}, fmt.Errorf("the server answered %s", response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return Peer{}, err
+	}
+	var peer Peer
+	if err := json.Unmarshal(body, &peer); err != nil {
+		return Peer{}, err
+	}
+	return peer, nil
+}
+
+/* Adds the peer to the list of peers known to the client, or replaces its addresses and key.
+ * A peer whose key does not match its pin is not added : we keep the key we had, if any.
+ */
+func rememberPeer(peer Peer) error {
+	if knownPeers != nil {
+		if err := knownPeers.Check(peer); err != nil {
+			return err
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for i := range peers {
+		if peers[i].Username == peer.Username {
+			peers[i] = peer
+			return nil
+		}
+	}
+	peers = append(peers, peer)
+	return nil
+}
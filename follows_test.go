@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"net"
+	"testing"
+	"time"
+)
+
+func testDatumDatagram(id string, node *MerkleNode, privateKey *ecdsa.PrivateKey) []byte {
+	bodyLength := HASH_LENGTH + len(node.Data)
+	datagramLength := DATAGRAM_MIN_LENGTH + bodyLength + SIGNATURE_LENGTH
+	datagram := datagramGeneralStructure([]byte(id), DATUM_TYPE, bodyLength, datagramLength)
+	copy(datagram[BODY_FIRST_BYTE:], node.Hash)
+	copy(datagram[DATUM_VALUE_FIRST_BYTE:], node.Data)
+	return CreateSignature(datagram, datagramLength, privateKey)
+}
+
+/* A peer that serves the nodes of merkleTree. Each GetDatum is announced on requested, and answered once release is closed. */
+func runTreePeer(conn net.PacketConn, merkleTree *MerkleTree, privateKey *ecdsa.PrivateKey, requested chan<- []byte, release <-chan struct{}) {
+	buf := make([]byte, BUFFER_SIZE)
+	for {
+		n, address, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		datagram, err := ParseDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		getDatum, ok := datagram.(*ParsedGetDatum)
+		if !ok {
+			continue
+		}
+		hash := append([]byte{}, getDatum.Hash...)
+		select {
+		case requested <- hash:
+		default:
+		}
+		<-release
+
+		id := string(getDatum.Header().Id)
+		answer := NoDatumDatagram(id, hash, privateKey)
+		if node := merkleTree.FindNode(hash); node != nil {
+			answer = testDatumDatagram(id, node, privateKey)
+		}
+		conn.WriteTo(answer, address)
+	}
+}
+
+/* Our end of a session with a peer that runs on peerConn, without encryption, and a tree of the session still empty */
+func testSessionWithPeer(t *testing.T, peerConn net.PacketConn) (net.PacketConn, *net.UDPAddr, *ecdsa.PrivateKey) {
+	t.Helper()
+	previousDebugMode, previousPolicy, previousNodeDir := DEBUG_MODE, SIGNATURE_POLICY, NAME_DIR_NODES
+	t.Cleanup(func() {
+		DEBUG_MODE, SIGNATURE_POLICY, NAME_DIR_NODES = previousDebugMode, previousPolicy, previousNodeDir
+	})
+	DEBUG_MODE = false
+	NAME_DIR_NODES = t.TempDir()
+	policy, err := ParseSignaturePolicy("none", UNKNOWN_SENDER_ACCEPT, SIGNATURE_FAILURE_DROP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SIGNATURE_POLICY = policy
+
+	privateKey := testPrivateKey(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go UdpRead(conn, privateKey, nil, nil, nil)
+
+	peerAddress := peerConn.LocalAddr().(*net.UDPAddr)
+	sessionManager.Open("", "treepeer", 0, peerAddress)
+	t.Cleanup(func() { sessionManager.Close(peerAddress) })
+	sessionManager.Update(peerAddress, func(session *Session) { session.Merkle = CreateEmptyTree(MERKLE_TREE_MAX_ARITY) })
+	return conn, peerAddress, privateKey
+}
+
+func TestDownloadSessionTreeDoesNotHoldTheLock(t *testing.T) {
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	conn, peerAddress, privateKey := testSessionWithPeer(t, peerConn)
+
+	source := CreateTree(testMessages(40), 4)
+	requested := make(chan []byte, 1)
+	release := make(chan struct{})
+	go runTreePeer(peerConn, source, testPrivateKey(t), requested, release)
+
+	session, _ := sessionManager.Find(peerAddress)
+	type result struct {
+		previous, downloaded *MerkleTree
+		err                  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		previous, downloaded, _, err := downloadSessionTree(conn, peerAddress, session, source.Root.Hash, privateKey)
+		done <- result{previous, downloaded, err}
+	}()
+
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the peer did not receive the GetDatum of the root")
+	}
+
+	// The peer does not answer yet : the trees of the sessions can still be read and replaced
+	locked := make(chan struct{})
+	go func() {
+		sessionTreesMutex.Lock()
+		sessionTreesMutex.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the lock of the trees of the sessions is held during the download")
+	}
+	if current, _ := sessionManager.Find(peerAddress); current.Merkle != session.Merkle || len(current.Merkle.Root.Data) != 0 {
+		t.Error("the tree of the session changed before the end of the download")
+	}
+
+	close(release)
+	var downloaded result
+	select {
+	case downloaded = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the download does not end")
+	}
+	if downloaded.err != nil {
+		t.Fatal(downloaded.err)
+	}
+	if downloaded.previous != session.Merkle || len(downloaded.previous.Root.Data) != 0 {
+		t.Error("the tree of the session before the download was changed")
+	}
+	if !bytes.Equal(downloaded.downloaded.Root.Hash, source.Root.Hash) || countLeaves(downloaded.downloaded) != 40 {
+		t.Errorf("root %x with %d messages, expected %x with 40", downloaded.downloaded.Root.Hash, countLeaves(downloaded.downloaded), source.Root.Hash)
+	}
+	if current, _ := sessionManager.Find(peerAddress); current.Merkle != downloaded.downloaded {
+		t.Error("the tree downloaded did not replace the tree of the session")
+	}
+}
+
+func TestMerkleTreeCopy(t *testing.T) {
+	source := CreateTree(testMessages(20), 3)
+	original := downloadTree(t, source, 32)
+	treeCopy := original.Copy()
+
+	if !bytes.Equal(treeCopy.Root.Hash, original.Root.Hash) || countLeaves(treeCopy) != 20 {
+		t.Fatalf("the copy has the root %x and %d messages", treeCopy.Root.Hash, countLeaves(treeCopy))
+	}
+	leaf := lastLeaf(original)
+	if copied := treeCopy.FindNode(leaf.Hash); copied == nil || copied == leaf || copied.ParentNode == leaf.ParentNode {
+		t.Error("the nodes of the copy are not indexed, or are the nodes of the tree")
+	}
+
+	// A new root in the copy does not change the tree
+	next := CreateTree(testMessages(21), 3)
+	if !treeCopy.AddNode(next.Root.Hash, next.Root.Data) {
+		t.Fatal("the new root was refused")
+	}
+	if !bytes.Equal(original.Root.Hash, source.Root.Hash) || countLeaves(original) != 20 || original.FindNode(leaf.Hash) != leaf {
+		t.Error("the tree changed with its copy")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+)
+
+/* The rotation of the key of a peer : a statement "the peer <name> moves from the key <old> to the key <new>",
+ * signed by the old key (the peers that trust it can trust the new one) and by the new key (it is really ours).
+ * The statements of our rotations are kept in NAME_FILE_KEY_ROTATIONS, sent to the server with the registration,
+ * and the server gives them with the peer (GET /peers/<name>), so that a peer that knew one of our old keys can follow the chain.
+ */
+
+const KEY_ROTATIONS_MAX = 16 // Only the last rotations are kept, by us and by the server
+
+type KeyRotation struct {
+	Name            string `json:"name"`
+	OldKey          string `json:"old_key"` // base64 of the 64 bytes of the public keys, like for the server
+	NewKey          string `json:"new_key"`
+	Time            int64  `json:"time"`              // Unix time, for information
+	OldKeySignature string `json:"old_key_signature"` // base64 of r and s (64 bytes), like the signature of a datagram
+	NewKeySignature string `json:"new_key_signature"`
+}
+
+func (rotation *KeyRotation) signedHash() []byte {
+	hashed := sha256.Sum256([]byte(fmt.Sprintf("microblog key rotation v1\n%s\n%s\n%s\n%d\n", rotation.Name, rotation.OldKey, rotation.NewKey, rotation.Time)))
+	return hashed[:]
+}
+
+func NewKeyRotation(name string, oldKey *ecdsa.PrivateKey, newKey *ecdsa.PrivateKey) (KeyRotation, error) {
+	rotation := KeyRotation{
+		Name:   name,
+		OldKey: CreatePublicKeyEncoded(oldKey),
+		NewKey: CreatePublicKeyEncoded(newKey),
+		Time:   time.Now().Unix(),
+	}
+	if rotation.OldKey == rotation.NewKey {
+		return rotation, errors.New("the new key is the old key")
+	}
+
+	var err error
+	if rotation.OldKeySignature, err = signKeyRotation(&rotation, oldKey); err != nil {
+		return rotation, err
+	}
+	if rotation.NewKeySignature, err = signKeyRotation(&rotation, newKey); err != nil {
+		return rotation, err
+	}
+	return rotation, nil
+}
+
+func signKeyRotation(rotation *KeyRotation, privateKey *ecdsa.PrivateKey) (string, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, rotation.signedHash())
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, SIGNATURE_LENGTH)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return base64.RawStdEncoding.EncodeToString(signature), nil
+}
+
+/* Checks the two signatures of the statement */
+func VerifyKeyRotation(rotation KeyRotation) error {
+	if err := validatePeerName(rotation.Name); err != nil {
+		return err
+	}
+	if rotation.OldKey == rotation.NewKey {
+		return errors.New("the new key is the old key")
+	}
+	for _, signed := range []struct{ key, signature, which string }{
+		{rotation.OldKey, rotation.OldKeySignature, "old"},
+		{rotation.NewKey, rotation.NewKeySignature, "new"},
+	} {
+		keyBytes, err := base64.RawStdEncoding.DecodeString(signed.key)
+		if err != nil {
+			return fmt.Errorf("the %s key is not valid base64 : %v", signed.which, err)
+		}
+		publicKey, err := ConvertBytesToEcdsaPublicKey(keyBytes)
+		if err != nil {
+			return fmt.Errorf("the %s key is not valid : %v", signed.which, err)
+		}
+		signature, err := base64.RawStdEncoding.DecodeString(signed.signature)
+		if err != nil || len(signature) != SIGNATURE_LENGTH {
+			return fmt.Errorf("the signature of the %s key is not valid", signed.which)
+		}
+		var r, s big.Int
+		r.SetBytes(signature[:32])
+		s.SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, rotation.signedHash(), &r, &s) {
+			return fmt.Errorf("the signature of the %s key does not match", signed.which)
+		}
+	}
+	return nil
+}
+
+/* The key of the peer name after the rotations that start from key (the statements are in the order of the rotations).
+ * The statements before key are ignored. An invalid statement on the way is an error, and so is a key that moves to two new keys :
+ * we cannot know which one is the peer.
+ */
+func FollowKeyRotations(name string, key string, rotations []KeyRotation) (string, error) {
+	for i, rotation := range rotations {
+		if rotation.OldKey != key {
+			continue
+		}
+		for _, other := range rotations[i+1:] {
+			if other.OldKey == key && other.NewKey != rotation.NewKey {
+				return key, fmt.Errorf("the key %s moves to two keys, %s and %s", key, rotation.NewKey, other.NewKey)
+			}
+		}
+		if rotation.Name != name {
+			return key, fmt.Errorf("the rotation of %s is for the peer %s", key, rotation.Name)
+		}
+		if err := VerifyKeyRotation(rotation); err != nil {
+			return key, fmt.Errorf("invalid rotation of %s : %v", key, err)
+		}
+		key = rotation.NewKey
+	}
+	return key, nil
+}
+
+/* Our rotations, none if the file does not exist */
+func LoadKeyRotations(fileName string) ([]KeyRotation, error) {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rotations []KeyRotation
+	if err := json.Unmarshal(data, &rotations); err != nil {
+		return nil, fmt.Errorf("the rotations %s are not valid : %v", fileName, err)
+	}
+	return rotations, nil
+}
+
+/* A rotation of a key that already has one was not finished (the keystore still has the old key) : it is replaced, not followed by a fork */
+func appendKeyRotation(rotations []KeyRotation, rotation KeyRotation) []KeyRotation {
+	kept := make([]KeyRotation, 0, len(rotations)+1)
+	for _, previous := range rotations {
+		if previous.OldKey != rotation.OldKey {
+			kept = append(kept, previous)
+		}
+	}
+	return append(kept, rotation)
+}
+
+func SaveKeyRotations(fileName string, rotations []KeyRotation) error {
+	if len(rotations) > KEY_ROTATIONS_MAX {
+		rotations = rotations[len(rotations)-KEY_ROTATIONS_MAX:]
+	}
+	data, err := json.MarshalIndent(rotations, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(fileName, data, 0600)
+}
+
+/* The rotations we send with our registration : only if they lead to the key we register */
+func keyRotationsForRegistration(publicKeyEncoded string) []KeyRotation {
+	rotations, err := LoadKeyRotations(NAME_FILE_KEY_ROTATIONS)
+	if err != nil {
+		log.Printf("The method LoadKeyRotations() failed in keyRotationsForRegistration() : %v \n", err)
+		return nil
+	}
+	// A rotation stopped before the new keystore was saved left a fork in the files of the previous versions
+	var chain []KeyRotation
+	for _, rotation := range rotations {
+		chain = appendKeyRotation(chain, rotation)
+	}
+	if len(chain) == 0 || chain[len(chain)-1].NewKey != publicKeyEncoded {
+		return nil
+	}
+	return chain
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"path/filepath"
+	"testing"
+)
+
+/* count rotations of the peer name, through count + 1 keys */
+func testKeyRotations(t *testing.T, name string, count int) ([]KeyRotation, []*ecdsa.PrivateKey) {
+	t.Helper()
+	privateKeys := []*ecdsa.PrivateKey{testPrivateKey(t)}
+	var rotations []KeyRotation
+	for i := 0; i < count; i++ {
+		privateKeys = append(privateKeys, testPrivateKey(t))
+		rotation, err := NewKeyRotation(name, privateKeys[i], privateKeys[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotations = append(rotations, rotation)
+	}
+	return rotations, privateKeys
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	rotations, privateKeys := testKeyRotations(t, "alice", 1)
+	otherRotations, otherKeys := testKeyRotations(t, "alice", 1)
+
+	tests := []struct {
+		name   string
+		modify func(rotation *KeyRotation)
+		valid  bool
+	}{
+		{"valid", func(rotation *KeyRotation) {}, true},
+		{"name", func(rotation *KeyRotation) { rotation.Name = "mallory" }, false},
+		{"invalid name", func(rotation *KeyRotation) { rotation.Name = "" }, false},
+		{"time", func(rotation *KeyRotation) { rotation.Time++ }, false},
+		{"new key", func(rotation *KeyRotation) { rotation.NewKey = CreatePublicKeyEncoded(otherKeys[1]) }, false},
+		{"old key", func(rotation *KeyRotation) { rotation.OldKey = CreatePublicKeyEncoded(otherKeys[0]) }, false},
+		{"same keys", func(rotation *KeyRotation) { rotation.NewKey = CreatePublicKeyEncoded(privateKeys[0]) }, false},
+		{"key not base64", func(rotation *KeyRotation) { rotation.NewKey = "!" }, false},
+		{"key not on the curve", func(rotation *KeyRotation) { rotation.NewKey = "AAAA" }, false},
+		{"old signature", func(rotation *KeyRotation) { rotation.OldKeySignature = otherRotations[0].OldKeySignature }, false},
+		{"new signature", func(rotation *KeyRotation) { rotation.NewKeySignature = rotation.OldKeySignature }, false},
+		{"no signature", func(rotation *KeyRotation) { rotation.OldKeySignature = "" }, false},
+		{"short signature", func(rotation *KeyRotation) { rotation.NewKeySignature = rotation.NewKeySignature[:40] }, false},
+	}
+	for _, test := range tests {
+		rotation := rotations[0]
+		test.modify(&rotation)
+		if err := VerifyKeyRotation(rotation); (err == nil) != test.valid {
+			t.Errorf("%s : error %v, valid %v expected", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestFollowKeyRotations(t *testing.T) {
+	rotations, privateKeys := testKeyRotations(t, "alice", 3)
+	keys := make([]string, len(privateKeys))
+	for i, privateKey := range privateKeys {
+		keys[i] = CreatePublicKeyEncoded(privateKey)
+	}
+	bobRotations, bobKeys := testKeyRotations(t, "bob", 1)
+	// The first key of alice signed a second rotation, to another key
+	fork, err := NewKeyRotation("alice", privateKeys[0], testPrivateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := rotations[1]
+	modified.Time++
+	wrongName := rotations[1]
+	wrongName.Name = "bob"
+
+	tests := []struct {
+		name      string
+		key       string
+		rotations []KeyRotation
+		expected  string
+		valid     bool
+	}{
+		{"no rotation", keys[0], nil, keys[0], true},
+		{"whole chain", keys[0], rotations, keys[3], true},
+		{"from the middle", keys[1], rotations, keys[3], true},
+		{"last key", keys[3], rotations, keys[3], true},
+		{"unknown key", CreatePublicKeyEncoded(bobKeys[0]), rotations, CreatePublicKeyEncoded(bobKeys[0]), true},
+		{"rotations of another peer on the side", keys[0], append(append([]KeyRotation{}, bobRotations...), rotations...), keys[3], true},
+		{"same statement twice", keys[0], []KeyRotation{rotations[0], rotations[0], rotations[1]}, keys[2], true},
+		{"hole in the chain", keys[0], []KeyRotation{rotations[0], rotations[2]}, keys[1], true},
+		{"fork", keys[0], []KeyRotation{rotations[0], fork, rotations[1]}, keys[0], false},
+		{"fork after", keys[0], append(append([]KeyRotation{}, rotations...), fork), keys[0], false},
+		{"fork of an old key", keys[1], []KeyRotation{fork, rotations[0], rotations[1]}, keys[2], true},
+		{"modified statement", keys[0], []KeyRotation{rotations[0], modified, rotations[2]}, keys[1], false},
+		{"statement of another peer", keys[0], []KeyRotation{rotations[0], wrongName}, keys[1], false},
+		{"rotation for another name", CreatePublicKeyEncoded(bobKeys[0]), bobRotations, CreatePublicKeyEncoded(bobKeys[0]), false},
+	}
+	for _, test := range tests {
+		key, err := FollowKeyRotations("alice", test.key, test.rotations)
+		if (err == nil) != test.valid {
+			t.Errorf("%s : error %v, valid %v expected", test.name, err, test.valid)
+		}
+		if key != test.expected {
+			t.Errorf("%s : key %s, expected %s", test.name, key, test.expected)
+		}
+	}
+}
+
+/* A rotation done again after a stop before the keystore was saved replaces the lost one */
+func TestAppendKeyRotation(t *testing.T) {
+	rotations, privateKeys := testKeyRotations(t, "alice", 2)
+	lost := rotations[1]
+	again, err := NewKeyRotation("alice", privateKeys[1], testPrivateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appended := appendKeyRotation(appendKeyRotation(nil, rotations[0]), lost)
+	appended = appendKeyRotation(appended, again)
+	if len(appended) != 2 || appended[0] != rotations[0] || appended[1] != again {
+		t.Fatalf("rotations %v, expected %v", appended, []KeyRotation{rotations[0], again})
+	}
+	key, err := FollowKeyRotations("alice", rotations[0].OldKey, appended)
+	if err != nil || key != again.NewKey {
+		t.Errorf("key %s (%v), expected %s", key, err, again.NewKey)
+	}
+
+	// The files of the previous versions can have the fork : it is not sent to the server
+	oldFileName := NAME_FILE_KEY_ROTATIONS
+	defer func() { NAME_FILE_KEY_ROTATIONS = oldFileName }()
+	NAME_FILE_KEY_ROTATIONS = filepath.Join(t.TempDir(), "rotations.json")
+	if err := SaveKeyRotations(NAME_FILE_KEY_ROTATIONS, []KeyRotation{rotations[0], lost, again}); err != nil {
+		t.Fatal(err)
+	}
+	registered := keyRotationsForRegistration(again.NewKey)
+	if key, err := FollowKeyRotations("alice", rotations[0].OldKey, registered); err != nil || key != again.NewKey {
+		t.Errorf("rotations for the registration %v : key %s (%v), expected %s", registered, key, err, again.NewKey)
+	}
+}
+
+func TestLoadKeyRotations(t *testing.T) {
+	rotations, _ := testKeyRotations(t, "alice", KEY_ROTATIONS_MAX+2)
+	fileName := filepath.Join(t.TempDir(), "rotations.json")
+
+	if loaded, err := LoadKeyRotations(fileName); err != nil || loaded != nil {
+		t.Errorf("no file : %v (%v), expected nothing", loaded, err)
+	}
+	if err := SaveKeyRotations(fileName, rotations); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadKeyRotations(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != KEY_ROTATIONS_MAX || loaded[0] != rotations[2] || loaded[KEY_ROTATIONS_MAX-1] != rotations[KEY_ROTATIONS_MAX+1] {
+		t.Errorf("%d rotations loaded, expected the last %d", len(loaded), KEY_ROTATIONS_MAX)
+	}
+
+	if err := writeFileAtomically(fileName, []byte(`{"name": "alice"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyRotations(fileName); err == nil {
+		t.Error("a file that is not a list of rotations was loaded")
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+/* The keystore : the file (NAME_FILE_PRIVATE_KEY) which keeps the private key of the peer, encrypted with a passphrase.
+ * The passphrase is stretched with scrypt into an AES-256 key, and the private key (SEC 1, DER) is sealed with AES-256-GCM.
+ * The public key and the parameters of scrypt are kept in the clear, but AES-GCM authenticates them with the private key :
+ * changing them makes the file unreadable.
+ * The passphrase comes from MICROBLOG_PASSPHRASE, or else is asked on the terminal.
+ */
+
+const KEYSTORE_VERSION = 1
+const KEYSTORE_KDF = "scrypt"
+const KEYSTORE_SCRYPT_N = 1 << 15 // 32 MiB and about 0.1 s
+const KEYSTORE_SCRYPT_R = 8
+const KEYSTORE_SCRYPT_P = 1
+const KEYSTORE_SALT_LENGTH = 16
+const KEYSTORE_KEY_LENGTH = 32
+
+const PASSPHRASE_ENV = CONFIG_ENV_PREFIX + "PASSPHRASE"
+const NEW_PASSPHRASE_ENV = CONFIG_ENV_PREFIX + "NEW_PASSPHRASE"
+
+var ErrWrongPassphrase = errors.New("wrong passphrase, or the key file was modified")
+
+type keystoreFile struct {
+	Version    int    `json:"version"`
+	PublicKey  string `json:"public_key"` // The 64 bytes of X and Y, in base64 like for the server
+	Kdf        string `json:"kdf"`
+	ScryptN    int    `json:"scrypt_n"`
+	ScryptR    int    `json:"scrypt_r"`
+	ScryptP    int    `json:"scrypt_p"`
+	Salt       string `json:"salt"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+/* Everything in the clear in the file is authenticated by AES-GCM */
+func (file *keystoreFile) additionalData() []byte {
+	return []byte(fmt.Sprintf("microblog keystore v%d %s %d %d %d %s", file.Version, file.Kdf, file.ScryptN, file.ScryptR, file.ScryptP, file.PublicKey))
+}
+
+func (file *keystoreFile) aead(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := Scrypt(passphrase, salt, file.ScryptN, file.ScryptR, file.ScryptP, KEYSTORE_KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/* Writes the private key in the file, encrypted with the passphrase. The file is replaced in one step, with the mode 0600. */
+func SaveKeystore(fileName string, privateKey *ecdsa.PrivateKey, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return errors.New("the passphrase is empty")
+	}
+	privateKeyDer, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, KEYSTORE_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	file := keystoreFile{
+		Version:   KEYSTORE_VERSION,
+		PublicKey: CreatePublicKeyEncoded(privateKey),
+		Kdf:       KEYSTORE_KDF,
+		ScryptN:   KEYSTORE_SCRYPT_N,
+		ScryptR:   KEYSTORE_SCRYPT_R,
+		ScryptP:   KEYSTORE_SCRYPT_P,
+		Salt:      base64.StdEncoding.EncodeToString(salt),
+	}
+	aead, err := file.aead(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	file.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	file.Ciphertext = base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, privateKeyDer, file.additionalData()))
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(fileName, data, 0600)
+}
+
+func readKeystoreFile(fileName string) (keystoreFile, error) {
+	var file keystoreFile
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return file, err
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, fmt.Errorf("%s is not a keystore (the first versions of this peer wrote a key file that cannot be used, remove it and run \"key init\") : %v", fileName, err)
+	}
+	if file.Version != KEYSTORE_VERSION {
+		return file, fmt.Errorf("%s : unknown keystore version %d", fileName, file.Version)
+	}
+	if file.Kdf != KEYSTORE_KDF {
+		return file, fmt.Errorf("%s : unknown key derivation %q", fileName, file.Kdf)
+	}
+	if err := ValidateScryptParameters(file.ScryptN, file.ScryptR, file.ScryptP); err != nil {
+		return file, fmt.Errorf("%s : %v", fileName, err)
+	}
+	return file, nil
+}
+
+/* The public key of the keystore, which does not need the passphrase */
+func ReadKeystorePublicKey(fileName string) (string, error) {
+	file, err := readKeystoreFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	publicKeyBytes, err := base64.RawStdEncoding.DecodeString(file.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("%s : invalid public key : %v", fileName, err)
+	}
+	if _, err := ConvertBytesToEcdsaPublicKey(publicKeyBytes); err != nil {
+		return "", fmt.Errorf("%s : invalid public key : %v", fileName, err)
+	}
+	return file.PublicKey, nil
+}
+
+/* Decrypts the private key of the keystore. ErrWrongPassphrase when the passphrase is not the right one. */
+func LoadKeystore(fileName string, passphrase []byte) (*ecdsa.PrivateKey, error) {
+	file, err := readKeystoreFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(file.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("%s : invalid salt : %v", fileName, err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(file.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("%s : invalid nonce : %v", fileName, err)
+	}
+	cipherText, err := base64.StdEncoding.DecodeString(file.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("%s : invalid ciphertext : %v", fileName, err)
+	}
+
+	aead, err := file.aead(passphrase, salt)
+	if err != nil {
+		return nil, fmt.Errorf("%s : %v", fileName, err)
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%s : the nonce must have %d bytes", fileName, aead.NonceSize())
+	}
+	privateKeyDer, err := aead.Open(nil, nonce, cipherText, file.additionalData())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	privateKey, err := x509.ParseECPrivateKey(privateKeyDer)
+	if err != nil {
+		return nil, fmt.Errorf("%s : %v", fileName, err)
+	}
+	if privateKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%s : the key is not a P-256 key", fileName)
+	}
+	if subtle.ConstantTimeCompare([]byte(CreatePublicKeyEncoded(privateKey)), []byte(file.PublicKey)) != 1 {
+		return nil, fmt.Errorf("%s : the private key does not match the public key", fileName)
+	}
+	return privateKey, nil
+}
+
+/* The private key of the peer, at startup. The keystore is created the first time, like the key file was before. */
+func LoadOrCreatePrivateKey(fileName string) (*ecdsa.PrivateKey, error) {
+	fileInfo, err := os.Stat(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("NO PRIVATE KEY IN %s : A NEW ONE IS CREATED \n", fileName)
+		return createKeystore(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo.Mode().Perm()&0077 != 0 {
+		log.Printf("WARNING : %s CAN BE READ BY OTHER USERS (MODE %v) \n", fileName, fileInfo.Mode().Perm())
+	}
+
+	passphrase, err := ReadPassphrase(PASSPHRASE_ENV, "Passphrase of "+fileName, false)
+	if err != nil {
+		return nil, err
+	}
+	return LoadKeystore(fileName, passphrase)
+}
+
+func createKeystore(fileName string) (*ecdsa.PrivateKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := ReadPassphrase(PASSPHRASE_ENV, "New passphrase of "+fileName, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveKeystore(fileName, privateKey, passphrase); err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+/* The passphrase from the environment variable, or else from the terminal (twice when confirm is true, for a new passphrase) */
+func ReadPassphrase(envName string, prompt string, confirm bool) ([]byte, error) {
+	if passphrase, found := os.LookupEnv(envName); found {
+		if passphrase == "" {
+			return nil, fmt.Errorf("%s is empty", envName)
+		}
+		return []byte(passphrase), nil
+	}
+
+	passphrase := promptPassphrase(prompt + " : ")
+	if passphrase == "" {
+		return nil, fmt.Errorf("the passphrase is empty (it can also be given in %s)", envName)
+	}
+	if confirm && promptPassphrase("Again : ") != passphrase {
+		return nil, errors.New("the two passphrases are different")
+	}
+	return []byte(passphrase), nil
+}
+
+/* The echo of the terminal is turned off with stty while the passphrase is typed. Without a terminal, the line is simply read. */
+func promptPassphrase(prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+	if setTerminalEcho(false) == nil {
+		defer func() {
+			setTerminalEcho(true)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	return readLine()
+}
+
+func setTerminalEcho(on bool) error {
+	argument := "-echo"
+	if on {
+		argument = "echo"
+	}
+	command := exec.Command("stty", argument)
+	command.Stdin = os.Stdin
+	return command.Run()
+}
+
+/* KEY COMMANDS
+ *  key init : creates the keystore (it must not exist)
+ *  key export-public [-fingerprint] : prints the public key, as it is registered on the server (or its fingerprint, for the pins of the other peers)
+ *  key change-passphrase : encrypts the key again with a new passphrase (MICROBLOG_NEW_PASSPHRASE, or asked)
+ *  key rotate : replaces the key by a new one, signs the rotation with the old one and registers the new key to the server
+ */
+func RunKeyCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage : key init | key export-public | key change-passphrase | key rotate \n")
+	}
+	flags := flag.NewFlagSet("key "+args[0], flag.ExitOnError)
+	fingerprint := flags.Bool("fingerprint", false, "export-public : print the fingerprint of the key")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "init":
+		if _, err := os.Stat(NAME_FILE_PRIVATE_KEY); err == nil {
+			log.Fatalf("%s already exists : it is not replaced \n", NAME_FILE_PRIVATE_KEY)
+		}
+		if _, err := createKeystore(NAME_FILE_PRIVATE_KEY); err != nil {
+			log.Fatalf("The keystore %s was not created : %v \n", NAME_FILE_PRIVATE_KEY, err)
+		}
+		publicKey, err := ReadKeystorePublicKey(NAME_FILE_PRIVATE_KEY)
+		if err != nil {
+			log.Fatalf("The keystore %s could not be read : %v \n", NAME_FILE_PRIVATE_KEY, err)
+		}
+		fmt.Println(publicKey)
+
+	case "export-public":
+		publicKey, err := ReadKeystorePublicKey(NAME_FILE_PRIVATE_KEY)
+		if err != nil {
+			log.Fatalf("The keystore %s could not be read : %v \n", NAME_FILE_PRIVATE_KEY, err)
+		}
+		if *fingerprint {
+			publicKey = KeyFingerprint(publicKey)
+		}
+		fmt.Println(publicKey)
+
+	case "change-passphrase":
+		passphrase, err := ReadPassphrase(PASSPHRASE_ENV, "Passphrase of "+NAME_FILE_PRIVATE_KEY, false)
+		if err != nil {
+			log.Fatalf("%v \n", err)
+		}
+		privateKey, err := LoadKeystore(NAME_FILE_PRIVATE_KEY, passphrase)
+		if err != nil {
+			log.Fatalf("The keystore %s could not be opened : %v \n", NAME_FILE_PRIVATE_KEY, err)
+		}
+		newPassphrase, err := ReadPassphrase(NEW_PASSPHRASE_ENV, "New passphrase of "+NAME_FILE_PRIVATE_KEY, true)
+		if err != nil {
+			log.Fatalf("%v \n", err)
+		}
+		if err := SaveKeystore(NAME_FILE_PRIVATE_KEY, privateKey, newPassphrase); err != nil {
+			log.Fatalf("The keystore %s was not saved : %v \n", NAME_FILE_PRIVATE_KEY, err)
+		}
+		log.Printf("THE PASSPHRASE OF %s WAS CHANGED \n", NAME_FILE_PRIVATE_KEY)
+
+	case "rotate":
+		rotateKey()
+
+	default:
+		log.Fatalf("Unknown command key %s \n", args[0])
+	}
+}
+
+/* The statement is saved before the new key : if we stop in between, the old key is still there and the rotation can be done again,
+ * its statement then replaces the one of the new key that was lost.
+ * If the server cannot be reached, the rotations are sent again with the registration at the next start of the peer.
+ */
+func rotateKey() {
+	passphrase, err := ReadPassphrase(PASSPHRASE_ENV, "Passphrase of "+NAME_FILE_PRIVATE_KEY, false)
+	if err != nil {
+		log.Fatalf("%v \n", err)
+	}
+	oldKey, err := LoadKeystore(NAME_FILE_PRIVATE_KEY, passphrase)
+	if err != nil {
+		log.Fatalf("The keystore %s could not be opened : %v \n", NAME_FILE_PRIVATE_KEY, err)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatalf("The method ecdsa.GenerateKey() failed in rotateKey() : %v \n", err)
+	}
+
+	rotation, err := NewKeyRotation(NAME_FOR_SERVER_REGISTRATION, oldKey, newKey)
+	if err != nil {
+		log.Fatalf("The rotation could not be signed : %v \n", err)
+	}
+	rotations, err := LoadKeyRotations(NAME_FILE_KEY_ROTATIONS)
+	if err != nil {
+		log.Fatalf("%v \n", err)
+	}
+	if err := SaveKeyRotations(NAME_FILE_KEY_ROTATIONS, appendKeyRotation(rotations, rotation)); err != nil {
+		log.Fatalf("The rotations %s were not saved : %v \n", NAME_FILE_KEY_ROTATIONS, err)
+	}
+	if err := SaveKeystore(NAME_FILE_PRIVATE_KEY, newKey, passphrase); err != nil {
+		log.Fatalf("The keystore %s was not saved : %v \n", NAME_FILE_PRIVATE_KEY, err)
+	}
+	log.Printf("NEW KEY IN %s, THE ROTATION IS IN %s \n", NAME_FILE_PRIVATE_KEY, NAME_FILE_KEY_ROTATIONS)
+
+	httpClient, err := CreateHttpClient()
+	if err == nil {
+		err = RegisterToServer(httpClient, rotation.NewKey)
+	}
+	if err != nil {
+		log.Printf("THE REGISTRATION OF THE NEW KEY TO THE SERVER FAILED, IT WILL BE DONE AT THE NEXT START : %v \n", err)
+	} else {
+		log.Printf("THE NEW KEY IS REGISTERED TO THE SERVER %s : A PEER STILL RUNNING WITH THE OLD KEY MUST BE RESTARTED \n", HOST)
+	}
+	fmt.Println(rotation.NewKey)
+}
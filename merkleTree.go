@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -30,32 +32,126 @@ type MerkleNode struct {
 
 type MerkleTree struct {
 	Root     *MerkleNode // Pointer to the root node
-	MaxArity int         // The maximum number of children of each node
+	MaxArity int         // The maximum number of children of each node, for the trees we build (not for the trees we download)
+
+	// The nodes of each level, from the leaves (levels[0]) to the root, as built by createNodes().
+	// Only for the trees built by CreateTree(), so that Append() can find the nodes to update.
+	levels [][]*MerkleNode
+
+	// The nodes of the tree by hash, and for each hash the internal node whose Data contains it.
+	// Kept up to date by every function that changes the tree, so that FindNode() and findParent() do not search the whole tree.
+	index        map[[HASH_LENGTH]byte]*MerkleNode
+	referencedBy map[[HASH_LENGTH]byte]*MerkleNode
 }
 
-var JANUARY_1_2022 = time.Date(2022, 1, 1, 1, 0, 0, 0, time.Local) // January 1, 2022
+var JANUARY_1_2022 = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC) // January 1, 2022, the origin of the dates of the messages
 
 /* A function that receives a list of messages as well as the maximum number of children in each node,
  * and returns a pointer to a Merkel tree containing all these messages.
+ * Without messages, the root is an internal node without children.
  */
 func CreateTree(messages [][]byte, maxArity int) *MerkleTree {
 	var merkleTree MerkleTree
 	merkleTree.MaxArity = maxArity
 
+	if len(messages) == 0 {
+		emptyRootData := []byte{NODE_TYPE_INTERNAL}
+		emptyRootHash := sha256.Sum256(emptyRootData)
+		merkleTree.Root = &MerkleNode{Hash: emptyRootHash[:], Data: emptyRootData}
+		merkleTree.levels = [][]*MerkleNode{nil}
+		merkleTree.rebuildIndex()
+		return &merkleTree
+	}
+
 	leafs := merkleTree.createLeafNodes(messages)
 
 	root := merkleTree.createNodes(leafs)
 	merkleTree.Root = root
 
+	// When a level fits in a single node, createNodes() returns this node without recording the level of the root
+	if len(merkleTree.levels[len(merkleTree.levels)-1]) > 1 {
+		merkleTree.levels = append(merkleTree.levels, []*MerkleNode{root})
+	}
+
+	merkleTree.rebuildIndex()
 	return &merkleTree
 }
 
+/* Adds a message at the end of a tree built by CreateTree(), without building the tree again.
+ * Only the last node of each level can change : we rehash the nodes on the path from the new leaf to the root.
+ * The result is the same tree as CreateTree() with all the messages.
+ */
+func (merkleTree *MerkleTree) Append(message []byte) {
+	if len(merkleTree.levels) == 0 {
+		log.Fatalf("The method Append() can only be used on a tree built by CreateTree() \n")
+	}
+
+	oldRoot := merkleTree.Root
+	leaf := merkleTree.createLeafNodes([][]byte{message})[0]
+	merkleTree.levels[0] = append(merkleTree.levels[0], leaf)
+	merkleTree.indexNode(leaf)
+
+	level := 0
+	for ; len(merkleTree.levels[level]) > 1; level++ {
+		nodes := merkleTree.levels[level]
+		lastGroup := (len(nodes) - 1) / merkleTree.MaxArity
+		children := nodes[lastGroup*merkleTree.MaxArity:]
+
+		if level+1 == len(merkleTree.levels) {
+			merkleTree.levels = append(merkleTree.levels, nil)
+		}
+		upperNodes := merkleTree.levels[level+1]
+
+		var node *MerkleNode
+		if len(children) == 1 {
+			// As in createNodes(), a single node is moved up to the next level
+			node = children[0]
+		} else {
+			// We reuse the internal node of the group if there is one, otherwise the group had a single node
+			if lastGroup < len(upperNodes) && upperNodes[lastGroup] != children[0] {
+				node = upperNodes[lastGroup]
+				merkleTree.unindexNode(node) // Its hash is going to change
+			} else {
+				node = &MerkleNode{}
+			}
+
+			hashesConcatenation := []byte{NODE_TYPE_INTERNAL}
+			for _, child := range children {
+				hashesConcatenation = append(hashesConcatenation, child.Hash...)
+				child.ParentNode = node
+			}
+			hash := sha256.Sum256(hashesConcatenation)
+
+			node.Children = append([]*MerkleNode{}, children...)
+			node.Data = hashesConcatenation
+			node.Hash = hash[:]
+			merkleTree.indexNode(node)
+		}
+
+		if lastGroup < len(upperNodes) {
+			upperNodes[lastGroup] = node
+		} else {
+			merkleTree.levels[level+1] = append(upperNodes, node)
+		}
+	}
+
+	merkleTree.levels = merkleTree.levels[:level+1]
+	merkleTree.Root = merkleTree.levels[level][0]
+	merkleTree.Root.ParentNode = nil
+
+	// The old root is now below the new one, unless it was the root of the empty tree : a GetDatum must no longer find it
+	if oldRoot != merkleTree.Root && oldRoot.ParentNode == nil {
+		merkleTree.unindexNode(oldRoot)
+	}
+}
+
 func CreateEmptyTree(maxArity int) *MerkleTree {
 	var merkleTree MerkleTree
 	merkleTree.MaxArity = maxArity
 
 	root := &MerkleNode{ParentNode: nil, Hash: []byte{}, Data: nil}
 	merkleTree.Root = root
+	merkleTree.rebuildIndex()
 
 	return &merkleTree
 }
@@ -66,16 +162,28 @@ func (merkleTree *MerkleTree) AddNode(hash []byte, nodeData []byte) bool {
 		return false
 	}
 
-	node := merkleTree.DepthFirstSearch(0, merkleTree.SearchParent, hash)
+	node := merkleTree.findParent(hash)
 	if node != nil {
-		if len(node.Children) < merkleTree.MaxArity {
+		// We already have this node
+		if merkleTree.FindNode(hash) != nil {
+			return true
+		}
 
-			node.Children = append(node.Children, &MerkleNode{
+		// The tree of another peer may have another arity than ours : its parent node says how many children it has
+		if len(node.Children) < (len(node.Data)-1)/HASH_LENGTH {
+
+			child := &MerkleNode{
 				Hash:       hash,
 				Children:   nil,
 				ParentNode: node,
 				Data:       nodeData,
-			})
+			}
+			node.Children = append(node.Children, child)
+			merkleTree.indexNode(child)
+
+			// The nodes can arrive in any order (several requests are outstanding at the same time),
+			// but the children must keep the order of the hashes in the parent node
+			merkleTree.orderChildren(node)
 		} else {
 			return false
 		}
@@ -83,27 +191,118 @@ func (merkleTree *MerkleTree) AddNode(hash []byte, nodeData []byte) bool {
 		merkleTree.Root.Hash = hash
 		merkleTree.Root.Data = nodeData
 
-		if merkleTree.Root.Data[NODE_TYPE_BYTE] == NODE_TYPE_INTERNAL {
-			for i := 0; i < len(merkleTree.Root.Children); i++ {
-				hashChild := fmt.Sprintf("%x", merkleTree.Root.Children[i].Hash)
-				hashFoundInParentNode := false
-				for j := NODE_TYPE_BYTE + 1; j < len(merkleTree.Root.Data) && !hashFoundInParentNode; j += HASH_LENGTH {
-					nodeHashString := fmt.Sprintf("%x", merkleTree.Root.Data[j:j+HASH_LENGTH])
-
-					if hashChild == nodeHashString {
-						hashFoundInParentNode = true
-					}
-				}
-
-				if !hashFoundInParentNode {
-					merkleTree.Root.Children = append(merkleTree.Root.Children[:i], merkleTree.Root.Children[i+1:]...)
-				}
+		// We keep only the children that are still referenced by the new root
+		merkleTree.orderChildren(merkleTree.Root)
+		merkleTree.rebuildIndex()
+	}
+
+	return true
+}
+
+/* The node of the tree with this hash, or nil */
+func (merkleTree *MerkleTree) FindNode(hash []byte) *MerkleNode {
+	key, ok := hashKey(hash)
+	if !ok {
+		return nil
+	}
+	return merkleTree.index[key]
+}
+
+/* The internal node of the tree whose Data contains this hash, or nil */
+func (merkleTree *MerkleTree) findParent(hash []byte) *MerkleNode {
+	key, ok := hashKey(hash)
+	if !ok {
+		return nil
+	}
+	return merkleTree.referencedBy[key]
+}
+
+func hashKey(hash []byte) ([HASH_LENGTH]byte, bool) {
+	if len(hash) != HASH_LENGTH {
+		return [HASH_LENGTH]byte{}, false
+	}
+	return [HASH_LENGTH]byte(hash), true
+}
+
+func (merkleTree *MerkleTree) indexNode(node *MerkleNode) {
+	key, ok := hashKey(node.Hash)
+	if !ok {
+		return
+	}
+	merkleTree.index[key] = node
+
+	if len(node.Data) != 0 && node.Data[NODE_TYPE_BYTE] == NODE_TYPE_INTERNAL {
+		for i := NODE_TYPE_BYTE + 1; i+HASH_LENGTH <= len(node.Data); i += HASH_LENGTH {
+			merkleTree.referencedBy[[HASH_LENGTH]byte(node.Data[i:i+HASH_LENGTH])] = node
+		}
+	}
+}
+
+func (merkleTree *MerkleTree) unindexNode(node *MerkleNode) {
+	key, ok := hashKey(node.Hash)
+	if !ok {
+		return
+	}
+	if merkleTree.index[key] == node {
+		delete(merkleTree.index, key)
+	}
+
+	if len(node.Data) != 0 && node.Data[NODE_TYPE_BYTE] == NODE_TYPE_INTERNAL {
+		for i := NODE_TYPE_BYTE + 1; i+HASH_LENGTH <= len(node.Data); i += HASH_LENGTH {
+			childKey := [HASH_LENGTH]byte(node.Data[i : i+HASH_LENGTH])
+			if merkleTree.referencedBy[childKey] == node {
+				delete(merkleTree.referencedBy, childKey)
 			}
 		}
+	}
+}
+
+/* A copy of the nodes of a downloaded tree, that can be changed while the tree is read. The Hash and Data of the nodes are shared : they are never changed.
+ * The levels are not copied : Append() cannot be used on the copy.
+ */
+func (merkleTree *MerkleTree) Copy() *MerkleTree {
+	treeCopy := &MerkleTree{Root: copyNode(merkleTree.Root, nil), MaxArity: merkleTree.MaxArity}
+	treeCopy.rebuildIndex()
+	return treeCopy
+}
 
+func copyNode(node *MerkleNode, parent *MerkleNode) *MerkleNode {
+	nodeCopy := &MerkleNode{ParentNode: parent, Hash: node.Hash, Data: node.Data}
+	for _, child := range node.Children {
+		nodeCopy.Children = append(nodeCopy.Children, copyNode(child, nodeCopy))
 	}
+	return nodeCopy
+}
 
-	return true
+/* Indexes all the nodes reachable from the root, after a change that can remove whole subtrees (a new root) */
+func (merkleTree *MerkleTree) rebuildIndex() {
+	merkleTree.index = make(map[[HASH_LENGTH]byte]*MerkleNode)
+	merkleTree.referencedBy = make(map[[HASH_LENGTH]byte]*MerkleNode)
+	merkleTree.DepthFirstSearch(0, func(nodeHeight int, merkleNode *MerkleNode, hashSearch []byte) bool {
+		merkleTree.indexNode(merkleNode)
+		return false
+	}, nil)
+}
+
+/* Sorts the children of a node in the order of their hashes in the Data field of the node.
+ * The children whose hash is not in the Data field are removed.
+ */
+func (merkleTree *MerkleTree) orderChildren(node *MerkleNode) {
+	if len(node.Data) == 0 || node.Data[NODE_TYPE_BYTE] != NODE_TYPE_INTERNAL {
+		node.Children = nil
+		return
+	}
+
+	orderedChildren := make([]*MerkleNode, 0, len(node.Children))
+	for i := NODE_TYPE_BYTE + 1; i+HASH_LENGTH <= len(node.Data); i += HASH_LENGTH {
+		for _, child := range node.Children {
+			if bytes.Equal(child.Hash, node.Data[i:i+HASH_LENGTH]) {
+				orderedChildren = append(orderedChildren, child)
+				break
+			}
+		}
+	}
+	node.Children = orderedChildren
 }
 
 /* Internal function. This function receives a list messages and returns leaves for those messages
@@ -136,6 +335,7 @@ func (merkleTree *MerkleTree) createLeafNodes(messages [][]byte) []*MerkleNode {
  */
 func (merkleTree *MerkleTree) createNodes(leafNodes []*MerkleNode) *MerkleNode {
 	var merkleNodes []*MerkleNode
+	merkleTree.levels = append(merkleTree.levels, leafNodes)
 
 	// Particular case: if we have a tree that includes only one element, this element will be the root of the tree
 	if len(leafNodes) == 1 {
@@ -217,14 +417,16 @@ func (merkleTree *MerkleTree) DepthFirstSearch(nodesHeightCountInitialization in
 }
 
 /******************************************************************************************/
+/* SearchParent and GetNodeByHash walk the whole tree with DepthFirstSearch(). FindNode() uses the index instead. */
 func (merkleTree *MerkleTree) SearchParent(nodeHeight int, merkleNode *MerkleNode, hashSearch []byte) bool {
-	hashSearchString := fmt.Sprintf("%x", hashSearch)
+	hashSearchKey, ok := hashKey(hashSearch)
+	if !ok {
+		return false
+	}
 
 	if len(merkleNode.Data) != 0 && merkleNode.Data[NODE_TYPE_BYTE] == NODE_TYPE_INTERNAL {
-		for i := NODE_TYPE_BYTE + 1; i < len(merkleNode.Data); i += HASH_LENGTH {
-			nodeHashString := fmt.Sprintf("%x", merkleNode.Data[i:i+HASH_LENGTH])
-
-			if hashSearchString == nodeHashString {
+		for i := NODE_TYPE_BYTE + 1; i+HASH_LENGTH <= len(merkleNode.Data); i += HASH_LENGTH {
+			if [HASH_LENGTH]byte(merkleNode.Data[i:i+HASH_LENGTH]) == hashSearchKey {
 				return true
 			}
 		}
@@ -234,10 +436,10 @@ func (merkleTree *MerkleTree) SearchParent(nodeHeight int, merkleNode *MerkleNod
 }
 
 func (merkleTree *MerkleTree) GetNodeByHash(nodeHeight int, merkleNode *MerkleNode, hashSearch []byte) bool {
-	nodeHashString := fmt.Sprintf("%x", merkleNode.Hash)
-	hashSearchString := fmt.Sprintf("%x", hashSearch)
+	nodeHashKey, ok := hashKey(merkleNode.Hash)
+	hashSearchKey, ok2 := hashKey(hashSearch)
 
-	return (nodeHashString == hashSearchString)
+	return ok && ok2 && nodeHashKey == hashSearchKey
 }
 
 func (merkleTree *MerkleTree) PrintNodeHash(nodeHeight int, merkleNode *MerkleNode, hashSearch []byte) bool {
@@ -283,14 +485,13 @@ func (merkleTree *MerkleTree) PrintLeaf(nodeHeight int, merkleNode *MerkleNode,
 
 /******************************************************************************************/
 func CreateMessage(body string, inReplyTo []byte) []byte {
-	timeSinceJanuary := fmt.Sprintf("%d", int(time.Since(JANUARY_1_2022).Seconds()))
 
 	messageBodyLength := len(body)
 	messageLength := MESSAGE_TOTAL_MIN_LENGTH + messageBodyLength
 	message := make([]byte, messageLength)
 
 	message[NODE_TYPE_BYTE] = NODE_TYPE_MESSAGE
-	copy(message[MESSAGE_DATE_FIRST_BYTE:MESSAGE_DATE_FIRST_BYTE+MESSAGE_DATE_LENGTH], []byte(timeSinceJanuary))
+	copy(message[MESSAGE_DATE_FIRST_BYTE:MESSAGE_DATE_FIRST_BYTE+MESSAGE_DATE_LENGTH], EncodeMessageDate(time.Now()))
 	copy(message[MESSAGE_IN_REPLY_TO_FIRST_BYTE:MESSAGE_IN_REPLY_TO_FIRST_BYTE+MESSAFE_IN_REPLY_TO_LENGTH], inReplyTo)
 	message[MESSAFE_LENGTH_FIRST_BYTE] = byte(messageBodyLength >> 8)
 	message[MESSAFE_LENGTH_FIRST_BYTE+1] = byte(messageBodyLength & 0xFF)
@@ -299,29 +500,6 @@ func CreateMessage(body string, inReplyTo []byte) []byte {
 	return message
 }
 
-func CreateMessagesForMerkleTree(numMessages int) [][]byte {
-	messages := make([][]byte, numMessages)
-
-	for i := 0; i < len(messages); i++ {
-		var inReplyTo []byte
-		messageBody := fmt.Sprintf("Message %d", i+1)
-
-		if i%2 != 0 {
-			hash := sha256.New()
-			_, errorMessage := hash.Write(messages[i-1])
-			if errorMessage != nil {
-				log.Fatalf("Error : unable to generate a hash for the message %s \n", messages[i-1])
-			}
-			inReplyTo = hash.Sum(nil)
-		} else {
-			inReplyTo = inReplyToZeroes()
-		}
-
-		messages[i] = CreateMessage(messageBody, inReplyTo)
-	}
-	return messages
-}
-
 // In-reply-to indicates the hash of the message to which a message replies.
 // It is 0 if a message does not respond to another message. Field size : 32 bytes.
 func inReplyToZeroes() []byte {
@@ -340,13 +518,14 @@ func nodeDataToString(nodeData []byte, tabulationNum int) string {
 	nodeType := nodeData[NODE_TYPE_BYTE]
 
 	if nodeType == 0 { // Type 0 indicates that it is a message
-		messageDate := nodeData[MESSAGE_DATE_FIRST_BYTE : MESSAGE_DATE_FIRST_BYTE+MESSAGE_DATE_LENGTH]
-		messageInReplyTo := nodeData[MESSAGE_IN_REPLY_TO_FIRST_BYTE : MESSAGE_IN_REPLY_TO_FIRST_BYTE+MESSAFE_IN_REPLY_TO_LENGTH]
-		messageLength := int(nodeData[MESSAFE_LENGTH_FIRST_BYTE])<<8 | int(nodeData[MESSAFE_LENGTH_FIRST_BYTE+1])
-		messageBody := nodeData[MESSAGE_BODY_FIRST_BYTE:]
-
-		messageDateSec := int(messageDate[0]) + int(messageDate[1]) + int(messageDate[2]) + int(messageDate[3])
-		messageDateTime := JANUARY_1_2022.Add(time.Duration(messageDateSec) * time.Second).String()
+		message, err := ParseMessage(nodeData)
+		if err != nil {
+			return fmt.Sprintf("Invalid message : %v \n", err)
+		}
+		messageInReplyTo := message.InReplyTo
+		messageLength := len(message.Body)
+		messageBody := message.Body
+		messageDateTime := message.DateString()
 
 		for i := 0; i < tabulationNum; i++ {
 			str += fmt.Sprintf("\t")
@@ -389,14 +568,34 @@ func nodeDataToString(nodeData []byte, tabulationNum int) string {
 }
 
 func CheckHash(hash []byte, data []byte) bool {
+	key, ok := hashKey(hash)
+	return ok && sha256.Sum256(data) == key
+}
+
+/* Checks that the Data field of a node received from another peer can be used without going out of bounds :
+ * a message must have all its fields and a body of the announced length, an internal node must be a list of hashes.
+ */
+func ValidateNodeData(nodeData []byte) error {
+	if len(nodeData) == 0 {
+		return errors.New("empty node")
+	}
 
-	dataHash := sha256.New()
-	_, errorMessage := dataHash.Write(data)
-	if errorMessage != nil {
-		log.Fatalf("Error : unable to generate a hash for the message %s \n", data)
+	switch nodeData[NODE_TYPE_BYTE] {
+	case NODE_TYPE_MESSAGE:
+		if len(nodeData) < MESSAGE_TOTAL_MIN_LENGTH {
+			return fmt.Errorf("message of %d bytes, expected at least %d", len(nodeData), MESSAGE_TOTAL_MIN_LENGTH)
+		}
+		messageLength := int(nodeData[MESSAFE_LENGTH_FIRST_BYTE])<<8 | int(nodeData[MESSAFE_LENGTH_FIRST_BYTE+1])
+		if MESSAGE_BODY_FIRST_BYTE+messageLength != len(nodeData) {
+			return fmt.Errorf("message Length field is %d but the body has %d bytes", messageLength, len(nodeData)-MESSAGE_BODY_FIRST_BYTE)
+		}
+	case NODE_TYPE_INTERNAL:
+		if (len(nodeData)-1)%HASH_LENGTH != 0 {
+			return fmt.Errorf("internal node of %d bytes is not a list of hashes", len(nodeData))
+		}
+	default:
+		return fmt.Errorf("unknown node type %d", nodeData[NODE_TYPE_BYTE])
 	}
 
-	hashString := fmt.Sprintf("%x", hash)
-	dataHashString := fmt.Sprintf("%x", dataHash.Sum(nil))
-	return (hashString == dataHashString)
+	return nil
 }
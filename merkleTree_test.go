@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func testMessages(count int) [][]byte {
+	messages := make([][]byte, count)
+	for i := range messages {
+		messages[i] = CreateMessage(fmt.Sprintf("message %d", i), inReplyToZeroes())
+	}
+	return messages
+}
+
+/* Downloads the tree as a peer does : the root, then the nodes level by level */
+func downloadTree(t *testing.T, source *MerkleTree, maxArity int) *MerkleTree {
+	t.Helper()
+	downloaded := CreateEmptyTree(maxArity)
+	nodes := []*MerkleNode{source.Root}
+	for len(nodes) > 0 {
+		var next []*MerkleNode
+		for _, node := range nodes {
+			if !downloaded.AddNode(node.Hash, node.Data) {
+				t.Fatalf("the node %x was refused", node.Hash)
+			}
+			next = append(next, node.Children...)
+		}
+		nodes = next
+	}
+	return downloaded
+}
+
+func countLeaves(merkleTree *MerkleTree) int {
+	leaves := 0
+	merkleTree.DepthFirstSearch(0, func(nodeHeight int, merkleNode *MerkleNode, hashSearch []byte) bool {
+		if len(merkleNode.Data) != 0 && merkleNode.Data[NODE_TYPE_BYTE] == NODE_TYPE_MESSAGE {
+			leaves++
+		}
+		return false
+	}, nil)
+	return leaves
+}
+
+func TestAddNodeKeepsTheArityOfThePeer(t *testing.T) {
+	tests := []struct {
+		peerArity  int
+		localArity int
+		messages   int
+	}{
+		{40, 32, 40},
+		{40, 32, 100},
+		{2, 32, 17},
+		{32, 2, 65},
+	}
+	for _, test := range tests {
+		source := CreateTree(testMessages(test.messages), test.peerArity)
+		downloaded := downloadTree(t, source, test.localArity)
+
+		if !bytes.Equal(downloaded.Root.Hash, source.Root.Hash) {
+			t.Errorf("arity %d/%d : root %x, expected %x", test.peerArity, test.localArity, downloaded.Root.Hash, source.Root.Hash)
+		}
+		if leaves := countLeaves(downloaded); leaves != test.messages {
+			t.Errorf("arity %d/%d : %d messages downloaded, expected %d", test.peerArity, test.localArity, leaves, test.messages)
+		}
+	}
+}
+
+func TestAddNodeRefusesAWrongHash(t *testing.T) {
+	source := CreateTree(testMessages(3), 32)
+	downloaded := CreateEmptyTree(32)
+	if !downloaded.AddNode(source.Root.Hash, source.Root.Data) {
+		t.Fatal("the root was refused")
+	}
+	child := source.Root.Children[0]
+	if downloaded.AddNode(child.Hash, append([]byte{}, source.Root.Children[1].Data...)) {
+		t.Error("a node whose data does not match its hash was accepted")
+	}
+}
+
+func indexedHashes(merkleTree *MerkleTree) map[[HASH_LENGTH]byte]bool {
+	hashes := make(map[[HASH_LENGTH]byte]bool)
+	for hash := range merkleTree.index {
+		hashes[hash] = true
+	}
+	return hashes
+}
+
+/* Append() must give, after each message, the tree CreateTree() builds with the same messages */
+func TestAppendGivesTheTreeOfCreateTree(t *testing.T) {
+	const maxMessages = 150
+	messages := testMessages(maxMessages)
+
+	for _, maxArity := range []int{2, 3, 4, 7, 32} {
+		appended := CreateTree(nil, maxArity)
+		for count := 0; count <= maxMessages; count++ {
+			if count > 0 {
+				appended.Append(messages[count-1])
+			}
+			created := CreateTree(messages[:count], maxArity)
+
+			if !bytes.Equal(appended.Root.Hash, created.Root.Hash) || !bytes.Equal(appended.Root.Data, created.Root.Data) {
+				t.Fatalf("arity %d, %d messages : root %x, expected %x", maxArity, count, appended.Root.Hash, created.Root.Hash)
+			}
+
+			appendedHashes, createdHashes := indexedHashes(appended), indexedHashes(created)
+			if len(appendedHashes) != len(createdHashes) {
+				t.Fatalf("arity %d, %d messages : %d nodes indexed, expected %d", maxArity, count, len(appendedHashes), len(createdHashes))
+			}
+			for hash := range createdHashes {
+				if !appendedHashes[hash] {
+					t.Fatalf("arity %d, %d messages : the node %x is not indexed", maxArity, count, hash)
+				}
+			}
+		}
+	}
+}
+
+func TestAppendForgetsTheEmptyRoot(t *testing.T) {
+	merkleTree := CreateTree(nil, 32)
+	emptyRootHash := merkleTree.Root.Hash
+	if merkleTree.FindNode(emptyRootHash) == nil {
+		t.Fatal("the root of the empty tree is not indexed")
+	}
+
+	merkleTree.Append(testMessages(1)[0])
+	if merkleTree.FindNode(emptyRootHash) != nil {
+		t.Error("the root of the empty tree is still found after Append()")
+	}
+}
+
+/* The size of the trees served by a peer that posts a lot, to measure the cost of serving a GetDatum */
+const BENCHMARK_MESSAGES = 100000
+
+var benchmarkTreeOnce sync.Once
+var benchmarkTree *MerkleTree
+
+func benchmarkMerkleTree(b *testing.B) *MerkleTree {
+	b.Helper()
+	benchmarkTreeOnce.Do(func() {
+		benchmarkTree = CreateTree(testMessages(BENCHMARK_MESSAGES), 32)
+	})
+	return benchmarkTree
+}
+
+/* The last message : the node a depth-first search finds last */
+func lastLeaf(merkleTree *MerkleTree) *MerkleNode {
+	node := merkleTree.Root
+	for len(node.Children) > 0 {
+		node = node.Children[len(node.Children)-1]
+	}
+	return node
+}
+
+func BenchmarkGetNodeByHash(b *testing.B) {
+	merkleTree := benchmarkMerkleTree(b)
+	hash := lastLeaf(merkleTree).Hash
+
+	b.Run("index", func(b *testing.B) {
+		for b.Loop() {
+			if merkleTree.FindNode(hash) == nil {
+				b.Fatal("node not found")
+			}
+		}
+	})
+	b.Run("search", func(b *testing.B) {
+		for b.Loop() {
+			if merkleTree.DepthFirstSearch(0, merkleTree.GetNodeByHash, hash) == nil {
+				b.Fatal("node not found")
+			}
+		}
+	})
+	b.Run("parent-index", func(b *testing.B) {
+		for b.Loop() {
+			if merkleTree.findParent(hash) == nil {
+				b.Fatal("parent not found")
+			}
+		}
+	})
+	b.Run("parent-search", func(b *testing.B) {
+		for b.Loop() {
+			if merkleTree.DepthFirstSearch(0, merkleTree.SearchParent, hash) == nil {
+				b.Fatal("parent not found")
+			}
+		}
+	})
+}
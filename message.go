@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+/* The codec of the messages (the Data field of the leaves of the Merkle tree) :
+ * type (1 byte, 0) | date (4 bytes) | in-reply-to (32 bytes) | length (2 bytes) | body
+ * The date is the number of seconds since January 1, 2022 (UTC), as a big-endian unsigned integer.
+ *
+ * The first versions of this peer wrote the date as a decimal string truncated to 4 bytes (for example "3100" for 31004211 seconds).
+ * With the compatibility mode (LEGACY_DATES_COMPATIBILITY), a date made of 4 ASCII digits is read as such a legacy date.
+ * A real date can only look like this after 2047 (0x30303030 seconds).
+ *
+ * The number of digits that were cut is not written : the number of seconds had 8 digits between April 2022 and March 2025,
+ * 9 digits after. We take the most recent date that is not in the future ("1234" is 123400000 seconds, in 2025, and not 12340000).
+ */
+
+type Message struct {
+	Date       time.Time
+	LegacyDate bool   // The date was written as a decimal string by an old peer, Date is only an approximation
+	InReplyTo  []byte // 32 bytes, all zeros if the message is not a reply
+	Body       []byte
+}
+
+func (message *Message) IsReply() bool {
+	for _, b := range message.InReplyTo {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (message *Message) DateString() string {
+	if message.LegacyDate {
+		return fmt.Sprintf("about %s (legacy date)", message.Date.Local().Format("2006-01-02 15:04"))
+	}
+	return message.Date.Local().Format("2006-01-02 15:04:05")
+}
+
+/* Decodes the Data field of a leaf, after checking it with ValidateNodeData() */
+func ParseMessage(nodeData []byte) (*Message, error) {
+	if err := ValidateNodeData(nodeData); err != nil {
+		return nil, err
+	}
+	if nodeData[NODE_TYPE_BYTE] != NODE_TYPE_MESSAGE {
+		return nil, fmt.Errorf("node of type %d is not a message", nodeData[NODE_TYPE_BYTE])
+	}
+
+	date, legacy := DecodeMessageDate(nodeData[MESSAGE_DATE_FIRST_BYTE : MESSAGE_DATE_FIRST_BYTE+MESSAGE_DATE_LENGTH])
+	return &Message{
+		Date:       date,
+		LegacyDate: legacy,
+		InReplyTo:  nodeData[MESSAGE_IN_REPLY_TO_FIRST_BYTE : MESSAGE_IN_REPLY_TO_FIRST_BYTE+MESSAFE_IN_REPLY_TO_LENGTH],
+		Body:       nodeData[MESSAGE_BODY_FIRST_BYTE:],
+	}, nil
+}
+
+func EncodeMessageDate(date time.Time) []byte {
+	seconds := date.Sub(JANUARY_1_2022) / time.Second
+	if seconds < 0 {
+		seconds = 0
+	}
+	dateField := make([]byte, MESSAGE_DATE_LENGTH)
+	binary.BigEndian.PutUint32(dateField, uint32(seconds))
+	return dateField
+}
+
+/* Returns the date and true if it is a legacy date (only when LEGACY_DATES_COMPATIBILITY is set) */
+func DecodeMessageDate(dateField []byte) (time.Time, bool) {
+	if LEGACY_DATES_COMPATIBILITY && isLegacyDate(dateField) {
+		return decodeLegacyDate(dateField, time.Now()), true
+	}
+	seconds := binary.BigEndian.Uint32(dateField)
+	return JANUARY_1_2022.Add(time.Duration(seconds) * time.Second), false
+}
+
+func isLegacyDate(dateField []byte) bool {
+	for _, b := range dateField {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+/* The 4 first digits of the number of seconds, scaled by the largest power of 10 that does not give a date after now.
+ * "0000" cannot be scaled : it is the first second of 2022.
+ */
+func decodeLegacyDate(dateField []byte, now time.Time) time.Time {
+	digits := 0
+	for _, b := range dateField {
+		digits = digits*10 + int(b-'0')
+	}
+	if digits == 0 {
+		return JANUARY_1_2022
+	}
+
+	secondsUntilNow := int(now.Sub(JANUARY_1_2022) / time.Second)
+	seconds := digits
+	for seconds*10 <= secondsUntilNow {
+		seconds *= 10
+	}
+	return JANUARY_1_2022.Add(time.Duration(seconds) * time.Second)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDecodeLegacyDate(t *testing.T) {
+	seconds := func(n int) time.Time { return JANUARY_1_2022.Add(time.Duration(n) * time.Second) }
+
+	tests := []struct {
+		name      string
+		dateField string
+		now       time.Time
+		expected  time.Time
+	}{
+		{"8 digits", "3100", seconds(40000000), seconds(31000000)},
+		{"8 digits read today", "3100", seconds(150000000), seconds(31000000)},
+		{"9 digits", "1234", seconds(150000000), seconds(123400000)},
+		{"9 digits just written", "1234", seconds(123456789), seconds(123400000)},
+		{"8 digits before the 9 digits", "1234", seconds(99999999), seconds(12340000)},
+		{"7 digits", "9000", seconds(9500000), seconds(9000000)},
+		{"zero", "0000", seconds(150000000), JANUARY_1_2022},
+		{"zero read in 2100", "0000", seconds(math.MaxInt32), JANUARY_1_2022},
+		{"one", "0001", seconds(150000000), seconds(100000000)},
+		{"read before 2022", "1234", JANUARY_1_2022.Add(-time.Hour), seconds(1234)},
+	}
+	for _, test := range tests {
+		date := decodeLegacyDate([]byte(test.dateField), test.now)
+		if !date.Equal(test.expected) {
+			t.Errorf("%s : %q read on %v is %v, expected %v", test.name, test.dateField, test.now, date, test.expected)
+		}
+	}
+}
+
+func TestMessageDates(t *testing.T) {
+	previous := LEGACY_DATES_COMPATIBILITY
+	defer func() { LEGACY_DATES_COMPATIBILITY = previous }()
+	LEGACY_DATES_COMPATIBILITY = true
+
+	date := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	decoded, legacy := DecodeMessageDate(EncodeMessageDate(date))
+	if legacy || !decoded.Equal(date) {
+		t.Errorf("%v is decoded as %v (legacy %v)", date, decoded, legacy)
+	}
+
+	// A legacy date of 9 digits : 110000000 seconds, in June 2025
+	decoded, legacy = DecodeMessageDate([]byte("1100"))
+	if expected := JANUARY_1_2022.Add(110000000 * time.Second); !legacy || !decoded.Equal(expected) {
+		t.Errorf("the legacy date 1100 is decoded as %v (legacy %v), expected %v", decoded, legacy, expected)
+	}
+
+	// Any peer can send this date : it must not block the reading of the message
+	decoded, legacy = DecodeMessageDate([]byte("0000"))
+	if !legacy || !decoded.Equal(JANUARY_1_2022) {
+		t.Errorf("the legacy date 0000 is decoded as %v (legacy %v), expected %v", decoded, legacy, JANUARY_1_2022)
+	}
+
+	LEGACY_DATES_COMPATIBILITY = false
+	if _, legacy := DecodeMessageDate([]byte("1100")); legacy {
+		t.Error("a legacy date is read without the compatibility mode")
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	valid := CreateMessage("hello", bytes.Repeat([]byte{7}, MESSAFE_IN_REPLY_TO_LENGTH))
+
+	tests := []struct {
+		name     string
+		nodeData []byte
+		valid    bool
+	}{
+		{"valid", valid, true},
+		{"empty body", CreateMessage("", inReplyToZeroes()), true},
+		{"empty", nil, false},
+		{"internal node", append([]byte{NODE_TYPE_INTERNAL}, make([]byte, HASH_LENGTH)...), false},
+		{"unknown type", append([]byte{2}, valid[1:]...), false},
+		{"no length", valid[:MESSAFE_LENGTH_FIRST_BYTE], false},
+		{"short body", valid[:len(valid)-1], false},
+		{"long body", append(append([]byte{}, valid...), 'x'), false},
+	}
+	for _, test := range tests {
+		message, err := ParseMessage(test.nodeData)
+		if (err == nil) != test.valid {
+			t.Errorf("%s : error %v, expected valid %v", test.name, err, test.valid)
+			continue
+		}
+		if test.valid && test.name == "valid" && (string(message.Body) != "hello" || !message.IsReply()) {
+			t.Errorf("%s : body %q, reply %v", test.name, message.Body, message.IsReply())
+		}
+	}
+}
@@ -3,14 +3,20 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
-	"math"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,49 +24,125 @@ import (
 const BUFFER_SIZE = 1500
 
 type WaitingResponse struct {
-	FullAddress   *net.UDPAddr // The UDP address from which we are waiting for a reply
-	DatagramTypes []int        // A list of the type numbers of the datagrams we are waiting to receive from this address. For example: HELLO_REPLY_TYPE, DATUM_TYPE, NO_DATUM_TYPE
-	Id            []byte       // The id that should be in the datagram of the answer we will receive (the same as the id in the datagram of our request)
+	FullAddress   *net.UDPAddr  // The UDP address from which we are waiting for a reply
+	DatagramTypes []int         // A list of the type numbers of the datagrams we are waiting to receive from this address. For example: HELLO_REPLY_TYPE, DATUM_TYPE, NO_DATUM_TYPE
+	Id            []byte        // The id that should be in the datagram of the answer we will receive (the same as the id in the datagram of our request)
+	Responses     chan Datagram // The answer is delivered on this channel to the goroutine that sent the request
 }
 
-type OpenSession struct {
-	FullAddress       *net.UDPAddr
-	LastHandshakeTime time.Time
+/* The results of a request, other than the expected answer */
+var ErrNoResponse = errors.New("no answer after all the attempts")
+var ErrNoDatum = errors.New("the peer does not have the requested datum (NoDatum)")
+
+/* The attempts of a request : the timeout doubles after each one, 2 + 4 + 8 + 16 seconds. Variables, so that the tests do not wait. */
+var REQUEST_MAX_ATTEMPTS = 4
+var REQUEST_FIRST_TIMEOUT = 2 * time.Second
+
+type PeerError struct {
+	Message string // The body of the Error datagram we received as an answer
 }
 
-type SessionWeOpened struct {
-	FullAddress          	*net.UDPAddr
-	LastDatagramTime     	time.Time
-	Merkle               	*MerkleTree
-	Buffer               	[]byte
-	sharedKey            	[]byte
-	privateKeyForSession 	*ecdsa.PrivateKey
-	myPublicKeyForSession   *ecdsa.PublicKey
+func (peerError *PeerError) Error() string {
+	return fmt.Sprintf("the peer answered with an error : %s", peerError.Message)
+}
+
+/* The error a peer sends when we make a request without a session : we must do the handshake again */
+const NO_HANDSHAKE_ERROR_MESSAGE = "No handshake was performed (Hello, HelloReplay) or more than an hour has passed since the last interaction"
+const NO_HANDSHAKE_ERROR_PREFIX = "No handshake was performed"
+
+func isNoHandshakeError(message string) bool {
+	return strings.HasPrefix(message, NO_HANDSHAKE_ERROR_PREFIX)
 }
 
+/* The reasons for which a received datagram can be rejected */
+const REJECTED_READ_ERROR = "read error"
+const REJECTED_INVALID_ADDRESS = "invalid address"
+const REJECTED_DECRYPTION_FAILED = "decryption failed"
+const REJECTED_REPLAYED = "replayed datagram"
+const REJECTED_INVALID_DATAGRAM = "invalid datagram"
+const REJECTED_INVALID_SIGNATURE = "invalid signature"
+const REJECTED_INVALID_KEY = "invalid key"
+const REJECTED_UNKNOWN_SENDER = "unknown sender"
+const REJECTED_BLOCKLISTED = "blocklisted address"
+
+var rejectedDatagrams = make(map[string]int) // The number of datagrams rejected for each reason
+var rejectedDatagramsMutex sync.Mutex
+
 var waitingResponses []WaitingResponse
-var openSessions []OpenSession
-var sessionsWeOpened []SessionWeOpened
 var mutex sync.Mutex
 
-func CreateHttpClient() *http.Client {
+/* The certificate of the server is verified, with the roots of the system or with the certificate authorities of CA_FILE.
+ * For a self-hosted server, SERVER_FINGERPRINT pins the SHA-256 of its certificate (the server logs it at startup) :
+ * alone, it replaces the verification of the chain, so that a self-signed certificate is accepted if it is the pinned one.
+ */
+func CreateHttpClient() (*http.Client, error) {
+	tlsConfig, err := serverTLSConfig(CA_FILE, SERVER_FINGERPRINT)
+	if err != nil {
+		return nil, err
+	}
+
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.MaxIdleConns = 100
 	transport.MaxConnsPerHost = 100
 	transport.MaxIdleConnsPerHost = 100
-	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // This is a code for pedagogical purposes !
+	transport.TLSClientConfig = tlsConfig
 
 	client := &http.Client{
 		Timeout:   10 * time.Second,
 		Transport: transport,
 	}
 
-	return client
+	return client, nil
+}
+
+var ErrServerCertificateMismatch = errors.New("the certificate of the server is not the pinned one")
+
+func serverTLSConfig(caFile string, fingerprint string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if fingerprint != "" {
+		pinned, err := hex.DecodeString(fingerprint)
+		if err != nil || len(pinned) != sha256.Size {
+			return nil, errors.New("the fingerprint of the server must be the 64 hexadecimal digits of a SHA-256")
+		}
+		tlsConfig.InsecureSkipVerify = caFile == "" // The pin replaces the verification of the chain, unless we also have certificate authorities
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("%w : the server sent no certificate", ErrServerCertificateMismatch)
+			}
+			received := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if subtle.ConstantTimeCompare(received[:], pinned) != 1 {
+				return fmt.Errorf("%w : its SHA-256 fingerprint is %x, the pinned one is %x", ErrServerCertificateMismatch, received, pinned)
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
 }
 
-func HttpRequest(requestType string, client *http.Client, requestUrl string, data []byte, responseBodyPrintMethod string) ([]byte, int) {
-	var req *http.Request
-	var errorMessage error
+/* An error of the verification of the certificate says how to trust a self-hosted server */
+func explainHttpError(err error) error {
+	var verificationError *tls.CertificateVerificationError
+	if errors.As(err, &verificationError) {
+		return fmt.Errorf("%w (for a self-hosted server, give its certificate authority with -ca-file or the fingerprint of its certificate with -server-fingerprint)", err)
+	}
+	return err
+}
+
+/* An HTTP request to the server. The errors (the server cannot be reached, its certificate is not valid...) are returned to the caller. */
+func HttpRequest(requestType string, client *http.Client, requestUrl string, data []byte, responseBodyPrintMethod string) ([]byte, int, error) {
 	if DEBUG_MODE {
 		fmt.Println()
 		log.Printf("HTTP %v REQUEST : %v \n", requestType, requestUrl)
@@ -70,379 +152,430 @@ func HttpRequest(requestType string, client *http.Client, requestUrl string, dat
 		}
 	}
 
+	var body io.Reader
 	if requestType == "POST" {
-		// func http.NewRequest(method string, url string, body io.Reader) (*http.Request, error)
-		req, errorMessage = http.NewRequest(requestType, requestUrl, bytes.NewBuffer(data))
-	} else {
-		req, errorMessage = http.NewRequest(requestType, requestUrl, nil)
+		body = bytes.NewBuffer(data)
 	}
-
-	if errorMessage != nil {
-		log.Fatalf("http.NewRequest() function in httpRequest() to %s : %v\n", requestUrl, errorMessage)
+	req, err := http.NewRequest(requestType, requestUrl, body)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	if requestType == "POST" {
-		// func (http.Header).Add(key string, value string)
 		req.Header.Add("Content-Type", "application/json")
 	}
 
-	// func (*http.Client).Do(req *http.Request) (*http.Response, error)
-	response, errorMessage := client.Do(req)
-	if errorMessage != nil {
-		log.Fatalf("client.Do() function in httpRequest() to %s : %v\n", requestUrl, errorMessage)
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, 0, explainHttpError(err)
 	}
+	defer response.Body.Close()
 
-	// func ioutil.ReadAll(r io.Reader) ([]byte, error)
-	responseBody, errorMessage := ioutil.ReadAll(response.Body)
-	if errorMessage != nil {
-		log.Fatalf("io.ReadAll() function in httpRequest() to %s : %v\n", requestUrl, errorMessage)
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, response.StatusCode, fmt.Errorf("the body of the response of %s could not be read : %v", requestUrl, err)
 	}
 
-	response.Body.Close() // func (io.Closer).Close() error
 	if DEBUG_MODE {
 		fmt.Printf("HTTP RESPONSE STATUS CODE : %d \n", response.StatusCode)
 		fmt.Printf("HTTP RESPONSE BODY :\n"+responseBodyPrintMethod+"\n", responseBody)
 	}
 
-	return responseBody, response.StatusCode
+	return responseBody, response.StatusCode, nil
 }
 
-func UdpRead(conn net.PacketConn, privateKey *ecdsa.PrivateKey, addressesFromServer []Address, publicKeyFromServer *ecdsa.PublicKey) {
+func UdpRead(conn net.PacketConn, privateKey *ecdsa.PrivateKey, addressesFromServer []Address, publicKeyFromServer *ecdsa.PublicKey, httpClient *http.Client) {
 
 	for {
 		buf := make([]byte, BUFFER_SIZE)
 
-		_, address, err := conn.ReadFrom(buf)
+		n, address, err := conn.ReadFrom(buf)
 		if err != nil {
-			log.Fatalf("The method conn.ReadFrom() failed in udpRead() : %v \n", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			countRejectedDatagram(REJECTED_READ_ERROR)
+			log.Printf("The method conn.ReadFrom() failed in udpRead() : %v \n", err)
+			continue
 		}
-
-		if DEBUG_MODE {
-			PrintDatagram(false, address.String(), buf, 0)
+		buf = buf[:n]
+
+		udpAddress, ok := address.(*net.UDPAddr)
+		if !ok {
+			udpAddress, err = net.ResolveUDPAddr("udp", address.String())
+			if err != nil {
+				countRejectedDatagram(REJECTED_INVALID_ADDRESS)
+				log.Printf("The method net.ResolveUDPAddr() failed in udpRead() during the resolve of the address %s : %v \n", address.String(), err)
+				continue
+			}
 		}
 
-		nonSolicitMessage := false
-		udpAddress, err := net.ResolveUDPAddr("udp", address.String())
-		if err != nil {
-			log.Fatalf("The method net.ResolveUDPAddr() failed in udpRead() during the resolve of the address %s : %v \n", address.String(), err)
+		// An address whose session sent us datagrams with bad signatures (SIGNATURE_FAILURE_BLOCKLIST)
+		if isBlocklisted(udpAddress) {
+			countRejectedDatagram(REJECTED_BLOCKLISTED)
+			continue
 		}
 
-		addressFind := false
-		for _, addr := range addressesFromServer {
-			if int(addr.Port) == udpAddress.Port && net.ParseIP(addr.Ip).Equal(udpAddress.IP) && !addressFind {
-				if buf[TYPE_BYTE] == 0 || buf[TYPE_BYTE] == 128 || buf[TYPE_BYTE] == byte(ROOT_REQUEST_TYPE) || buf[TYPE_BYTE] == byte(ROOT_TYPE) {
-					ok := VerifySignature(buf, publicKeyFromServer)
-					if !ok {
-						panic(ok)
-					}
-				}
-				addressFind = true
-				break
+		// The header of an encrypted datagram is in the clear, the body and the signature must be decrypted
+		plainBuf, err := sessionManager.DecryptDatagram(udpAddress, buf)
+		if errors.Is(err, ErrReplayedDatagram) || errors.Is(err, ErrForgedDatagram) {
+			// Anyone can send us a copy of a datagram of the session, or bytes that look encrypted : we never answer them,
+			// so that they cannot be used to make us send datagrams to another address
+			if errors.Is(err, ErrReplayedDatagram) {
+				countRejectedDatagram(REJECTED_REPLAYED)
+			} else {
+				countRejectedDatagram(REJECTED_DECRYPTION_FAILED)
+			}
+			if DEBUG_MODE {
+				log.Printf("WE DROP A DATAGRAM FROM %s : %v \n", udpAddress.String(), err)
 			}
+			continue
 		}
-
-		if !addressFind {
-			for _, peer := range peers {
-				for _, addr := range peer.Addresses {
-					if int(addr.Port) == udpAddress.Port && net.ParseIP(addr.Ip).Equal(udpAddress.IP) && !addressFind {
-						if buf[TYPE_BYTE] == 0 || buf[TYPE_BYTE] == 128 || buf[TYPE_BYTE] == byte(ROOT_REQUEST_TYPE) || buf[TYPE_BYTE] == byte(ROOT_TYPE) {
-							keyFromPeerBytes, err := base64.RawStdEncoding.DecodeString(peer.Key)
-							if err != nil {
-								panic(err)
-							}
-							ok := VerifySignature(buf, ConvertBytesToEcdsaPublicKey(keyFromPeerBytes))
-							if !ok {
-								panic(ok)
-							}
-
-						}
-						addressFind = true
-						break
-					}
+		if err != nil {
+			// We forgot the session (we were restarted for example), or we do not have the keys of the peer :
+			// the peer must do the handshake again. The Error is in the clear, the peer could not read it with our keys.
+			countRejectedDatagram(REJECTED_DECRYPTION_FAILED)
+			if !errors.Is(err, ErrNoSessionKeys) {
+				log.Printf("WE CANNOT DECRYPT A DATAGRAM FROM %s : %v \n", udpAddress.String(), err)
+			}
+			if buf[TYPE_BYTE] < 128 {
+				errorDatagram := ErrorDatagram(string(buf[ID_FIRST_BYTE:ID_FIRST_BYTE+ID_LENGTH]), []byte(NO_HANDSHAKE_ERROR_MESSAGE), privateKey)
+				if _, err := conn.WriteTo(errorDatagram, udpAddress); err != nil {
+					log.Printf("The method WriteTo failed in udpRead() to %s : %v \n", udpAddress.String(), err)
 				}
 			}
+			continue
 		}
+		encrypted := isEncryptedDatagram(buf)
+		buf = plainBuf
 
-		if !addressFind {
-			fmt.Println("Response from unknown")
+		datagram, err := ParseDatagram(buf)
+		if err != nil {
+			rejectDatagram(conn, udpAddress, buf, REJECTED_INVALID_DATAGRAM, err, privateKey)
+			continue
 		}
+		header := datagram.Header()
 
-		mutex.Lock()
-		i := sliceContainsAddress(waitingResponses, address.String())
-		if i != -1 {
-			//id := buf[ID_FIRST_BYTE : ID_FIRST_BYTE+ID_LENGTH]
-			datagramType := buf[TYPE_BYTE]
-
-			if sliceContainsInt(waitingResponses[i].DatagramTypes, int(datagramType)) != -1 {
-				waitingResponses = append(waitingResponses[:i], waitingResponses[i+1:]...)
-
-				// In addition to sessions opened by other peers, we also store sessions we opened
-				if buf[TYPE_BYTE] == HELLO_REPLY_TYPE {
-					i = sliceContainsSessionWeOpened(sessionsWeOpened, udpAddress.String(), conn, privateKey)
-					if i != -1 {
-						sessionsWeOpened[i].LastDatagramTime = time.Now()
-					} else {
-						sessionWeOpened := SessionWeOpened{FullAddress: udpAddress, LastDatagramTime: time.Now(), Merkle: nil, Buffer: nil}
-						sessionsWeOpened = append(sessionsWeOpened, sessionWeOpened)
-					}
-
-					if (buf[FLAGS_FIRST_BYTE+3] >> 3 & 1) == 1 {
-						privateKeyForSession := CreatePrivateKeyForEncryption()
-						myPublicKeyEncoded := GeneratePublicEncodedKeyForEncryption(privateKeyForSession)
-
-						sessionsWeOpened[i].privateKeyForSession = CreatePrivateKeyForEncryption()
-						myPublicKeyBytes, _ := base64.RawStdEncoding.DecodeString(myPublicKeyEncoded)
-						sessionsWeOpened[i].myPublicKeyForSession = ConvertBytesToEcdsaPublicKey(myPublicKeyBytes)
-
-						UdpWrite(conn, string(buf[ID_FIRST_BYTE:ID_FIRST_BYTE+ID_LENGTH]), SEND_KEY_HELLO_TYPE, udpAddress, []byte(myPublicKeyEncoded), privateKey)
-					}
-				}
+		if DEBUG_MODE {
+			PrintDatagram(false, address.String(), buf, 0)
+		}
 
-			} else { // We are waiting for a datagram from this address but not a datagram with the received datagram type
-				if buf[TYPE_BYTE] >= 128 && buf[TYPE_BYTE] != ERROR_TYPE { // If we receive a response type datagram
-					nonSolicitMessage = true
+		sender := identifySender(udpAddress, addressesFromServer, publicKeyFromServer)
+		sender.Encrypted = encrypted
+		err = SIGNATURE_POLICY.Check(buf, header, sender)
+		if errors.Is(err, ErrUnknownSender) {
+			switch SIGNATURE_POLICY.UnknownSender {
+			case UNKNOWN_SENDER_ACCEPT:
+				err = nil
+			case UNKNOWN_SENDER_LOOKUP:
+				// Only a Hello or a HelloReply gives the name of its sender
+				if name, ok := helloUsername(datagram); ok {
+					go checkUnknownSender(conn, httpClient, udpAddress, buf, datagram, name, privateKey)
+					continue
 				}
 			}
-		} else { // If we are not waiting for a message from this peer
-			if buf[TYPE_BYTE] >= 128 && buf[TYPE_BYTE] != ERROR_TYPE { // If we receive a response type datagram
-				nonSolicitMessage = true
-			}
 		}
-		mutex.Unlock()
-
-		if nonSolicitMessage && buf[TYPE_BYTE] != ERROR_TYPE {
-			UdpWrite(conn, string(buf[ID_FIRST_BYTE:ID_FIRST_BYTE+ID_LENGTH]), ERROR_TYPE, udpAddress, []byte("A response type datagram was received even though we did not request such a response"), privateKey)
+		if err != nil {
+			SIGNATURE_POLICY.Reject(conn, udpAddress, buf, sender, err, privateKey)
 			continue
 		}
 
-		i = sliceContainsSession(openSessions, udpAddress.String())
-		if i != -1 {
-			if buf[TYPE_BYTE] == HELLO_TYPE {
-				openSessions[i].LastHandshakeTime = time.Now()
-			}
+		handleDatagram(conn, udpAddress, buf, datagram, sender.Key, privateKey)
+	}
+}
 
-		} else { // If there is no open session
-			if int(buf[TYPE_BYTE]) != HELLO_TYPE && int(buf[TYPE_BYTE]) <= 127 {
-				UdpWrite(conn, string(buf[ID_FIRST_BYTE:ID_FIRST_BYTE+ID_LENGTH]), ERROR_TYPE, udpAddress, []byte("No handshake was performed (Hello, HelloReplay) or more than an hour has passed since the last interaction"), privateKey)
-				continue
-			}
+/* A datagram whose signature was checked : an answer is delivered to the request that waits for it, a request is answered.
+ * peerKey is the key of the peer that sent the datagram, if we know it : the session of the peer is identified by its key.
+ */
+func handleDatagram(conn net.PacketConn, udpAddress *net.UDPAddr, buf []byte, datagram Datagram, peerKey string, privateKey *ecdsa.PrivateKey) {
+	header := datagram.Header()
+	unsolicitedResponse := false
+
+	sessionManager.Touch(udpAddress)
+
+	mutex.Lock()
+	i := sliceContainsWaitingResponse(waitingResponses, udpAddress.String(), header.Id)
+	// An Error datagram with the id of one of our requests is also an answer to that request
+	if i != -1 && (header.Type == ERROR_TYPE || sliceContainsInt(waitingResponses[i].DatagramTypes, header.Type) != -1) {
+		// In addition to sessions opened by other peers, we also store sessions we opened (before the goroutine that sent the Hello continues)
+		if helloReply, ok := datagram.(*ParsedHelloReply); ok {
+			sessionManager.Open(peerKey, helloReply.Username, Extensions(helloReply.Flags), udpAddress)
 		}
 
-		i = sliceContainsSessionWeOpened(sessionsWeOpened, udpAddress.String(), conn, privateKey)
-		if i != -1 {
-			if sessionsWeOpened[i].sharedKey != nil {
-				buf = Decrypt(sessionsWeOpened[i].sharedKey, buf)
-			}
+		select {
+		case waitingResponses[i].Responses <- datagram:
+		default: // The reading of the datagrams must never be blocked
 		}
+		waitingResponses = append(waitingResponses[:i], waitingResponses[i+1:]...)
 
-		switch buf[TYPE_BYTE] {
-		case byte(SEND_KEY_HELLO_TYPE):
-			privateKeyForSession := CreatePrivateKeyForEncryption()
-			myPublicKeyEncoded := GeneratePublicEncodedKeyForEncryption(privateKeyForSession)
+	} else if header.Type >= 128 && header.Type != ERROR_TYPE {
+		// A response type datagram that does not match the address, the id and the type of a request we are waiting for :
+		// a late reply (after our last attempt), a duplicate, or a reply we never asked for. We drop it.
+		unsolicitedResponse = true
+	}
+	mutex.Unlock()
 
-			sessionsWeOpened[i].privateKeyForSession = CreatePrivateKeyForEncryption()
-			myPublicKeyBytes, _ := base64.RawStdEncoding.DecodeString(myPublicKeyEncoded)
-			sessionsWeOpened[i].myPublicKeyForSession = ConvertBytesToEcdsaPublicKey(myPublicKeyBytes)
+	if unsolicitedResponse {
+		if DEBUG_MODE {
+			log.Printf("WE DROP THE DATAGRAM OF TYPE %d WITH ID %v FROM %s : IT DOES NOT MATCH ANY REQUEST WE ARE WAITING FOR \n", header.Type, header.Id, udpAddress.String())
+		}
+		return
+	}
 
-			UdpWrite(conn, string(buf[ID_FIRST_BYTE:ID_FIRST_BYTE+ID_LENGTH]), SEND_KEY_HELLO_REPLY_TYPE, udpAddress, []byte(myPublicKeyEncoded), privateKey)
+	// If the peer did not open a session with us (or more than an hour ago), we only answer a Hello
+	session, found := sessionManager.Find(udpAddress)
+	if header.Type != HELLO_TYPE && header.Type <= 127 && !(found && session.Accepted()) {
+		UdpWrite(conn, string(header.Id), ERROR_TYPE, udpAddress, []byte(NO_HANDSHAKE_ERROR_MESSAGE), privateKey)
+		return
+	}
 
-		case byte(SEND_KEY_HELLO_REPLY_TYPE):
-			i = sliceContainsSessionWeOpened(sessionsWeOpened, udpAddress.String(), conn, privateKey)
-			if i != -1 {
-				bodyLength := int(buf[LENGTH_FIRST_BYTE])<<8 | int(buf[LENGTH_FIRST_BYTE+1])
-				keyInBody := buf[BODY_FIRST_BYTE : BODY_FIRST_BYTE+bodyLength]
-				keyInBodByte, _ := base64.RawStdEncoding.DecodeString(string(keyInBody))
-				publicKeyFromPeer := ConvertBytesToEcdsaPublicKey(keyInBodByte)
+	switch datagram := datagram.(type) {
+	case *ParsedSendKey:
+		// An optional datagram, only for the extensions of the session
+		if !found || !session.Extensions.Has(EXTENSION_ENCRYPTION) {
+			UdpWrite(conn, string(header.Id), ERROR_TYPE, udpAddress, []byte("The encryption extension was not negotiated in the Hello of this session"), privateKey)
+			return
+		}
 
-				sessionsWeOpened[i].sharedKey = GenerateSharedKey(*publicKeyFromPeer, sessionsWeOpened[i].privateKeyForSession)
-			}
+		var publicKey []byte
+		var err error
+		sessionManager.Update(udpAddress, func(session *Session) {
+			publicKey, err = session.answerKeyExchange(header.Id, datagram.Key)
+		})
+		if err != nil {
+			rejectDatagram(conn, udpAddress, buf, REJECTED_INVALID_KEY, err, privateKey)
+			return
+		}
+		UdpWrite(conn, string(header.Id), SEND_KEY_HELLO_REPLY_TYPE, udpAddress, publicKey, privateKey)
+
+	case *ParsedHello: // If a Hello datagram arrives, we send HelloReplay and open a session for an hour
+		// The session is open before the reply : the Hello of an unknown sender is handled outside of the loop of UdpRead(),
+		// and the next datagram of the peer (its SendKey) may be read as soon as it has our reply
+		sessionManager.Accept(peerKey, Extensions(datagram.Flags), udpAddress)
+		UdpWrite(conn, string(header.Id), HELLO_REPLY_TYPE, udpAddress, nil, privateKey)
+
+	case *ParsedRootRequest:
+		// The post command may have published messages since the last RootRequest
+		RefreshThisPeerMerkleTree()
+		UdpWrite(conn, string(header.Id), ROOT_TYPE, udpAddress, nil, privateKey)
+	case *ParsedGetDatum:
+		UdpWrite(conn, string(header.Id), DATUM_TYPE, udpAddress, datagram.Hash, privateKey)
+
+		// The answers to our requests (Root, Datum, NoDatum, Error) have already been delivered to the goroutine that waits for them
+	}
+}
 
-		case byte(HELLO_TYPE): // If a Hello datagram arrives, we send HelloReplay and open a session for an hour
-			UdpWrite(conn, string(buf[ID_FIRST_BYTE:ID_FIRST_BYTE+ID_LENGTH]), HELLO_REPLY_TYPE, udpAddress, nil, privateKey)
-			openSession := &OpenSession{FullAddress: udpAddress, LastHandshakeTime: time.Now()}
-			openSessions = append(openSessions, *openSession)
-
-		case byte(ROOT_REQUEST_TYPE):
-			UdpWrite(conn, string(buf[ID_FIRST_BYTE:ID_FIRST_BYTE+ID_LENGTH]), ROOT_TYPE, udpAddress, nil, privateKey)
-		case byte(GET_DATUM_TYPE):
-			UdpWrite(conn, string(buf[ID_FIRST_BYTE:ID_FIRST_BYTE+ID_LENGTH]), DATUM_TYPE, udpAddress, buf[BODY_FIRST_BYTE:BODY_FIRST_BYTE+GET_DATUM_BODY_LENGTH], privateKey)
-
-		case byte(ROOT_TYPE):
-			i = sliceContainsSessionWeOpened(sessionsWeOpened, udpAddress.String(), conn, privateKey)
-			rootHash := buf[BODY_FIRST_BYTE : BODY_FIRST_BYTE+ROOT_BODY_LENGTH]
-			if i != -1 {
-				if sessionsWeOpened[i].Merkle == nil {
-					if DEBUG_MODE {
-						fmt.Println()
-						fmt.Printf("So far we have not created a Merkle tree for this session, so we create a Merkle tree now. \n")
-					}
-					sessionsWeOpened[i].Merkle = CreateEmptyTree(MERKLE_TREE_MAX_ARITY)
-					sessionsWeOpened[i].Buffer = rootHash
-				} else {
-					if fmt.Sprintf("%x", rootHash) == fmt.Sprintf("%x", sessionsWeOpened[i].Merkle.Root.Hash) {
-						if DEBUG_MODE {
-							fmt.Println()
-							fmt.Printf("The root we got is the same as the root that was stored so far in the Merkle tree for this session. \n")
-						}
-					} else {
-						if DEBUG_MODE {
-							fmt.Println()
-							fmt.Print("The root we got is not the same as the root that was stored so far in the Merkle tree for this session. We will save the new hash in a buffer until we get the node that this hash represents.\n")
-							fmt.Print("If the hash matches the node, we will replace the root of the Merkel tree. \n")
-						}
-						sessionsWeOpened[i].Buffer = rootHash
-					}
-				}
+func verifyPeerSignature(buf []byte, peer Peer) error {
+	keyFromPeerBytes, err := base64.RawStdEncoding.DecodeString(peer.Key)
+	if err != nil {
+		return fmt.Errorf("the key of the peer %s is not valid base64 : %v", peer.Username, err)
+	}
+	keyFromPeer, err := ConvertBytesToEcdsaPublicKey(keyFromPeerBytes)
+	if err != nil {
+		return fmt.Errorf("the key of the peer %s is not valid : %v", peer.Username, err)
+	}
+	if !VerifySignature(buf, keyFromPeer) {
+		return fmt.Errorf("the signature does not match the key of the peer %s", peer.Username)
+	}
+	return nil
+}
 
-			}
+/* A datagram we cannot use is counted and logged, then dropped.
+ * If it is a request (and we could read its Id), we answer with an Error datagram, as the protocol asks.
+ * We never answer a response or an Error, so that two peers cannot send errors to each other forever.
+ */
+func rejectDatagram(conn net.PacketConn, address *net.UDPAddr, buf []byte, reason string, err error, privateKey *ecdsa.PrivateKey) {
+	countRejectedDatagram(reason)
 
-		case byte(DATUM_TYPE):
-			bodyLength := int(buf[LENGTH_FIRST_BYTE])<<8 | int(buf[LENGTH_FIRST_BYTE+1])
+	fmt.Println()
+	log.Printf("WE REJECT A DATAGRAM FROM %s (%s) : %v \n", address.String(), reason, err)
 
-			i = sliceContainsSessionWeOpened(sessionsWeOpened, udpAddress.String(), conn, privateKey)
-			if i != -1 {
-				sessionsWeOpened[i].Buffer = buf[BODY_FIRST_BYTE : BODY_FIRST_BYTE+bodyLength]
-			}
+	if len(buf) >= DATAGRAM_MIN_LENGTH && buf[TYPE_BYTE] < 128 {
+		id := string(buf[ID_FIRST_BYTE : ID_FIRST_BYTE+ID_LENGTH])
+		UdpWrite(conn, id, ERROR_TYPE, address, []byte(fmt.Sprintf("%s : %v", reason, err)), privateKey)
+	}
+}
+
+func countRejectedDatagram(reason string) {
+	rejectedDatagramsMutex.Lock()
+	rejectedDatagrams[reason]++
+	rejectedDatagramsMutex.Unlock()
+}
 
-		case byte(NO_DATUM_TYPE):
-			bodyLength := int(buf[LENGTH_FIRST_BYTE])<<8 | int(buf[LENGTH_FIRST_BYTE+1])
+func PrintRejectedDatagrams() {
+	rejectedDatagramsMutex.Lock()
+	defer rejectedDatagramsMutex.Unlock()
 
-			i = sliceContainsSessionWeOpened(sessionsWeOpened, udpAddress.String(), conn, privateKey)
-			if i != -1 {
-				sessionsWeOpened[i].Buffer = buf[BODY_FIRST_BYTE : BODY_FIRST_BYTE+bodyLength]
-			}
+	if len(rejectedDatagrams) == 0 {
+		fmt.Println("No datagram has been rejected so far")
+		return
+	}
+	for reason, count := range rejectedDatagrams {
+		fmt.Printf("%s : %d \n", reason, count)
+	}
+}
 
+/* Sends a datagram. If it is a request, waits for the answer and returns it :
+ * the answer is delivered by UdpRead() on the channel of this request.
+ * The error is ErrNoResponse if there is no answer after all the attempts (with the error of the last write, if it failed),
+ * ErrNoDatum if the answer is a NoDatum, and a *PeerError if the answer is an Error datagram.
+ * The error of the write of a datagram that is not a request is returned.
+ * If the peer answers that we did not do the handshake (it forgot our session), we do it again and send the request once more.
+ * Not for the datagrams of the handshake itself (Hello, SendKeyHello) : the handshake would send them again, without end.
+ */
+func UdpWrite(conn net.PacketConn, datagramId string, datagramType int, address *net.UDPAddr, data []byte, privateKey *ecdsa.PrivateKey) (Datagram, error) {
+	response, err := udpWrite(conn, datagramId, datagramType, address, data, privateKey)
+
+	var peerError *PeerError
+	if !isHandshakeDatagramType(datagramType) && errors.As(err, &peerError) && isNoHandshakeError(peerError.Message) {
+		if DEBUG_MODE {
+			log.Printf("THE PEER %s DOES NOT KNOW OUR SESSION, WE DO THE HANDSHAKE AGAIN \n", address.String())
+		}
+		if handshakeErr := Handshake(conn, address, privateKey); handshakeErr != nil {
+			return response, err
 		}
+		response, err = udpWrite(conn, NewDatagramId(), datagramType, address, data, privateKey)
+	}
+	return response, err
+}
+
+func udpWrite(conn net.PacketConn, datagramId string, datagramType int, address *net.UDPAddr, data []byte, privateKey *ecdsa.PrivateKey) (Datagram, error) {
+	datagram, responseOptions := buildDatagram(conn, datagramId, datagramType, address, data, privateKey)
+	if datagram == nil {
+		return nil, fmt.Errorf("we cannot build a datagram of type %d", datagramType)
+	}
+
+	if len(responseOptions) == 0 {
+		return nil, writeDatagram(conn, datagram, address, 0)
+	}
+
+	// Each request has its own entry, identified by the address and the id of the request.
+	// The same id is used for all the attempts, so a reply to any of them completes the request.
+	responses := make(chan Datagram, 1)
+	mutex.Lock()
+	waitingResponses = append(waitingResponses, WaitingResponse{FullAddress: address, DatagramTypes: responseOptions, Id: []byte(datagramId), Responses: responses})
+	mutex.Unlock()
+
+	var writeErr error
+	for i := 0; i < REQUEST_MAX_ATTEMPTS; i++ {
+		// Exponential growth (Croissance exponentielle) : the timeout doubles after each attempt
+		timeOut := REQUEST_FIRST_TIMEOUT << i
+
+		writeErr = writeDatagram(conn, datagram, address, timeOut.Seconds())
+		if errors.Is(writeErr, net.ErrClosed) {
+			// Our socket is closed : the other attempts would fail too
+			forgetWaitingResponse(address, datagramId)
+			return nil, writeErr
+		}
+
+		select {
+		case response := <-responses:
+			return response, responseError(response)
+		case <-time.After(timeOut):
+		}
+	}
+
+	if DEBUG_MODE {
+		log.Printf("AFTER %d ATTEMPTS, WE DID NOT GET THE ANSWER WE EXPECTED FROM %s TO DATAGRAM OF TYPE %d \n", REQUEST_MAX_ATTEMPTS, address.String(), datagramType)
+	}
+
+	// We stop waiting : a reply that arrives later will be dropped
+	forgetWaitingResponse(address, datagramId)
+
+	// The answer may have arrived between the last timeout and the removal of the entry
+	select {
+	case response := <-responses:
+		return response, responseError(response)
+	default:
+		if writeErr != nil {
+			return nil, fmt.Errorf("%w : %w", ErrNoResponse, writeErr)
+		}
+		return nil, ErrNoResponse
+	}
+}
+
+func forgetWaitingResponse(address *net.UDPAddr, datagramId string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	j := sliceContainsWaitingResponse(waitingResponses, address.String(), []byte(datagramId))
+	if j != -1 {
+		waitingResponses = append(waitingResponses[:j], waitingResponses[j+1:]...)
+	}
+}
+
+func responseError(response Datagram) error {
+	switch response := response.(type) {
+	case *ParsedNoDatum:
+		return ErrNoDatum
+	case *ParsedError:
+		return &PeerError{Message: response.Message}
 	}
+	return nil
 }
 
-func UdpWrite(conn net.PacketConn, datagramId string, datagramType int, address *net.UDPAddr, data []byte, privateKey *ecdsa.PrivateKey) bool {
+/* Builds the datagram of the given type (encrypted if we share a key with the peer),
+ * and returns it with the list of the types of the datagrams that can answer it.
+ */
+func buildDatagram(conn net.PacketConn, datagramId string, datagramType int, address *net.UDPAddr, data []byte, privateKey *ecdsa.PrivateKey) ([]byte, []int) {
 	var datagram []byte
 	var responseOptions []int
-	var responseReceived bool
-	var waitingResponse *WaitingResponse
-	writingSuccessful := true
 
 	switch datagramType {
 	case HELLO_TYPE:
-		datagram = HelloOrHelloReplyDatagram(true, datagramId, NAME_FOR_SERVER_REGISTRATION, privateKey)
+		datagram = HelloOrHelloReplyDatagram(true, datagramId, NAME_FOR_SERVER_REGISTRATION, LOCAL_EXTENSIONS, privateKey)
 		responseOptions = append(responseOptions, HELLO_REPLY_TYPE)
 	case HELLO_REPLY_TYPE:
-		datagram = HelloOrHelloReplyDatagram(false, datagramId, NAME_FOR_SERVER_REGISTRATION, privateKey)
+		datagram = HelloOrHelloReplyDatagram(false, datagramId, NAME_FOR_SERVER_REGISTRATION, LOCAL_EXTENSIONS, privateKey)
 	case ROOT_REQUEST_TYPE:
 		datagram = RootRequestDatagram(datagramId, privateKey)
 		responseOptions = append(responseOptions, ROOT_TYPE)
 	case ROOT_TYPE:
 		datagram = RootDatagram(datagramId, privateKey)
 	case GET_DATUM_TYPE:
-		datagram = GetDatumDatagram(datagramId, data)
+		datagram = GetDatumDatagram(datagramId, data, privateKey)
 		responseOptions = append(responseOptions, NO_DATUM_TYPE, DATUM_TYPE)
 	case DATUM_TYPE:
-		datagram = DatumDatagram(datagramId, data)
+		datagram = DatumDatagram(datagramId, data, privateKey)
 	case ERROR_TYPE:
-		datagram = ErrorDatagram(datagramId, data)
+		datagram = ErrorDatagram(datagramId, data, privateKey)
 	case SEND_KEY_HELLO_TYPE:
 		datagram = SendKeyDatagram(datagramId, data, privateKey, false)
+		responseOptions = append(responseOptions, SEND_KEY_HELLO_REPLY_TYPE)
 	case SEND_KEY_HELLO_REPLY_TYPE:
 		datagram = SendKeyDatagram(datagramId, data, privateKey, true)
 
 	default:
-		return false
+		return nil, nil
 	}
 
-	i := sliceContainsSessionWeOpened(sessionsWeOpened, address.String(), conn, privateKey)
-	if i != -1 {
-		if sessionsWeOpened[i].sharedKey != nil {
-			datagram = Encrypt(sessionsWeOpened[i].sharedKey, datagram)
-		}
-	}
-
-	waitForResponse := len(responseOptions) != 0
-	if waitForResponse {
-		mutex.Lock()
-		i := sliceContainsAddress(waitingResponses, address.String())
-		if i == -1 {
-			waitingResponse = &WaitingResponse{FullAddress: address, DatagramTypes: responseOptions}
-			waitingResponses = append(waitingResponses, *waitingResponse)
-		} else {
-			waitingResponses[i].DatagramTypes = append(waitingResponses[i].DatagramTypes, responseOptions...)
-		}
-		mutex.Unlock()
-	}
-
-	responseReceived = false
-	for i := 0; !responseReceived && i < 4; i++ {
-		// Exponential growth (Croissance exponentielle)
-		// Formula : f(x)=a(1+r)^{x}
-		// a    =   initial amount
-		// r	=	growth rate
-		// {x}	=	number of time intervals
-		// Source : Google ("Exponential growth Formula")
-		r := 1
-		timeOut := 0.0
-		if waitForResponse {
-			timeOut = 2 * math.Pow(float64(1+r), float64(i))
-		}
-
-		if DEBUG_MODE {
-			PrintDatagram(true, address.String(), datagram, timeOut)
-		}
-
-		_, err := conn.WriteTo(datagram, address)
-		if err != nil {
-			log.Fatalf("The method WriteTo failed in udpWrite() to %s : %v", address.String(), err)
-		}
+	return datagram, responseOptions
+}
 
-		if waitForResponse {
-			time.Sleep(time.Duration(timeOut * float64(time.Second)))
-			mutex.Lock()
-			if sliceContainsAddress(waitingResponses, address.String()) == -1 {
-				responseReceived = true
-			} else {
-				if i == 3 {
-					if DEBUG_MODE {
-						log.Printf("AFTER %d ATTEMPTS, WE DID NOT GET THE ANSWER WE EXPECTED FROM %s TO DATAGRAM OF TYPE %d \n", i+1, address.String(), datagramType)
-					}
-					writingSuccessful = false
-				}
-			}
-			mutex.Unlock()
-		} else {
-			responseReceived = true
-		}
+/* An error of WriteTo (for example an unreachable address given by another peer) must not stop the peer : it is logged and returned.
+ * For a request, it is the same as a datagram lost on the network.
+ * The datagram is encrypted here if we share keys with the peer, so that each attempt of a request has its own nonce.
+ */
+func writeDatagram(conn net.PacketConn, datagram []byte, address *net.UDPAddr, timeOut float64) error {
+	if DEBUG_MODE {
+		PrintDatagram(true, address.String(), datagram, timeOut)
 	}
 
-	return writingSuccessful
-
-}
-
-func sliceContainsAddress(slice []WaitingResponse, address string) int {
-	for i, element := range slice {
-		if element.FullAddress.String() == address {
-			return i
-		}
+	encryptedDatagram, err := sessionManager.EncryptDatagram(address, datagram)
+	if err != nil {
+		log.Printf("The method EncryptDatagram() failed in writeDatagram() for %s : %v \n", address.String(), err)
+		return err
 	}
-	return -1
-}
 
-func sliceContainsSession(slice []OpenSession, address string) int {
-	for i, element := range slice {
-		if element.FullAddress.String() == address {
-			// After an hour the session is no longer valid and in that case we remove it
-			if time.Since(element.LastHandshakeTime).Minutes() > 55 {
-				openSessions = append(openSessions[:i], openSessions[i+1:]...)
-				return -1
-			} else {
-				return i
-			}
-		}
+	_, err = conn.WriteTo(encryptedDatagram, address)
+	if err != nil {
+		log.Printf("The method WriteTo failed in udpWrite() to %s : %v \n", address.String(), err)
 	}
-	return -1
+	return err
 }
 
-func sliceContainsSessionWeOpened(slice []SessionWeOpened, address string, conn net.PacketConn, privateKey *ecdsa.PrivateKey) int {
+func sliceContainsWaitingResponse(slice []WaitingResponse, address string, id []byte) int {
 	for i, element := range slice {
-		if element.FullAddress.String() == address {
+		if element.FullAddress.String() == address && bytes.Equal(element.Id, id) {
 			return i
 		}
 	}
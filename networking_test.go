@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* A peer that answers our Hello, then forgets us : every request gets the "no handshake" Error */
+func runForgetfulPeer(conn net.PacketConn, privateKey *ecdsa.PrivateKey, received map[int]int, receivedMutex *sync.Mutex) {
+	buf := make([]byte, BUFFER_SIZE)
+	for {
+		n, address, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < DATAGRAM_MIN_LENGTH {
+			continue
+		}
+		id := string(buf[ID_FIRST_BYTE : ID_FIRST_BYTE+ID_LENGTH])
+		datagramType := int(buf[TYPE_BYTE])
+
+		receivedMutex.Lock()
+		received[datagramType]++
+		receivedMutex.Unlock()
+
+		var answer []byte
+		switch {
+		case datagramType == HELLO_TYPE:
+			answer = HelloOrHelloReplyDatagram(false, id, "Forgetful", EXTENSION_ENCRYPTION, privateKey)
+		case datagramType < 128:
+			answer = ErrorDatagram(id, []byte(NO_HANDSHAKE_ERROR_MESSAGE), privateKey)
+		default:
+			continue
+		}
+		conn.WriteTo(answer, address)
+	}
+}
+
+func TestUdpWriteHandshakesAgainOnlyOnce(t *testing.T) {
+	previousDebugMode, previousPolicy := DEBUG_MODE, SIGNATURE_POLICY
+	defer func() { DEBUG_MODE, SIGNATURE_POLICY = previousDebugMode, previousPolicy }()
+	DEBUG_MODE = false
+	policy, err := ParseSignaturePolicy("none", UNKNOWN_SENDER_ACCEPT, SIGNATURE_FAILURE_DROP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SIGNATURE_POLICY = policy
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+
+	received := make(map[int]int)
+	var receivedMutex sync.Mutex
+	go runForgetfulPeer(peerConn, privateKey, received, &receivedMutex)
+	go UdpRead(conn, privateKey, nil, nil, nil)
+
+	peerAddress := peerConn.LocalAddr().(*net.UDPAddr)
+	done := make(chan error, 1)
+	go func() {
+		_, err := UdpWrite(conn, NewDatagramId(), ROOT_REQUEST_TYPE, peerAddress, nil, privateKey)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		var peerError *PeerError
+		if !errors.As(err, &peerError) || !isNoHandshakeError(peerError.Message) {
+			t.Errorf("the request ended with %v, expected the no handshake Error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the request does not end : the handshake is done again without end")
+	}
+
+	receivedMutex.Lock()
+	defer receivedMutex.Unlock()
+	expected := map[int]int{ROOT_REQUEST_TYPE: 2, HELLO_TYPE: 1, SEND_KEY_HELLO_TYPE: 1}
+	for datagramType, count := range expected {
+		if received[datagramType] != count {
+			t.Errorf("the peer received %d datagrams of type %d, expected %d (%v)", received[datagramType], datagramType, count, received)
+		}
+	}
+}
+
+/* A replayed datagram, or one that does not decrypt with the keys of the session, gets no answer : anyone can send them */
+func TestUdpReadDropsReplayedAndForgedDatagrams(t *testing.T) {
+	previousDebugMode, previousPolicy := DEBUG_MODE, SIGNATURE_POLICY
+	defer func() { DEBUG_MODE, SIGNATURE_POLICY = previousDebugMode, previousPolicy }()
+	DEBUG_MODE = false
+	policy, err := ParseSignaturePolicy("none", UNKNOWN_SENDER_ACCEPT, SIGNATURE_FAILURE_DROP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SIGNATURE_POLICY = policy
+	ThisPeerMerkleTreeMutex.Lock()
+	previousTree := ThisPeerMerkleTree
+	ThisPeerMerkleTree = CreateTree(testMessages(1), MERKLE_TREE_MAX_ARITY)
+	ThisPeerMerkleTreeMutex.Unlock()
+	defer func() {
+		ThisPeerMerkleTreeMutex.Lock()
+		ThisPeerMerkleTree = previousTree
+		ThisPeerMerkleTreeMutex.Unlock()
+	}()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	go UdpRead(conn, testPrivateKey(t), nil, nil, nil)
+
+	address := conn.LocalAddr().(*net.UDPAddr)
+	peerAddress := peerConn.LocalAddr().(*net.UDPAddr)
+	sessionManager.Accept("", EXTENSION_ENCRYPTION, peerAddress)
+	defer sessionManager.Close(peerAddress)
+	peer := NewSessionManager()
+	peer.Open("", "us", EXTENSION_ENCRYPTION, address)
+	exchangeKeys(t, peer, sessionManager, peerAddress, address, "efgh")
+
+	encrypted, err := peer.EncryptDatagram(address, testDatagram(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := peer.EncryptDatagram(address, testDatagram(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged[len(forged)-1] ^= 1
+
+	buf := make([]byte, BUFFER_SIZE)
+	answered := func(datagram []byte) bool {
+		if _, err := peerConn.WriteTo(datagram, address); err != nil {
+			t.Fatal(err)
+		}
+		peerConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, _, err := peerConn.ReadFrom(buf)
+		return err == nil
+	}
+
+	if !answered(encrypted) {
+		t.Fatal("the request is not answered")
+	}
+	if answered(encrypted) {
+		t.Error("the replayed request is answered")
+	}
+	if answered(forged) {
+		t.Error("the forged request is answered")
+	}
+}
+
+/* The certificate of the server is trusted with the pin of its fingerprint or with a certificate authority, never without them */
+func TestServerTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	defer server.Close()
+	// The servers of httptest share one certificate : the other server has its own
+	directory := t.TempDir()
+	otherCertificate, err := loadOrCreateCertificate(filepath.Join(directory, "other_cert.pem"), filepath.Join(directory, "other_key.pem"), []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherServer := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	otherServer.TLS = &tls.Config{Certificates: []tls.Certificate{otherCertificate}}
+	otherServer.StartTLS()
+	defer otherServer.Close()
+
+	fingerprint := sha256.Sum256(server.Certificate().Raw)
+	pin := hex.EncodeToString(fingerprint[:])
+	otherFingerprint := sha256.Sum256(otherServer.Certificate().Raw)
+	wrongPin := hex.EncodeToString(otherFingerprint[:])
+
+	writeCertificate := func(name string, data []byte) string {
+		fileName := filepath.Join(directory, name)
+		if err := os.WriteFile(fileName, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+	caFile := writeCertificate("ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	otherCaFile := writeCertificate("other.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherServer.Certificate().Raw}))
+	invalidCaFile := writeCertificate("invalid.pem", []byte("not a certificate"))
+	missingCaFile := filepath.Join(directory, "missing.pem")
+
+	tests := []struct {
+		name        string
+		caFile      string
+		fingerprint string
+		configError bool // serverTLSConfig fails
+		trusted     bool // The connection to the server succeeds
+	}{
+		{"nothing", "", "", false, false},
+		{"matching pin", "", pin, false, true},
+		{"matching pin in capitals", "", strings.ToUpper(pin), false, true},
+		{"wrong pin", "", wrongPin, false, false},
+		{"CA file", caFile, "", false, true},
+		{"CA file and matching pin", caFile, pin, false, true},
+		{"CA file and wrong pin", caFile, wrongPin, false, false},
+		{"CA file of another server", otherCaFile, "", false, false},
+		{"CA file of another server and matching pin", otherCaFile, pin, false, false},
+		{"missing CA file", missingCaFile, "", true, false},
+		{"missing CA file and matching pin", missingCaFile, pin, true, false},
+		{"invalid CA file", invalidCaFile, "", true, false},
+		{"invalid pin", "", pin[:10], true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlsConfig, err := serverTLSConfig(test.caFile, test.fingerprint)
+			if (err != nil) != test.configError {
+				t.Fatalf("serverTLSConfig() = %v, expected an error : %v", err, test.configError)
+			}
+			if err != nil {
+				return
+			}
+
+			client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			response, err := client.Get(server.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+			if (err == nil) != test.trusted {
+				t.Errorf("the request ended with %v, expected the server trusted : %v", err, test.trusted)
+			}
+			if test.fingerprint == wrongPin && !errors.Is(err, ErrServerCertificateMismatch) {
+				t.Errorf("the request ended with %v, expected %v", err, ErrServerCertificateMismatch)
+			}
+		})
+	}
+}
+
+/* The answer of a request is the datagram from its address, with its Id and one of its types : the others are dropped */
+func TestUdpWriteMatchesTheAnswer(t *testing.T) {
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	otherConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherConn.Close()
+	conn, peerAddress, privateKey := testSessionWithPeer(t, peerConn)
+	peerPrivateKey := testPrivateKey(t)
+	hash := bytes.Repeat([]byte{1}, HASH_LENGTH)
+
+	go func() {
+		buf := make([]byte, BUFFER_SIZE)
+		_, address, err := peerConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		id := string(buf[ID_FIRST_BYTE : ID_FIRST_BYTE+ID_LENGTH])
+
+		// An Error answers any request : only its address, or its Id, tells that it is not the answer
+		answers := []struct {
+			conn     net.PacketConn
+			datagram []byte
+		}{
+			{otherConn, ErrorDatagram(id, []byte("another address"), peerPrivateKey)},
+			{peerConn, ErrorDatagram("zzzz", []byte("another id"), peerPrivateKey)},
+			{peerConn, HelloOrHelloReplyDatagram(false, id, "another type", 0, peerPrivateKey)},
+			{peerConn, NoDatumDatagram(id, hash, peerPrivateKey)},
+		}
+		for _, answer := range answers {
+			answer.conn.WriteTo(answer.datagram, address)
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	response, err := UdpWrite(conn, NewDatagramId(), GET_DATUM_TYPE, peerAddress, hash, privateKey)
+	if _, ok := response.(*ParsedNoDatum); !ok || !errors.Is(err, ErrNoDatum) {
+		t.Errorf("the answer is %T (%v), expected the NoDatum", response, err)
+	}
+}
+
+/* Short timeouts for the attempts of the requests */
+func shortRequestTimeouts(t *testing.T) {
+	previousAttempts, previousTimeout := REQUEST_MAX_ATTEMPTS, REQUEST_FIRST_TIMEOUT
+	t.Cleanup(func() { REQUEST_MAX_ATTEMPTS, REQUEST_FIRST_TIMEOUT = previousAttempts, previousTimeout })
+	REQUEST_MAX_ATTEMPTS, REQUEST_FIRST_TIMEOUT = 4, 20*time.Millisecond
+}
+
+/* A peer that never answers : the Id and the time of each datagram it receives are sent on received */
+type receivedDatagram struct {
+	Id   string
+	Time time.Time
+}
+
+func runSilentPeer(conn net.PacketConn, received chan<- receivedDatagram) {
+	buf := make([]byte, BUFFER_SIZE)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n >= DATAGRAM_MIN_LENGTH {
+			received <- receivedDatagram{Id: string(buf[ID_FIRST_BYTE : ID_FIRST_BYTE+ID_LENGTH]), Time: time.Now()}
+		}
+	}
+}
+
+/* The attempts of a request are sent again with the same Id after a timeout that doubles each time */
+func checkAttempts(t *testing.T, received chan receivedDatagram, maxAttempts int, firstTimeout time.Duration) {
+	t.Helper()
+	time.Sleep(4 * firstTimeout << maxAttempts) // No attempt after the last one
+	var attempts []receivedDatagram
+	for len(received) > 0 {
+		attempts = append(attempts, <-received)
+	}
+	if len(attempts) != maxAttempts {
+		t.Fatalf("%d attempts, expected %d", len(attempts), maxAttempts)
+	}
+	for i := 1; i < len(attempts); i++ {
+		if attempts[i].Id != attempts[0].Id {
+			t.Errorf("the attempt %d has the Id %q, expected %q", i+1, attempts[i].Id, attempts[0].Id)
+		}
+		if gap, timeout := attempts[i].Time.Sub(attempts[i-1].Time), firstTimeout<<(i-1); gap < timeout*3/4 {
+			t.Errorf("the attempt %d was sent %v after the previous one, expected %v", i+1, gap, timeout)
+		}
+	}
+}
+
+func TestUdpWriteAttempts(t *testing.T) {
+	shortRequestTimeouts(t)
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	conn, peerAddress, privateKey := testSessionWithPeer(t, peerConn)
+	received := make(chan receivedDatagram, 100)
+	go runSilentPeer(peerConn, received)
+
+	start := time.Now()
+	_, err = UdpWrite(conn, NewDatagramId(), ROOT_REQUEST_TYPE, peerAddress, nil, privateKey)
+	if !errors.Is(err, ErrNoResponse) {
+		t.Errorf("the request ended with %v, expected %v", err, ErrNoResponse)
+	}
+	if elapsed, expected := time.Since(start), REQUEST_FIRST_TIMEOUT*(1<<REQUEST_MAX_ATTEMPTS-1); elapsed < expected {
+		t.Errorf("the request ended after %v, expected %v", elapsed, expected)
+	}
+	checkAttempts(t, received, REQUEST_MAX_ATTEMPTS, REQUEST_FIRST_TIMEOUT)
+}
+
+/* The error of the write of the datagram is returned */
+func TestUdpWriteReturnsTheWriteError(t *testing.T) {
+	shortRequestTimeouts(t)
+	privateKey := testPrivateKey(t)
+	address := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A datagram that is not a request, to an address we cannot send to
+	if _, err := UdpWrite(conn, NewDatagramId(), HELLO_REPLY_TYPE, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, nil, privateKey); err == nil {
+		t.Error("the write to the port 0 did not fail")
+	}
+	// A request to an address we cannot send to : it is a datagram lost on the network, until the last attempt
+	var writeError *net.OpError
+	if _, err := UdpWrite(conn, NewDatagramId(), ROOT_REQUEST_TYPE, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, nil, privateKey); !errors.Is(err, ErrNoResponse) || !errors.As(err, &writeError) {
+		t.Errorf("the request ended with %v, expected %v with the error of the write", err, ErrNoResponse)
+	}
+
+	// Our socket is closed : the request ends at once
+	conn.Close()
+	if _, err := UdpWrite(conn, NewDatagramId(), HELLO_REPLY_TYPE, address, nil, privateKey); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("the write ended with %v, expected %v", err, net.ErrClosed)
+	}
+	REQUEST_FIRST_TIMEOUT = time.Minute
+	start := time.Now()
+	if _, err := UdpWrite(conn, NewDatagramId(), ROOT_REQUEST_TYPE, address, nil, privateKey); !errors.Is(err, net.ErrClosed) || time.Since(start) > 10*time.Second {
+		t.Errorf("the request ended with %v after %v, expected %v at once", err, time.Since(start), net.ErrClosed)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/* The nodes we downloaded from the other peers are kept on the disk, so that after a restart
+ * we only request the nodes we do not have yet. There is one store per peer, in NAME_DIR_NODES,
+ * named after the fingerprint of the public key of the peer (or after its name if it does not sign its messages).
+ * A store is an append-only log with the same records as the post store : each record is the Data field of a node,
+ * and the nodes are found by their hash (the SHA-256 of the record).
+ */
+
+const NODE_STORE_FINGERPRINT_LENGTH = 16 // The number of bytes of the SHA-256 of the key used in the name of the file
+
+type NodeStore struct {
+	mutex    sync.Mutex
+	file     *os.File
+	fileName string
+	size     int64
+	nodes    map[[HASH_LENGTH]byte][]byte
+	dirty    bool // Records were written since the last Sync()
+}
+
+var nodeStores = make(map[string]*NodeStore) // The stores already opened, by file name
+var nodeStoresMutex sync.Mutex
+
+func OpenNodeStore(fileName string) (*NodeStore, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	records, offset, recordErr, err := readLogRecords(file, 0, ValidateNodeData)
+	if err == nil && recordErr != nil {
+		err = truncateDamagedLog(file, fileName, offset, recordErr)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	store := &NodeStore{file: file, fileName: fileName, size: offset, nodes: make(map[[HASH_LENGTH]byte][]byte, len(records))}
+	for _, record := range records {
+		store.nodes[sha256.Sum256(record)] = record
+	}
+	return store, nil
+}
+
+/* The store of the nodes of a peer, opened the first time it is needed.
+ * The peer is identified by its key (base64, as given by the server) or, if it has none, by its name.
+ */
+func PeerNodeStore(peerName string, peerKey string) (*NodeStore, error) {
+	var storeName string
+	keyBytes, err := base64.RawStdEncoding.DecodeString(peerKey)
+	if peerKey != "" && err == nil {
+		fingerprint := sha256.Sum256(keyBytes)
+		storeName = fmt.Sprintf("key-%x.nodes", fingerprint[:NODE_STORE_FINGERPRINT_LENGTH])
+	} else if validatePeerName(peerName) == nil {
+		storeName = fmt.Sprintf("name-%x.nodes", peerName) // In hexadecimal : the name can contain any character
+	} else {
+		return nil, fmt.Errorf("the peer has neither a key nor a name")
+	}
+	fileName := filepath.Join(NAME_DIR_NODES, storeName)
+
+	nodeStoresMutex.Lock()
+	defer nodeStoresMutex.Unlock()
+
+	if store, found := nodeStores[fileName]; found {
+		return store, nil
+	}
+	if err := os.MkdirAll(NAME_DIR_NODES, 0700); err != nil {
+		return nil, err
+	}
+	store, err := OpenNodeStore(fileName)
+	if err != nil {
+		return nil, err
+	}
+	nodeStores[fileName] = store
+	return store, nil
+}
+
+/* The Data field of the node with this hash, or nil */
+func (store *NodeStore) Get(hash []byte) []byte {
+	key, ok := hashKey(hash)
+	if !ok {
+		return nil
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.nodes[key]
+}
+
+/* Adds a node that passed CheckHash(). The record is on the disk after the next Sync(). */
+func (store *NodeStore) Put(hash []byte, nodeData []byte) error {
+	key, ok := hashKey(hash)
+	if !ok || !CheckHash(hash, nodeData) {
+		return fmt.Errorf("the hash does not match the node")
+	}
+	if err := ValidateNodeData(nodeData); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, found := store.nodes[key]; found {
+		return nil
+	}
+
+	record := encodeLogRecord(nodeData)
+	n, err := store.file.Write(record)
+	if err != nil {
+		if n > 0 {
+			store.file.Truncate(store.size)
+		}
+		return err
+	}
+	store.size += int64(len(record))
+	store.nodes[key] = append([]byte{}, nodeData...)
+	store.dirty = true
+	return nil
+}
+
+/* A download writes many nodes : we call fsync once at the end instead of once per node.
+ * If the program stops before, the records that were not written completely are removed at the next start.
+ */
+func (store *NodeStore) Sync() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if !store.dirty {
+		return nil
+	}
+	store.dirty = false
+	return store.file.Sync()
+}
+
+/* The store of the peer of a session we opened, or nil if we cannot open it (the download then works without it) */
+func nodeStoreForSession(session *Session) *NodeStore {
+	store, err := PeerNodeStore(session.Name(), session.PeerKey)
+	if err != nil {
+		log.Printf("The node store of %s could not be opened : %v \n", session.Name(), err)
+		return nil
+	}
+	return store
+}
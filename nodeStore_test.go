@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+/* The download of the menu : the trees of the sessions can be read while it waits for the peer, and its nodes are kept in the node store */
+func TestGetMerkleTreeAnotherPeer(t *testing.T) {
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	conn, peerAddress, privateKey := testSessionWithPeer(t, peerConn)
+
+	source := CreateTree(testMessages(10), 4)
+	sessionManager.Update(peerAddress, func(session *Session) { updateSessionRoot(session, source.Root.Hash) })
+	requested := make(chan []byte, 1)
+	release := make(chan struct{})
+	go runTreePeer(peerConn, source, testPrivateKey(t), requested, release)
+
+	sessionTreesMutex.RLock() // A menu reads the trees
+	done := make(chan bool, 1)
+	go func() { done <- getMerkleTreeAnotherPeer(conn, peerAddress.String(), privateKey) }()
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download waits for the trees to be read before asking the peer")
+	}
+	sessionTreesMutex.RUnlock()
+	close(release)
+
+	select {
+	case found := <-done:
+		if !found {
+			t.Fatal("no session with the peer")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the download does not end")
+	}
+	session, _ := sessionManager.Find(peerAddress)
+	if !bytes.Equal(session.Merkle.Root.Hash, source.Root.Hash) || countLeaves(session.Merkle) != 10 {
+		t.Errorf("the session has the root %x with %d messages, expected %x with 10", session.Merkle.Root.Hash, countLeaves(session.Merkle), source.Root.Hash)
+	}
+	store := nodeStoreForSession(&session)
+	if store == nil || store.Get(lastLeaf(source).Hash) == nil {
+		t.Error("the nodes downloaded are not in the node store")
+	}
+}
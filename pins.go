@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* The keys of the other peers, pinned the first time we see them (trust on first use) and saved in NAME_FILE_KNOWN_PEERS.
+ * If the server later gives another key for a peer, the peer is blocked (we keep the pinned key) until the new key is accepted :
+ * with "pins verify <name> <fingerprint>" (or the menu) after comparing the fingerprint with the one the peer gives us itself,
+ * or with "pins remove <name>" to pin again the key of the server. A rotation signed with the pinned key is accepted without asking.
+ * The file is read again for each check, so that the pins commands can be used while the peer runs.
+ */
+
+var ErrKeyChanged = errors.New("the key of the peer changed")
+
+type KeyPin struct {
+	Name         string    `json:"name"`
+	Key          string    `json:"key"` // "" if the peer does not sign its messages
+	Fingerprint  string    `json:"fingerprint"`
+	FirstSeen    time.Time `json:"first_seen"`
+	Verified     bool      `json:"verified,omitempty"`    // The fingerprint was compared with the one given by the peer itself
+	PendingKey   string    `json:"pending_key,omitempty"` // Another key given by the server, waiting to be accepted
+	PendingSince time.Time `json:"pending_since,omitzero"`
+}
+
+type KnownPeers struct {
+	mutex    sync.Mutex
+	fileName string
+}
+
+type knownPeersFile struct {
+	Pins []KeyPin `json:"pins"`
+}
+
+var knownPeers *KnownPeers // The pins of the peer, nil for the commands that do not need them
+
+func NewKnownPeers(fileName string) *KnownPeers {
+	return &KnownPeers{fileName: fileName}
+}
+
+/* The SHA-256 of the 64 bytes of the key, in hexadecimal : the same for the peer itself (key export-public -fingerprint) */
+func KeyFingerprint(key string) string {
+	if key == "" {
+		return "none"
+	}
+	keyBytes, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil {
+		return "invalid"
+	}
+	fingerprint := sha256.Sum256(keyBytes)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+/* The fingerprint as it may be typed : upper case, with ':' or spaces */
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+}
+
+func (knownPeers *KnownPeers) load() ([]KeyPin, error) {
+	data, err := os.ReadFile(knownPeers.fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file knownPeersFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("the known peers %s are not valid : %v", knownPeers.fileName, err)
+	}
+	return file.Pins, nil
+}
+
+func (knownPeers *KnownPeers) save(pins []KeyPin) error {
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Name < pins[j].Name })
+	data, err := json.MarshalIndent(knownPeersFile{Pins: pins}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(knownPeers.fileName, data, 0600)
+}
+
+func findPin(pins []KeyPin, name string) int {
+	for i := range pins {
+		if pins[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+/* Checks the key the server gave for the peer against its pin. The first key of a peer is pinned.
+ * ErrKeyChanged if the key changed without a rotation signed with the pinned key : the peer must not be used with this key.
+ */
+func (knownPeers *KnownPeers) Check(peer Peer) error {
+	knownPeers.mutex.Lock()
+	defer knownPeers.mutex.Unlock()
+
+	pins, err := knownPeers.load()
+	if err != nil {
+		return err
+	}
+
+	i := findPin(pins, peer.Username)
+	if i == -1 {
+		pins = append(pins, KeyPin{Name: peer.Username, Key: peer.Key, Fingerprint: KeyFingerprint(peer.Key), FirstSeen: time.Now()})
+		log.Printf("KEY OF %s PINNED, FINGERPRINT : %s \n", peer.Username, KeyFingerprint(peer.Key))
+		return knownPeers.save(pins)
+	}
+
+	pin := &pins[i]
+	if pin.Key == peer.Key {
+		if pin.PendingKey == "" {
+			return nil
+		}
+		pin.PendingKey, pin.PendingSince = "", time.Time{} // The server gives the pinned key again
+		return knownPeers.save(pins)
+	}
+
+	if pin.Key != "" {
+		if key, err := FollowKeyRotations(peer.Username, pin.Key, peer.Rotations); err == nil && key == peer.Key {
+			pin.Key, pin.Fingerprint = peer.Key, KeyFingerprint(peer.Key)
+			pin.PendingKey, pin.PendingSince = "", time.Time{}
+			log.Printf("THE KEY OF %s WAS ROTATED, NEW FINGERPRINT : %s \n", peer.Username, pin.Fingerprint)
+			return knownPeers.save(pins)
+		}
+	}
+
+	if pin.PendingKey != peer.Key {
+		pin.PendingKey, pin.PendingSince = peer.Key, time.Now()
+		if err := knownPeers.save(pins); err != nil {
+			return err
+		}
+	}
+	log.Printf("\n"+
+		"************************************************************\n"+
+		"WARNING : THE KEY OF %s CHANGED, THE SERVER MAY BE COMPROMISED\n"+
+		"PINNED KEY          : %s (SINCE %s)\n"+
+		"KEY OF THE SERVER   : %s\n"+
+		"THE PEER IS BLOCKED UNTIL THE NEW KEY IS ACCEPTED : pins verify %s <fingerprint> (menu u)\n"+
+		"************************************************************\n",
+		peer.Username, pin.Fingerprint, pin.FirstSeen.Format(time.DateTime), KeyFingerprint(peer.Key), peer.Username)
+	return fmt.Errorf("%w : %s is blocked until its new key is accepted", ErrKeyChanged, peer.Username)
+}
+
+func (knownPeers *KnownPeers) List() ([]KeyPin, error) {
+	knownPeers.mutex.Lock()
+	defer knownPeers.mutex.Unlock()
+	return knownPeers.load()
+}
+
+/* Compares the fingerprint (obtained from the peer itself) with the pin. If it is the one of the pending key, the new key is accepted. */
+func (knownPeers *KnownPeers) Verify(name string, fingerprint string) (string, error) {
+	knownPeers.mutex.Lock()
+	defer knownPeers.mutex.Unlock()
+
+	pins, err := knownPeers.load()
+	if err != nil {
+		return "", err
+	}
+	i := findPin(pins, name)
+	if i == -1 {
+		return "", fmt.Errorf("no key is pinned for %s", name)
+	}
+
+	pin := &pins[i]
+	fingerprint = normalizeFingerprint(fingerprint)
+	switch {
+	case pin.Key != "" && fingerprint == pin.Fingerprint:
+		pin.Verified = true
+		return fmt.Sprintf("the pinned key of %s is verified", name), knownPeers.save(pins)
+	case pin.PendingKey != "" && fingerprint == KeyFingerprint(pin.PendingKey):
+		pin.Key, pin.Fingerprint, pin.FirstSeen, pin.Verified = pin.PendingKey, fingerprint, pin.PendingSince, true
+		pin.PendingKey, pin.PendingSince = "", time.Time{}
+		return fmt.Sprintf("the new key of %s is accepted", name), knownPeers.save(pins)
+	}
+	return "", fmt.Errorf("the fingerprint matches neither the pinned key of %s nor the key waiting to be accepted", name)
+}
+
+func (knownPeers *KnownPeers) Remove(name string) error {
+	knownPeers.mutex.Lock()
+	defer knownPeers.mutex.Unlock()
+
+	pins, err := knownPeers.load()
+	if err != nil {
+		return err
+	}
+	i := findPin(pins, name)
+	if i == -1 {
+		return fmt.Errorf("no key is pinned for %s", name)
+	}
+	return knownPeers.save(append(pins[:i], pins[i+1:]...))
+}
+
+func PrintPins(pins []KeyPin) {
+	if len(pins) == 0 {
+		fmt.Println("No key is pinned")
+		return
+	}
+	for _, pin := range pins {
+		state := "not verified"
+		if pin.Verified {
+			state = "verified"
+		}
+		fmt.Printf("%s : %s (first seen %s, %s) \n", pin.Name, pin.Fingerprint, pin.FirstSeen.Format(time.DateTime), state)
+		if pin.PendingKey != "" {
+			fmt.Printf("    BLOCKED : the server gives another key since %s : %s \n", pin.PendingSince.Format(time.DateTime), KeyFingerprint(pin.PendingKey))
+		}
+	}
+}
+
+/* PINS COMMANDS
+ *  pins list : the pinned keys, and the keys waiting to be accepted
+ *  pins verify <name> <fingerprint> : compares the fingerprint with the pin, and accepts the new key if it is the one waiting
+ *  pins remove <name> : forgets the key of the peer, the next key given by the server is pinned
+ */
+func RunPinsCommand(args []string) {
+	knownPeers := NewKnownPeers(NAME_FILE_KNOWN_PEERS)
+	if len(args) == 0 {
+		log.Fatalf("Usage : pins list | pins verify <name> <fingerprint> | pins remove <name> \n")
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		pins, err := knownPeers.List()
+		if err != nil {
+			log.Fatalf("%v \n", err)
+		}
+		PrintPins(pins)
+	case args[0] == "verify" && len(args) == 3:
+		result, err := knownPeers.Verify(args[1], args[2])
+		if err != nil {
+			log.Fatalf("%v \n", err)
+		}
+		fmt.Println(result)
+	case args[0] == "remove" && len(args) == 2:
+		if err := knownPeers.Remove(args[1]); err != nil {
+			log.Fatalf("%v \n", err)
+		}
+		fmt.Printf("The key of %s is no longer pinned \n", args[1])
+	default:
+		log.Fatalf("Usage : pins list | pins verify <name> <fingerprint> | pins remove <name> \n")
+	}
+}
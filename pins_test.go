@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKnownPeers(t *testing.T) *KnownPeers {
+	t.Helper()
+	return NewKnownPeers(filepath.Join(t.TempDir(), "known_peers.json"))
+}
+
+func testPin(t *testing.T, knownPeers *KnownPeers, name string) KeyPin {
+	t.Helper()
+	pins, err := knownPeers.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := findPin(pins, name)
+	if i == -1 {
+		t.Fatalf("no key is pinned for %s", name)
+	}
+	return pins[i]
+}
+
+/* The keys the server gives for alice, one after the other, and what the pin becomes */
+func TestKnownPeersCheck(t *testing.T) {
+	rotations, privateKeys := testKeyRotations(t, "alice", 2)
+	keys := make([]string, len(privateKeys))
+	for i, privateKey := range privateKeys {
+		keys[i] = CreatePublicKeyEncoded(privateKey)
+	}
+	otherKey := CreatePublicKeyEncoded(testPrivateKey(t))
+	forgedRotation, _ := testKeyRotations(t, "alice", 1) // Signed by a key that is not pinned
+
+	tests := []struct {
+		name       string
+		peer       Peer
+		changed    bool   // ErrKeyChanged
+		pinned     string // The key pinned after the check
+		pendingKey string
+	}{
+		{"first key", Peer{Username: "alice", Key: keys[0]}, false, keys[0], ""},
+		{"same key", Peer{Username: "alice", Key: keys[0]}, false, keys[0], ""},
+		{"another key", Peer{Username: "alice", Key: otherKey}, true, keys[0], otherKey},
+		{"another key again", Peer{Username: "alice", Key: otherKey}, true, keys[0], otherKey},
+		{"the pinned key again", Peer{Username: "alice", Key: keys[0]}, false, keys[0], ""},
+		{"rotation not signed by the pinned key", Peer{Username: "alice", Key: forgedRotation[0].NewKey, Rotations: forgedRotation}, true, keys[0], forgedRotation[0].NewKey},
+		{"rotation", Peer{Username: "alice", Key: keys[1], Rotations: rotations[:1]}, false, keys[1], ""},
+		{"two rotations from the first key", Peer{Username: "alice", Key: keys[2], Rotations: rotations}, false, keys[2], ""},
+		{"old key", Peer{Username: "alice", Key: keys[0], Rotations: rotations}, true, keys[2], keys[0]},
+		{"no key", Peer{Username: "alice"}, true, keys[2], ""},
+	}
+	knownPeers := testKnownPeers(t)
+	for _, test := range tests {
+		err := knownPeers.Check(test.peer)
+		if changed := errors.Is(err, ErrKeyChanged); changed != test.changed || (err != nil && !changed) {
+			t.Errorf("%s : error %v, key changed %v expected", test.name, err, test.changed)
+		}
+		pin := testPin(t, knownPeers, "alice")
+		if pin.Key != test.pinned || pin.Fingerprint != KeyFingerprint(test.pinned) {
+			t.Errorf("%s : the key pinned is %s, expected %s", test.name, pin.Key, test.pinned)
+		}
+		if pin.PendingKey != test.pendingKey {
+			t.Errorf("%s : the key waiting is %q, expected %q", test.name, pin.PendingKey, test.pendingKey)
+		}
+	}
+}
+
+func TestKnownPeersVerify(t *testing.T) {
+	pinnedKey := CreatePublicKeyEncoded(testPrivateKey(t))
+	newKey := CreatePublicKeyEncoded(testPrivateKey(t))
+	otherKey := CreatePublicKeyEncoded(testPrivateKey(t))
+	// The fingerprint as the user may type it
+	typed := strings.ToUpper(KeyFingerprint(newKey)[:8]) + ":" + KeyFingerprint(newKey)[8:16] + " " + KeyFingerprint(newKey)[16:]
+
+	tests := []struct {
+		name        string
+		peer        string
+		fingerprint string
+		valid       bool
+		pinned      string
+	}{
+		{"unknown peer", "bob", KeyFingerprint(pinnedKey), false, pinnedKey},
+		{"another fingerprint", "alice", KeyFingerprint(otherKey), false, pinnedKey},
+		{"part of the fingerprint", "alice", KeyFingerprint(newKey)[:32], false, pinnedKey},
+		{"empty fingerprint", "alice", "", false, pinnedKey},
+		{"pinned key", "alice", KeyFingerprint(pinnedKey), true, pinnedKey},
+		{"key waiting", "alice", typed, true, newKey},
+	}
+	knownPeers := testKnownPeers(t)
+	if err := knownPeers.Check(Peer{Username: "alice", Key: pinnedKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := knownPeers.Check(Peer{Username: "alice", Key: newKey}); !errors.Is(err, ErrKeyChanged) {
+		t.Fatalf("error %v, expected %v", err, ErrKeyChanged)
+	}
+	for _, test := range tests {
+		_, err := knownPeers.Verify(test.peer, test.fingerprint)
+		if (err == nil) != test.valid {
+			t.Errorf("%s : error %v, valid %v expected", test.name, err, test.valid)
+		}
+		pin := testPin(t, knownPeers, "alice")
+		if pin.Key != test.pinned {
+			t.Errorf("%s : the key pinned is %s, expected %s", test.name, pin.Key, test.pinned)
+		}
+		if test.valid && !pin.Verified {
+			t.Errorf("%s : the pin is not verified", test.name)
+		}
+	}
+	if pin := testPin(t, knownPeers, "alice"); pin.PendingKey != "" {
+		t.Errorf("the new key is still waiting after it was accepted")
+	}
+	if err := knownPeers.Check(Peer{Username: "alice", Key: newKey}); err != nil {
+		t.Errorf("the accepted key : %v", err)
+	}
+}
+
+/* The peer that does not sign its messages has the key "" : the fingerprint "none" cannot accept a key */
+func TestKnownPeersWithoutKey(t *testing.T) {
+	knownPeers := testKnownPeers(t)
+	if err := knownPeers.Check(Peer{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := knownPeers.Verify("alice", "none"); err == nil {
+		t.Error("the fingerprint none was verified")
+	}
+	key := CreatePublicKeyEncoded(testPrivateKey(t))
+	if err := knownPeers.Check(Peer{Username: "alice", Key: key}); !errors.Is(err, ErrKeyChanged) {
+		t.Errorf("a key after no key : error %v, expected %v", err, ErrKeyChanged)
+	}
+}
+
+func TestKnownPeersRemove(t *testing.T) {
+	knownPeers := testKnownPeers(t)
+	for _, name := range []string{"alice", "bob"} {
+		if err := knownPeers.Check(Peer{Username: name, Key: CreatePublicKeyEncoded(testPrivateKey(t))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := knownPeers.Remove("carol"); err == nil {
+		t.Error("an unknown peer was removed")
+	}
+	if err := knownPeers.Remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+	pins, err := knownPeers.List()
+	if err != nil || len(pins) != 1 || pins[0].Name != "bob" {
+		t.Fatalf("pins %v (%v), expected bob only", pins, err)
+	}
+	// The next key of alice is pinned again
+	key := CreatePublicKeyEncoded(testPrivateKey(t))
+	if err := knownPeers.Check(Peer{Username: "alice", Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if pin := testPin(t, knownPeers, "alice"); pin.Key != key {
+		t.Errorf("the key pinned is %s, expected %s", pin.Key, key)
+	}
+}
+
+func TestKnownPeersInvalidFile(t *testing.T) {
+	knownPeers := testKnownPeers(t)
+	if err := writeFileAtomically(knownPeers.fileName, []byte("[not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := knownPeers.Check(Peer{Username: "alice"}); err == nil {
+		t.Error("an invalid file of known peers was used")
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	tests := []struct {
+		key, expected string
+	}{
+		{"", "none"},
+		{"!", "invalid"},
+		{"AAAA", "709e80c88487a2411e1ee4dfb9f22a861492d20c4765150c0c794abd70f8147c"}, // SHA-256 of 3 zero bytes
+	}
+	for _, test := range tests {
+		if fingerprint := KeyFingerprint(test.key); fingerprint != test.expected {
+			t.Errorf("%q : %s, expected %s", test.key, fingerprint, test.expected)
+		}
+	}
+
+	normalized := map[string]string{
+		"abcdef":     "abcdef",
+		"AB:CD:EF":   "abcdef",
+		"ab cd ef":   "abcdef",
+		" AB:cd EF ": "abcdef",
+		"":           "",
+	}
+	for fingerprint, expected := range normalized {
+		if result := normalizeFingerprint(fingerprint); result != expected {
+			t.Errorf("%q : %q, expected %q", fingerprint, result, expected)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+)
+
+/* The messages published by this peer are kept in an append-only log file.
+ * The file can be written by the running peer and by the post command at the same time.
+ * Each record is : the length of the message (4 bytes), the CRC-32 of the message (4 bytes), the message (the Data field of a leaf of the Merkle tree).
+ * A record is written with a single write followed by an fsync. If the peer crashes in the middle of a write,
+ * the incomplete or corrupted record at the end of the file is detected by its length or its CRC and removed at the next start.
+ * If the post command appended records after it before the restart, the damaged record is skipped and the records after it are kept.
+ */
+
+const LOG_RECORD_HEADER_LENGTH = 4 + 4 // Length and CRC-32
+const LOG_RECORD_MAX_LENGTH = MESSAGE_BODY_FIRST_BYTE + 0xFFFF
+
+type PostStore struct {
+	mutex    sync.Mutex
+	file     *os.File
+	fileName string
+	size     int64    // The size of the valid part of the file
+	posts    [][]byte // The messages, in the order in which they were published
+}
+
+/* Opens (or creates) the log file and reads all the valid records */
+func OpenPostStore(fileName string) (*PostStore, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &PostStore{file: file, fileName: fileName}
+	if err := store.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *PostStore) load() error {
+	posts, offset, recordErr, err := readLogRecords(store.file, 0, validatePostRecord)
+	if err != nil {
+		return err
+	}
+	if recordErr != nil {
+		if err := truncateDamagedLog(store.file, store.fileName, offset, recordErr); err != nil {
+			return err
+		}
+	}
+
+	store.posts = posts
+	store.size = offset
+	return nil
+}
+
+func validatePostRecord(record []byte) error {
+	if err := ValidateNodeData(record); err != nil {
+		return err
+	}
+	if record[NODE_TYPE_BYTE] != NODE_TYPE_MESSAGE {
+		return errors.New("the record is not a message")
+	}
+	return nil
+}
+
+/* Reads the records of a log file from the given offset to the end of the file.
+ * Returns the records, the offset after the last valid record and, if the file ends with a record that is incomplete,
+ * corrupted or refused by validate, the reason in recordErr.
+ * A damaged record followed by valid records (another process appended after a crash) is skipped and reported :
+ * the records after it are still read.
+ */
+func readLogRecords(file *os.File, offset int64, validate func([]byte) error) (records [][]byte, end int64, recordErr error, err error) {
+	data, err := io.ReadAll(io.NewSectionReader(file, offset, math.MaxInt64-offset))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	position := 0
+	for position < len(data) {
+		record, err := decodeLogRecord(data[position:], validate)
+		if err != nil {
+			next := findLogRecord(data, position+1, validate)
+			if next < 0 {
+				return records, offset + int64(position), err, nil
+			}
+			log.Printf("THE LOG FILE %s IS DAMAGED AT OFFSET %d (%v) : %d BYTES SKIPPED \n", file.Name(), offset+int64(position), err, next-position)
+			position = next
+			continue
+		}
+
+		records = append(records, record)
+		position += LOG_RECORD_HEADER_LENGTH + len(record)
+	}
+	return records, offset + int64(position), nil, nil
+}
+
+/* Decodes the record at the start of data */
+func decodeLogRecord(data []byte, validate func([]byte) error) ([]byte, error) {
+	if len(data) < LOG_RECORD_HEADER_LENGTH {
+		return nil, errors.New("incomplete record header")
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	checksum := binary.BigEndian.Uint32(data[4:8])
+	if length == 0 || length > LOG_RECORD_MAX_LENGTH {
+		return nil, fmt.Errorf("invalid record length %d", length)
+	}
+	if uint32(len(data)-LOG_RECORD_HEADER_LENGTH) < length {
+		return nil, errors.New("incomplete record")
+	}
+
+	record := data[LOG_RECORD_HEADER_LENGTH : LOG_RECORD_HEADER_LENGTH+int(length)]
+	// validate is cheaper than the checksum : it goes first when we look for the next record after a damaged one
+	if err := validate(record); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(record) != checksum {
+		return nil, errors.New("bad checksum")
+	}
+	return bytes.Clone(record), nil
+}
+
+/* The position of the first valid record at or after from, or -1 */
+func findLogRecord(data []byte, from int, validate func([]byte) error) int {
+	for position := from; position+LOG_RECORD_HEADER_LENGTH < len(data); position++ {
+		if _, err := decodeLogRecord(data[position:], validate); err == nil {
+			return position
+		}
+	}
+	return -1
+}
+
+/* The damaged record at the end of the file is dropped : it is the record that was being written when the program stopped */
+func truncateDamagedLog(file *os.File, fileName string, offset int64, recordErr error) error {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	log.Printf("THE LOG FILE %s IS DAMAGED AT OFFSET %d (%v) : %d BYTES REMOVED \n", fileName, offset, recordErr, fileInfo.Size()-offset)
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func encodeLogRecord(data []byte) []byte {
+	record := make([]byte, LOG_RECORD_HEADER_LENGTH+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[LOG_RECORD_HEADER_LENGTH:], data)
+	return record
+}
+
+/* Reads the messages appended to the file by another process (the post command) since the last read.
+ * Returns the number of new messages. An incomplete record at the end may still be being written : it is read next time.
+ */
+func (store *PostStore) Refresh() (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.refresh()
+}
+
+func (store *PostStore) refresh() (int, error) {
+	posts, offset, _, err := readLogRecords(store.file, store.size, validatePostRecord)
+	if err != nil {
+		return 0, err
+	}
+	store.posts = append(store.posts, posts...)
+	store.size = offset
+	return len(posts), nil
+}
+
+/* Adds a message at the end of the log. When the function returns without error, the message is on the disk. */
+func (store *PostStore) Append(message []byte) error {
+	if err := validatePostRecord(message); err != nil {
+		return err
+	}
+	record := encodeLogRecord(message)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// Another process may have written to the file since we read it
+	if _, err := store.refresh(); err != nil {
+		return err
+	}
+
+	// The file is opened with O_APPEND : the record always goes to the end of the file, even if another process writes at the same time
+	n, err := store.file.Write(record)
+	if err == nil {
+		err = store.file.Sync()
+	}
+	if err != nil {
+		// We do not leave a partial record behind us
+		if n > 0 {
+			store.file.Truncate(store.size)
+		}
+		return err
+	}
+
+	_, err = store.refresh()
+	return err
+}
+
+/* A copy of the list of messages, in the order in which they were published */
+func (store *PostStore) Posts() [][]byte {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return append([][]byte{}, store.posts...)
+}
+
+func (store *PostStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.file.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* A log file written by a peer that stopped in the middle of a record, possibly with records appended after it by the post command */
+func TestOpenPostStoreDamaged(t *testing.T) {
+	messages := testMessages(4)
+	record := func(i int) []byte { return encodeLogRecord(messages[i]) }
+	badChecksum := func(i int) []byte {
+		damaged := record(i)
+		damaged[4] ^= 0xFF
+		return damaged
+	}
+
+	tests := []struct {
+		name     string
+		contents [][]byte
+		expected []int // The messages read
+		kept     bool  // The damaged bytes stay in the file, because valid records follow them
+	}{
+		{"no damage", [][]byte{record(0), record(1), record(2)}, []int{0, 1, 2}, true},
+		{"truncated header", [][]byte{record(0), record(1), record(2)[:5]}, []int{0, 1}, false},
+		{"truncated body", [][]byte{record(0), record(1), record(2)[:LOG_RECORD_HEADER_LENGTH+10]}, []int{0, 1}, false},
+		{"bad checksum at the end", [][]byte{record(0), record(1), badChecksum(2)}, []int{0, 1}, false},
+		{"bad checksum in the middle", [][]byte{record(0), badChecksum(1), record(2)}, []int{0, 2}, true},
+		{"truncated record in the middle", [][]byte{record(0), record(1)[:LOG_RECORD_HEADER_LENGTH+10], record(2)}, []int{0, 2}, true},
+		{"truncated header in the middle", [][]byte{record(0), record(1)[:5], record(2)}, []int{0, 2}, true},
+		{"invalid length in the middle", [][]byte{record(0), {0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0}, record(2)}, []int{0, 2}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "posts")
+			contents := bytes.Join(test.contents, nil)
+			if err := os.WriteFile(fileName, contents, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err := OpenPostStore(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPosts(t, store.Posts(), messages, test.expected)
+			fileInfo, err := os.Stat(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := fileInfo.Size() == int64(len(contents)); kept != test.kept {
+				t.Errorf("the file has %d bytes of %d, expected the damaged bytes kept : %v", fileInfo.Size(), len(contents), test.kept)
+			}
+
+			// After the recovery, a new message is read back after the others
+			if err := store.Append(messages[3]); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+			store, err = OpenPostStore(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			checkPosts(t, store.Posts(), messages, append(test.expected, 3))
+		})
+	}
+}
+
+/* The records written by the post command after a damaged record are read by the running peer */
+func TestPostStoreRefreshDamaged(t *testing.T) {
+	messages := testMessages(3)
+	fileName := filepath.Join(t.TempDir(), "posts")
+	store, err := OpenPostStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Append(messages[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	damaged := encodeLogRecord(messages[1])[:LOG_RECORD_HEADER_LENGTH+10]
+	if _, err := file.Write(damaged); err != nil {
+		t.Fatal(err)
+	}
+
+	// The record may still be being written : it is not read yet
+	if count, err := store.Refresh(); err != nil || count != 0 {
+		t.Fatalf("Refresh() = %d, %v, expected 0 new messages", count, err)
+	}
+
+	if _, err := file.Write(encodeLogRecord(messages[2])); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := store.Refresh(); err != nil || count != 1 {
+		t.Fatalf("Refresh() = %d, %v, expected the message after the damaged record", count, err)
+	}
+	checkPosts(t, store.Posts(), messages, []int{0, 2})
+}
+
+func checkPosts(t *testing.T, posts [][]byte, messages [][]byte, expected []int) {
+	t.Helper()
+	if len(posts) != len(expected) {
+		t.Fatalf("%d messages read, expected %d", len(posts), len(expected))
+	}
+	for i, index := range expected {
+		if !bytes.Equal(posts[i], messages[index]) {
+			t.Errorf("message %d is %q, expected message %d", i, posts[i], index)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+/* A message must fit in the 2 bytes of its Length field, and the leaf that contains it must fit in a single Datum datagram */
+const MESSAGE_BODY_MAX_LENGTH = min(0xFFFF, BUFFER_SIZE-BODY_FIRST_BYTE-HASH_LENGTH-MESSAGE_BODY_FIRST_BYTE-SIGNATURE_LENGTH-ENCRYPTION_OVERHEAD)
+
+/* ThisPeerMerkleTree is read by the goroutine that answers the other peers and replaced when we publish */
+var ThisPeerMerkleTreeMutex sync.RWMutex
+var thisPeerMerkleTreePosts = 0 // The number of messages of the post store that are in ThisPeerMerkleTree
+
+/* Appends a new message (a reply if inReplyTo is not nil) to the post store.
+ * Returns the hash of the message. The Merkle tree we publish is updated by RefreshThisPeerMerkleTree().
+ */
+func PublishMessage(store *PostStore, body string, inReplyTo []byte) ([]byte, error) {
+	if len(body) == 0 {
+		return nil, errors.New("the message is empty")
+	}
+	if len(body) > MESSAGE_BODY_MAX_LENGTH {
+		return nil, fmt.Errorf("the message has %d bytes, the maximum is %d", len(body), MESSAGE_BODY_MAX_LENGTH)
+	}
+	if !utf8.ValidString(body) {
+		return nil, errors.New("the message is not valid UTF-8")
+	}
+
+	if inReplyTo == nil {
+		inReplyTo = inReplyToZeroes()
+	} else if len(inReplyTo) != MESSAFE_IN_REPLY_TO_LENGTH {
+		return nil, fmt.Errorf("the hash of the message we reply to must have %d bytes", MESSAFE_IN_REPLY_TO_LENGTH)
+	}
+
+	message := CreateMessage(body, inReplyTo)
+	if err := store.Append(message); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(message)
+	return hash[:], nil
+}
+
+/* Adds to ThisPeerMerkleTree the messages that were added to the post store, by us or by the post command.
+ * Called before answering a RootRequest, so that the other peers always get our last root.
+ */
+func RefreshThisPeerMerkleTree() {
+	ThisPeerMerkleTreeMutex.Lock()
+	defer ThisPeerMerkleTreeMutex.Unlock()
+
+	if _, err := ThisPeerPostStore.Refresh(); err != nil {
+		log.Printf("The method Refresh() failed in RefreshThisPeerMerkleTree() : %v \n", err)
+	}
+
+	posts := ThisPeerPostStore.Posts()
+	if len(posts) == thisPeerMerkleTreePosts {
+		return
+	}
+
+	// Only the path from each new leaf to the root is hashed again
+	for _, message := range posts[thisPeerMerkleTreePosts:] {
+		ThisPeerMerkleTree.Append(message)
+	}
+	thisPeerMerkleTreePosts = len(posts)
+
+	if DEBUG_MODE {
+		fmt.Printf("NEW ROOT OF OUR MERKLE TREE : %x (%d messages) \n", ThisPeerMerkleTree.Root.Hash, len(posts))
+	}
+}
+
+/* Reads the hash of a message as typed by the user (64 hexadecimal digits) */
+func ParseMessageHash(hashString string) ([]byte, error) {
+	hash, err := hex.DecodeString(strings.TrimSpace(hashString))
+	if err != nil {
+		return nil, fmt.Errorf("the hash is not hexadecimal : %v", err)
+	}
+	if len(hash) != HASH_LENGTH {
+		return nil, fmt.Errorf("the hash must have %d bytes, not %d", HASH_LENGTH, len(hash))
+	}
+	return hash, nil
+}
+
+/* The post command : publishes a message without starting the peer.
+ * post [-reply-to HASH] body
+ * A running peer with the same post store serves the message at the next RootRequest.
+ */
+func RunPostCommand(args []string) {
+	flags := flag.NewFlagSet("post", flag.ExitOnError)
+	replyTo := flags.String("reply-to", "", "hash of the message we reply to")
+	flags.Parse(args)
+
+	body := strings.Join(flags.Args(), " ")
+
+	var inReplyTo []byte
+	if *replyTo != "" {
+		var err error
+		inReplyTo, err = ParseMessageHash(*replyTo)
+		if err != nil {
+			log.Fatalf("Invalid -reply-to : %v \n", err)
+		}
+	}
+
+	store, err := OpenPostStore(NAME_FILE_POSTS)
+	if err != nil {
+		log.Fatalf("The post store %s could not be opened : %v \n", NAME_FILE_POSTS, err)
+	}
+	hash, err := PublishMessage(store, body, inReplyTo)
+	store.Close()
+	if err != nil {
+		log.Fatalf("The message was not published : %v \n", err)
+	}
+	fmt.Printf("%x\n", hash)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPublishMessage(t *testing.T) {
+	parent := bytes.Repeat([]byte{1}, HASH_LENGTH)
+
+	tests := []struct {
+		name      string
+		body      string
+		inReplyTo []byte
+		valid     bool
+	}{
+		{"message", "hello", nil, true},
+		{"reply", "hello", parent, true},
+		{"maximum length", strings.Repeat("a", MESSAGE_BODY_MAX_LENGTH), nil, true},
+		{"maximum length reply", strings.Repeat("a", MESSAGE_BODY_MAX_LENGTH), parent, true},
+		{"one byte too long", strings.Repeat("a", MESSAGE_BODY_MAX_LENGTH+1), nil, false},
+		{"one character of two bytes too long", strings.Repeat("a", MESSAGE_BODY_MAX_LENGTH-1) + "é", nil, false},
+		{"empty", "", nil, false},
+		{"invalid UTF-8", "\xff", nil, false},
+		{"short hash of the parent", "hello", parent[:HASH_LENGTH-1], false},
+	}
+
+	store, err := OpenPostStore(filepath.Join(t.TempDir(), "posts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	privateKey := testPrivateKey(t)
+
+	for _, test := range tests {
+		count := len(store.Posts())
+		hash, err := PublishMessage(store, test.body, test.inReplyTo)
+		if (err == nil) != test.valid {
+			t.Errorf("%s : error %v, expected valid %v", test.name, err, test.valid)
+			continue
+		}
+		if !test.valid {
+			if len(store.Posts()) != count {
+				t.Errorf("%s : the message was appended to the post store", test.name)
+			}
+			continue
+		}
+
+		posts := store.Posts()
+		if len(posts) != count+1 {
+			t.Fatalf("%s : the message is not in the post store", test.name)
+		}
+		message, err := ParseMessage(posts[count])
+		if err != nil || string(message.Body) != test.body || message.IsReply() != (test.inReplyTo != nil) {
+			t.Errorf("%s : the post store has %+v (%v)", test.name, message, err)
+		}
+
+		// The leaf is served in a single encrypted Datum datagram
+		leaf := lastLeaf(CreateTree(posts[count:], 4))
+		if !bytes.Equal(leaf.Hash, hash) {
+			t.Errorf("%s : the hash %x is not the one of the leaf %x", test.name, hash, leaf.Hash)
+		}
+		if length := len(testDatumDatagram("abcd", leaf, privateKey)) + ENCRYPTION_OVERHEAD; length > BUFFER_SIZE {
+			t.Errorf("%s : the Datum datagram has %d bytes, more than %d", test.name, length, BUFFER_SIZE)
+		}
+	}
+}
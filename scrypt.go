@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+/* scrypt (RFC 7914), which stretches the passphrase of the keystore : the standard library only has PBKDF2.
+ * N is the cost in memory and time (128 * r * N bytes), r the size of a block, p the parallelization.
+ */
+
+/* The parameters come from the key file : they are bounded, so that a modified file cannot use all the memory or the time of the peer */
+const SCRYPT_MAX_N = 1 << 20
+const SCRYPT_MAX_MEMORY = 1 << 30 // 128 * r * N bytes : 1 GiB, 32 times the keystore of this peer
+const SCRYPT_MAX_WORK = 1 << 32   // p * 128 * r * N bytes mixed
+
+func ValidateScryptParameters(n, r, p int) error {
+	if n <= 1 || n&(n-1) != 0 || n > SCRYPT_MAX_N {
+		return fmt.Errorf("scrypt : N must be a power of 2 between 2 and %d", SCRYPT_MAX_N)
+	}
+	if r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 {
+		return errors.New("scrypt : r and p must be positive, and r * p less than 2^30")
+	}
+	memory := 128 * uint64(r) * uint64(n) // r < 2^30 and N <= 2^20 : no overflow
+	if memory > SCRYPT_MAX_MEMORY {
+		return fmt.Errorf("scrypt : N = %d and r = %d need %d MiB, more than %d MiB", n, r, memory>>20, SCRYPT_MAX_MEMORY>>20)
+	}
+	if memory > SCRYPT_MAX_WORK/uint64(p) {
+		return fmt.Errorf("scrypt : p = %d is too large for N = %d and r = %d", p, n, r)
+	}
+	return nil
+}
+
+func Scrypt(passphrase []byte, salt []byte, n, r, p, keyLength int) ([]byte, error) {
+	if err := ValidateScryptParameters(n, r, p); err != nil {
+		return nil, err
+	}
+
+	blockLength := 128 * r
+	b, err := pbkdf2.Key(sha256.New, string(passphrase), salt, 1, p*blockLength)
+	if err != nil {
+		return nil, err
+	}
+
+	x := make([]uint32, 32*r)
+	y := make([]uint32, 32*r)
+	v := make([]uint32, 32*r*n)
+	for i := 0; i < p; i++ {
+		block := b[i*blockLength : (i+1)*blockLength]
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(block[4*j:])
+		}
+		scryptROMix(x, y, v, n, r)
+		for j := range x {
+			binary.LittleEndian.PutUint32(block[4*j:], x[j])
+		}
+	}
+
+	return pbkdf2.Key(sha256.New, string(passphrase), b, 1, keyLength)
+}
+
+/* ROMix : the block x is mixed with N blocks it depends on, all kept in v */
+func scryptROMix(x, y, v []uint32, n, r int) {
+	words := 32 * r
+	for i := 0; i < n; i++ {
+		copy(v[i*words:], x)
+		scryptBlockMix(x, y, r)
+	}
+	for i := 0; i < n; i++ {
+		j := int(x[words-16] & uint32(n-1)) // Integerify : the first word of the last 64 bytes
+		for k := range x {
+			x[k] ^= v[j*words+k]
+		}
+		scryptBlockMix(x, y, r)
+	}
+}
+
+/* BlockMix : Salsa20/8 on each 64 bytes of the block, the even results first, then the odd ones. y is a buffer of the size of b. */
+func scryptBlockMix(b, y []uint32, r int) {
+	var x [16]uint32
+	copy(x[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for k := range x {
+			x[k] ^= b[i*16+k]
+		}
+		salsa208(&x)
+		position := (i/2)*16 + (i%2)*r*16
+		copy(y[position:], x[:])
+	}
+	copy(b, y)
+}
+
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
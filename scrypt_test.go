@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+/* The test vectors of RFC 7914, section 12 */
+func TestScryptVectors(t *testing.T) {
+	tests := []struct {
+		passphrase string
+		salt       string
+		n, r, p    int
+		expected   string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	}
+	for _, test := range tests {
+		expected, _ := hex.DecodeString(test.expected)
+		key, err := Scrypt([]byte(test.passphrase), []byte(test.salt), test.n, test.r, test.p, len(expected))
+		if err != nil {
+			t.Fatalf("N = %d r = %d p = %d : %v", test.n, test.r, test.p, err)
+		}
+		if !bytes.Equal(key, expected) {
+			t.Errorf("N = %d r = %d p = %d : %x, expected %x", test.n, test.r, test.p, key, expected)
+		}
+	}
+}
+
+func TestValidateScryptParameters(t *testing.T) {
+	tests := []struct {
+		n, r, p int
+		valid   bool
+	}{
+		{KEYSTORE_SCRYPT_N, KEYSTORE_SCRYPT_R, KEYSTORE_SCRYPT_P, true},
+		{SCRYPT_MAX_N, 8, 1, true},
+		{2, 1, 1, true},
+		{SCRYPT_MAX_N, 8, SCRYPT_MAX_WORK / SCRYPT_MAX_MEMORY, true},
+		{0, 8, 1, false},
+		{1, 8, 1, false},
+		{-1024, 8, 1, false},
+		{1000, 8, 1, false},
+		{SCRYPT_MAX_N * 2, 8, 1, false},
+		{1024, 0, 1, false},
+		{1024, -8, 1, false},
+		{1024, 8, 0, false},
+		{1024, 8, -1, false},
+		{2, 1 << 15, 1 << 15, false},
+		{2, 1 << 29, 1, false},
+		{SCRYPT_MAX_N, 16, 1, false},
+		{SCRYPT_MAX_N, 8, SCRYPT_MAX_WORK/SCRYPT_MAX_MEMORY + 1, false},
+		{1024, 1, 1 << 29, false},
+	}
+	for _, test := range tests {
+		err := ValidateScryptParameters(test.n, test.r, test.p)
+		if (err == nil) != test.valid {
+			t.Errorf("N = %d r = %d p = %d : error %v, valid %v expected", test.n, test.r, test.p, err, test.valid)
+		}
+		/* Scrypt() must refuse them too, before allocating anything */
+		if !test.valid {
+			if _, err := Scrypt([]byte("passphrase"), []byte("salt"), test.n, test.r, test.p, 32); err == nil {
+				t.Errorf("N = %d r = %d p = %d : accepted by Scrypt()", test.n, test.r, test.p)
+			}
+		}
+	}
+}
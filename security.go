@@ -1,129 +1,17 @@
 package main
 
 import (
-	"crypto/aes"
-	"io"
 	"errors"
-	"crypto/cipher"
 	"crypto/rand"
-	"encoding/pem"
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/x509"
-	"strings"
-	"bytes"
 	"math/big"
-	"io/fs"
-	"io/ioutil"
 	"encoding/base64"
 	"fmt"
 	"crypto/sha256"
 	"log"
 )
 
-func Encrypt(key []byte, plainText []byte) []byte {
-
-	//Create a new AES cipher using the key
-	block, err := aes.NewCipher(key)
-
-	//IF NewCipher failed, exit:
-	if err != nil {
-		panic(err)
-	}
-
-	//Make the cipher text a byte array of size BlockSize + the length of the message
-	cipherText := make([]byte, aes.BlockSize+len(plainText))
-
-	//iv is the ciphertext up to the blocksize (16)
-	iv := cipherText[:aes.BlockSize]
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-		panic(err)
-	}
-
-	//Encrypt the data:
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], plainText)
-
-	//Return string encoded in base64
-	return cipherText
-}
-
-func Decrypt(key []byte, cipherText []byte) []byte {
-	//Create a new AES cipher with the key and encrypted message
-	block, err := aes.NewCipher(key)
-
-	//IF NewCipher failed, exit:
-	if err != nil {
-		panic(err)
-	}
-
-	//IF the length of the cipherText is less than 16 Bytes:
-	if len(cipherText) < aes.BlockSize {
-		err := errors.New("Ciphertext block size is too short!")
-		panic(err)
-	}
-
-	iv := cipherText[:aes.BlockSize]
-	cipherText = cipherText[aes.BlockSize:]
-
-	//Decrypt the message
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(cipherText, cipherText)
-
-	return cipherText // cipherText == plainText
-}
-
-func CreateOrFindPrivateKey(fileInfo fs.FileInfo, err error) *ecdsa.PrivateKey {
-	keyForFile := []byte("asuperstrong32bitpasswordgohere!") //32 bit key for AES-256
-
-	if err != nil || fileInfo.Size() == 0 {
-
-		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		privateKeyDr, err := x509.MarshalECPrivateKey(privateKey)
-		if err != nil {
-			panic(err)
-		}
-		privPEM := pem.EncodeToMemory(
-			&pem.Block{
-				Type:  "EC PRIVATE KEY",
-				Bytes: privateKeyDr,
-			},
-		)
-
-		cipherPrivPEM := Encrypt(keyForFile,privPEM)
-
-		err = ioutil.WriteFile(NAME_FILE_PRIVATE_KEY, cipherPrivPEM, 0644)
-		if err != nil {
-			panic(err)
-		}
-
-	}
-
-	cipherData, err := ioutil.ReadFile(NAME_FILE_PRIVATE_KEY)
-	if err != nil {
-		panic(err)
-	}
-
-	plainData := Decrypt(keyForFile, cipherData)
-
-	lines := strings.Split(string(plainData), "\n")
-	lines = lines[1 : len(lines)-2]
-
-	privateKeyString := strings.Join(lines, "")
-
-	if DEBUG_MODE {
-		fmt.Printf("privateKeyString : %v\n", privateKeyString)
-	}
-
-	// Create the private key
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), bytes.NewReader([]byte(privateKeyString)))
-	if err != nil {
-		panic(err)
-	}
-
-	return privateKey
-}
-
 func CreatePublicKeyEncoded(privateKey *ecdsa.PrivateKey) string {
 
 	publicKey, _ := privateKey.Public().(*ecdsa.PublicKey)
@@ -139,25 +27,51 @@ func CreatePublicKeyEncoded(privateKey *ecdsa.PrivateKey) string {
 	return publicKeyEncoded
 }
 
-func ConvertBytesToEcdsaPublicKey(keyBytes []byte) *ecdsa.PublicKey {
+/* The keys we receive (from the server or from other peers) are the 64 bytes of the coordinates X and Y of a point of P-256.
+ * Anything else is rejected, so that the key can be used safely afterwards.
+ */
+func ConvertBytesToEcdsaPublicKey(keyBytes []byte) (*ecdsa.PublicKey, error) {
+	if len(keyBytes) != 64 {
+		return nil, fmt.Errorf("a public key must have 64 bytes, not %d", len(keyBytes))
+	}
+
 	var x, y big.Int
 	x.SetBytes(keyBytes[:32])
 	y.SetBytes(keyBytes[32:])
 	publicKey := &ecdsa.PublicKey{
 		Curve: elliptic.P256(),
-		X: &x,
-		Y: &y,
+		X:     &x,
+		Y:     &y,
 	}
-	return publicKey
+
+	if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+		return nil, errors.New("the public key is not a point of the curve P-256")
+	}
+	return publicKey, nil
+}
+
+/* A key given by the server : base64 of the 64 bytes */
+func DecodePublicKey(key string) (*ecdsa.PublicKey, error) {
+	keyBytes, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	return ConvertBytesToEcdsaPublicKey(keyBytes)
 }
 
 func VerifySignature(buf []byte, publicKey *ecdsa.PublicKey) bool {
-	length := int((buf[5] << 8) + buf[6])
-	signature := buf[BODY_FIRST_BYTE+length:BODY_FIRST_BYTE+length+SIGNATURE_LENGTH]
+	datagram, err := ParseDatagram(buf)
+	if err != nil || datagram.Header().Signature == nil {
+		if DEBUG_MODE {
+			fmt.Printf("Signature verified : false (no valid signature in the datagram)\n")
+		}
+		return false
+	}
+	signature := datagram.Header().Signature
 	var r, s big.Int
 	r.SetBytes(signature[:32])
 	s.SetBytes(signature[32:])
-	hashed := sha256.Sum256(buf[:BODY_FIRST_BYTE+length])
+	hashed := sha256.Sum256(datagram.Header().Signed)
 	ok := ecdsa.Verify(publicKey, hashed[:], &r, &s)
 	if DEBUG_MODE {
 		fmt.Printf("Signature verified : %v\n",ok)
@@ -169,7 +83,7 @@ func CreateSignature(datagram []byte, datagramLength int, privateKey *ecdsa.Priv
 	hashed := sha256.Sum256(datagram[:datagramLength-SIGNATURE_LENGTH])
 	r, s, errorMessage := ecdsa.Sign(rand.Reader, privateKey, hashed[:])
 	if errorMessage != nil {
-		log.Fatalf("The method ecdsa.Sign() failed In the phase of building a datagram of type %d : %v \n", ROOT_REQUEST_TYPE, errorMessage)
+		log.Fatalf("The method ecdsa.Sign() failed In the phase of building a datagram of type %d : %v \n", datagram[TYPE_BYTE], errorMessage)
 	}
 	signature := make([]byte, SIGNATURE_LENGTH)
 	r.FillBytes(signature[:32])
@@ -177,39 +91,10 @@ func CreateSignature(datagram []byte, datagramLength int, privateKey *ecdsa.Priv
 
 	copy(datagram[datagramLength-SIGNATURE_LENGTH:], signature ) //signature
 
-	myPublicKeyBytes, err := base64.RawStdEncoding.DecodeString(MyPublicKeyEncoded)
-	if err != nil {
-		panic(err)
-	}
-	ok := VerifySignature(datagram, ConvertBytesToEcdsaPublicKey(myPublicKeyBytes) )
+	ok := VerifySignature(datagram, &privateKey.PublicKey)
 	if !ok {
-		panic(err)
+		log.Fatalf("The signature of the datagram of type %d we just built is not valid \n", datagram[TYPE_BYTE])
 	}
 
 	return datagram
 }
-
-func CreatePrivateKeyForEncryption() *ecdsa.PrivateKey{
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		panic(err)
-	}
-	return privateKey
-}
-
-func GeneratePublicEncodedKeyForEncryption(privateKey *ecdsa.PrivateKey) string {
-	publicKey := privateKey.PublicKey
-	publicKey64Bytes := make([]byte, 64)
-	publicKey.X.FillBytes(publicKey64Bytes[:32])
-	publicKey.Y.FillBytes(publicKey64Bytes[32:])
-	publicKeyEncoded := base64.RawStdEncoding.EncodeToString(publicKey64Bytes)
-	return publicKeyEncoded
-}
-
-func GenerateSharedKey(publicKeyForEncryptionFromPeer ecdsa.PublicKey, myPrivateKeyForEncryption *ecdsa.PrivateKey) []byte {
-	sharedKey, err := publicKeyForEncryptionFromPeer.Curve.ScalarMult(publicKeyForEncryptionFromPeer.X, publicKeyForEncryptionFromPeer.Y, myPrivateKeyForEncryption.D.Bytes())
-	if err != nil {
-		panic(err)
-	}
-	return sharedKey.Bytes()
-}
\ No newline at end of file
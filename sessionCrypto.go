@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+/* The encryption of the sessions (extension EXTENSION_ENCRYPTION).
+ * After the HelloReply, the peer that sent the Hello (the initiator) sends a SendKeyHello with an ephemeral X25519 public key,
+ * and the other peer (the responder) answers with a SendKeyHelloReply with its own. Both datagrams are signed with the keys of the peers.
+ * The two peers compute the X25519 shared secret and derive with HKDF-SHA256 two AES-256-GCM keys, one per direction.
+ * The salt of HKDF is the SHA-256 of the transcript of the exchange (its Id and the two public keys) : the keys are bound to this exchange.
+ *
+ * An encrypted datagram keeps its Id, Type and Length in the clear, they are the associated data of AES-GCM :
+ *  Id | Type | Length | Counter (8 bytes) | AES-GCM(Body | Signature) (16 bytes longer)
+ * The Length is the one of the body in the clear. The nonce is made of the counter of the direction, which starts at 1
+ * and is never reused with the same key : each attempt of a request is encrypted again. A counter we already received is rejected.
+ *
+ * Once a session has keys, only the datagrams of the handshake (Hello, HelloReply, SendKeyHello, SendKeyHelloReply) may be in the clear,
+ * and the "No handshake" Error of a peer that cannot decrypt our datagrams, if it is signed with the key of the peer.
+ * A replayed datagram, or one that does not decrypt with the keys of the session, is dropped without an answer.
+ * The keys are shared by the two directions of the session (the one we opened and the one the peer opened) :
+ * a Hello does not drop them, they are replaced at the end of each new exchange, which each Handshake() starts.
+ */
+
+const ENCRYPTION_COUNTER_LENGTH = 8
+const ENCRYPTION_TAG_LENGTH = 16
+const ENCRYPTION_OVERHEAD = ENCRYPTION_COUNTER_LENGTH + ENCRYPTION_TAG_LENGTH
+const ENCRYPTION_KEY_LENGTH = 32    // AES-256
+const ENCRYPTION_REPLAY_WINDOW = 64 // The number of counters below the highest one we received that are still accepted (once), for the datagrams received out of order
+const ENCRYPTION_HKDF_INFO = "microblog session keys v1"
+
+var ErrNoSessionKeys = errors.New("the datagram is encrypted but we do not share keys with this peer")
+var ErrUnencryptedDatagram = errors.New("the session is encrypted but the datagram is not")
+var ErrReplayedDatagram = errors.New("the counter of the datagram was already received")
+var ErrForgedDatagram = errors.New("the datagram was not encrypted with the keys of the session")
+
+/* The exchange of keys in progress (or done) in a session */
+type keyExchange struct {
+	Id            []byte // The Id of the SendKeyHello
+	Initiator     bool
+	PrivateKey    *ecdh.PrivateKey
+	PeerPublicKey []byte // nil while we wait for the SendKeyHelloReply
+}
+
+/* The counters we received recently : the highest one, and a bit for each of the ENCRYPTION_REPLAY_WINDOW counters below it */
+type replayWindow struct {
+	Highest uint64
+	Bitmap  uint64
+}
+
+func (window *replayWindow) Accepts(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > window.Highest {
+		return true
+	}
+	if window.Highest-counter >= ENCRYPTION_REPLAY_WINDOW {
+		return false
+	}
+	return window.Bitmap&(1<<(window.Highest-counter)) == 0
+}
+
+func (window *replayWindow) Add(counter uint64) {
+	if counter > window.Highest {
+		if counter-window.Highest >= ENCRYPTION_REPLAY_WINDOW {
+			window.Bitmap = 0
+		} else {
+			window.Bitmap <<= counter - window.Highest
+		}
+		window.Bitmap |= 1
+		window.Highest = counter
+		return
+	}
+	window.Bitmap |= 1 << (window.Highest - counter)
+}
+
+/* The datagrams that are never encrypted : they open the session and exchange the keys */
+func isHandshakeDatagramType(datagramType int) bool {
+	return datagramType == HELLO_TYPE || datagramType == HELLO_REPLY_TYPE || datagramType == SEND_KEY_HELLO_TYPE || datagramType == SEND_KEY_HELLO_REPLY_TYPE
+}
+
+/* The Error a peer sends in the clear when it cannot decrypt our datagrams (it lost our keys) : we must do the handshake again */
+func isNoHandshakeErrorDatagram(buf []byte) bool {
+	return buf[TYPE_BYTE] == ERROR_TYPE && bytes.HasPrefix(buf[BODY_FIRST_BYTE:], []byte(NO_HANDSHAKE_ERROR_PREFIX))
+}
+
+/* The "No handshake" Error in the clear ends the encryption of the session : it must be signed by the key of the peer */
+func (session *Session) signedByPeer(buf []byte) bool {
+	if session.PeerKey == "" {
+		return false
+	}
+	publicKey, err := DecodePublicKey(session.PeerKey)
+	return err == nil && VerifySignature(buf, publicKey)
+}
+
+/* A datagram in the clear has nothing or a signature after its body, an encrypted one has 24 more bytes */
+func isEncryptedDatagram(buf []byte) bool {
+	if len(buf) < DATAGRAM_MIN_LENGTH {
+		return false
+	}
+	extra := len(buf) - DATAGRAM_MIN_LENGTH - int(binary.BigEndian.Uint16(buf[LENGTH_FIRST_BYTE:LENGTH_FIRST_BYTE+2]))
+	return extra == ENCRYPTION_OVERHEAD || extra == ENCRYPTION_OVERHEAD+SIGNATURE_LENGTH
+}
+
+/* Called with the mutex of the SessionManager locked */
+func (session *Session) resetEncryption() {
+	session.keyExchange = nil
+	session.sendCipher = nil
+	session.receiveCipher = nil
+	session.sendCounter = 0
+	session.receiveWindow = replayWindow{}
+}
+
+func (session *Session) Encrypted() bool {
+	return session.sendCipher != nil
+}
+
+/* Derives the keys of the two directions from the exchange. Called with the mutex of the SessionManager locked. */
+func (session *Session) completeKeyExchange(peerPublicKeyBytes []byte) error {
+	exchange := session.keyExchange
+	peerPublicKey, err := ecdh.X25519().NewPublicKey(peerPublicKeyBytes)
+	if err != nil {
+		return err
+	}
+	secret, err := exchange.PrivateKey.ECDH(peerPublicKey)
+	if err != nil {
+		return err
+	}
+
+	initiatorPublicKey, responderPublicKey := exchange.PrivateKey.PublicKey().Bytes(), peerPublicKeyBytes
+	if !exchange.Initiator {
+		initiatorPublicKey, responderPublicKey = responderPublicKey, initiatorPublicKey
+	}
+	transcript := sha256.New()
+	transcript.Write(exchange.Id)
+	transcript.Write(initiatorPublicKey)
+	transcript.Write(responderPublicKey)
+
+	keys, err := hkdf.Key(sha256.New, secret, transcript.Sum(nil), ENCRYPTION_HKDF_INFO, 2*ENCRYPTION_KEY_LENGTH)
+	if err != nil {
+		return err
+	}
+	initiatorToResponder, err := newSessionCipher(keys[:ENCRYPTION_KEY_LENGTH])
+	if err != nil {
+		return err
+	}
+	responderToInitiator, err := newSessionCipher(keys[ENCRYPTION_KEY_LENGTH:])
+	if err != nil {
+		return err
+	}
+
+	exchange.PeerPublicKey = peerPublicKeyBytes
+	session.sendCipher, session.receiveCipher = initiatorToResponder, responderToInitiator
+	if !exchange.Initiator {
+		session.sendCipher, session.receiveCipher = responderToInitiator, initiatorToResponder
+	}
+	session.sendCounter = 0
+	session.receiveWindow = replayWindow{}
+	return nil
+}
+
+func newSessionCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/* Answers a SendKeyHello of the peer : returns our public key for the SendKeyHelloReply.
+ * If both peers started an exchange at the same time, the exchange with the smallest public key of initiator wins on both sides.
+ * Called with the mutex of the SessionManager locked.
+ */
+func (session *Session) answerKeyExchange(id []byte, peerPublicKey []byte) ([]byte, error) {
+	exchange := session.keyExchange
+	if exchange != nil && !exchange.Initiator && bytes.Equal(exchange.Id, id) && bytes.Equal(exchange.PeerPublicKey, peerPublicKey) {
+		// The peer did not get our SendKeyHelloReply and sent its SendKeyHello again : the keys do not change
+		return exchange.PrivateKey.PublicKey().Bytes(), nil
+	}
+	if exchange != nil && exchange.Initiator && exchange.PeerPublicKey == nil && bytes.Compare(exchange.PrivateKey.PublicKey().Bytes(), peerPublicKey) < 0 {
+		return nil, errors.New("we started an exchange of keys at the same time, ours is used")
+	}
+
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	previous := *session
+	session.resetEncryption()
+	session.keyExchange = &keyExchange{Id: append([]byte{}, id...), Initiator: false, PrivateKey: privateKey}
+	if err := session.completeKeyExchange(peerPublicKey); err != nil {
+		*session = previous
+		return nil, err
+	}
+	return privateKey.PublicKey().Bytes(), nil
+}
+
+/* Starts the exchange of keys with the peer, as initiator, and waits for its end. Called after the HelloReply, not from UdpRead(). */
+func StartKeyExchange(conn net.PacketConn, address *net.UDPAddr, privateKey *ecdsa.PrivateKey) error {
+	exchangePrivateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	id := NewDatagramId()
+	// The keys of the session are used until the new ones are derived : the peer may still send datagrams encrypted with them
+	if !sessionManager.Update(address, func(session *Session) {
+		session.keyExchange = &keyExchange{Id: []byte(id), Initiator: true, PrivateKey: exchangePrivateKey}
+	}) {
+		return errors.New("no session with the peer")
+	}
+
+	response, err := UdpWrite(conn, id, SEND_KEY_HELLO_TYPE, address, exchangePrivateKey.PublicKey().Bytes(), privateKey)
+	if err != nil {
+		return err
+	}
+	reply, ok := response.(*ParsedSendKeyReply)
+	if !ok {
+		return fmt.Errorf("unexpected answer of type %d to our SendKeyHello", response.Header().Type)
+	}
+
+	err = errors.New("the exchange of keys was replaced by another one")
+	sessionManager.Update(address, func(session *Session) {
+		if session.keyExchange != nil && session.keyExchange.Initiator && bytes.Equal(session.keyExchange.Id, []byte(id)) {
+			err = session.completeKeyExchange(reply.Key)
+		}
+	})
+	return err
+}
+
+/* Encrypts the datagram if we share keys with the peer that uses this address (the datagrams of the handshake stay in the clear) */
+func (manager *SessionManager) EncryptDatagram(address *net.UDPAddr, datagram []byte) ([]byte, error) {
+	if len(datagram) < DATAGRAM_MIN_LENGTH || isHandshakeDatagramType(int(datagram[TYPE_BYTE])) {
+		return datagram, nil
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session, found := manager.byAddress[address.String()]
+	if !found || session.sendCipher == nil {
+		return datagram, nil
+	}
+
+	session.sendCounter++
+	encrypted := make([]byte, BODY_FIRST_BYTE+ENCRYPTION_COUNTER_LENGTH, len(datagram)+ENCRYPTION_OVERHEAD)
+	copy(encrypted, datagram[:BODY_FIRST_BYTE])
+	binary.BigEndian.PutUint64(encrypted[BODY_FIRST_BYTE:], session.sendCounter)
+	return session.sendCipher.Seal(encrypted, sessionNonce(session.sendCounter), datagram[BODY_FIRST_BYTE:], datagram[:BODY_FIRST_BYTE]), nil
+}
+
+/* Returns the datagram in the clear. An error if it cannot be decrypted, if it was already received,
+ * or if it is in the clear in an encrypted session (except for the datagrams of the handshake).
+ */
+func (manager *SessionManager) DecryptDatagram(address *net.UDPAddr, buf []byte) ([]byte, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session, found := manager.byAddress[address.String()]
+	if !isEncryptedDatagram(buf) {
+		if found && session.receiveCipher != nil && len(buf) >= DATAGRAM_MIN_LENGTH && !isHandshakeDatagramType(int(buf[TYPE_BYTE])) &&
+			!(isNoHandshakeErrorDatagram(buf) && session.signedByPeer(buf)) {
+			return nil, ErrUnencryptedDatagram
+		}
+		return buf, nil
+	}
+	if !found || session.receiveCipher == nil {
+		return nil, ErrNoSessionKeys
+	}
+
+	counter := binary.BigEndian.Uint64(buf[BODY_FIRST_BYTE : BODY_FIRST_BYTE+ENCRYPTION_COUNTER_LENGTH])
+	if !session.receiveWindow.Accepts(counter) {
+		return nil, ErrReplayedDatagram
+	}
+	datagram := append([]byte{}, buf[:BODY_FIRST_BYTE]...)
+	datagram, err := session.receiveCipher.Open(datagram, sessionNonce(counter), buf[BODY_FIRST_BYTE+ENCRYPTION_COUNTER_LENGTH:], buf[:BODY_FIRST_BYTE])
+	if err != nil {
+		return nil, fmt.Errorf("%w : %v", ErrForgedDatagram, err)
+	}
+	session.receiveWindow.Add(counter)
+	return datagram, nil
+}
+
+func sessionNonce(counter uint64) []byte {
+	nonce := make([]byte, 12) // The nonce size of AES-GCM
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
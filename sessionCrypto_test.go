@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+)
+
+/* Two session managers, a (the initiator) and b, that exchanged keys. addressA is the address of a as b sees it, and conversely. */
+func encryptedSessionPair(t *testing.T) (a *SessionManager, b *SessionManager, addressA *net.UDPAddr, addressB *net.UDPAddr) {
+	t.Helper()
+	a, b = NewSessionManager(), NewSessionManager()
+	addressA = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+	addressB = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10002}
+
+	b.Accept("keyA", EXTENSION_ENCRYPTION, addressA)
+	a.Open("keyB", "B", EXTENSION_ENCRYPTION, addressB)
+	exchangeKeys(t, a, b, addressA, addressB, "abcd")
+	return a, b, addressA, addressB
+}
+
+/* a sends a SendKeyHello to b and gets its SendKeyHelloReply */
+func exchangeKeys(t *testing.T, a *SessionManager, b *SessionManager, addressA *net.UDPAddr, addressB *net.UDPAddr, id string) {
+	t.Helper()
+	exchangePrivateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Update(addressB, func(session *Session) {
+		session.keyExchange = &keyExchange{Id: []byte(id), Initiator: true, PrivateKey: exchangePrivateKey}
+	})
+
+	var reply []byte
+	b.Update(addressA, func(session *Session) {
+		reply, err = session.answerKeyExchange([]byte(id), exchangePrivateKey.PublicKey().Bytes())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Update(addressB, func(session *Session) {
+		err = session.completeKeyExchange(reply)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPrivateKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privateKey
+}
+
+func testDatagram(t *testing.T) []byte {
+	t.Helper()
+	return GetDatumDatagram("abcd", bytes.Repeat([]byte{1}, HASH_LENGTH), testPrivateKey(t))
+}
+
+func TestSessionEncryption(t *testing.T) {
+	a, b, addressA, addressB := encryptedSessionPair(t)
+	datagram := testDatagram(t)
+
+	encrypted, err := a.EncryptDatagram(addressB, datagram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedDatagram(encrypted) || !bytes.Equal(encrypted[:BODY_FIRST_BYTE], datagram[:BODY_FIRST_BYTE]) {
+		t.Fatal("the datagram is not encrypted with its header in the clear")
+	}
+	decrypted, err := b.DecryptDatagram(addressA, encrypted)
+	if err != nil || !bytes.Equal(decrypted, datagram) {
+		t.Fatalf("the datagram is not decrypted : %v", err)
+	}
+
+	// In the other direction
+	encrypted, _ = b.EncryptDatagram(addressA, datagram)
+	if decrypted, err := a.DecryptDatagram(addressB, encrypted); err != nil || !bytes.Equal(decrypted, datagram) {
+		t.Fatalf("the answer is not decrypted : %v", err)
+	}
+}
+
+func TestSessionDecryptionFailures(t *testing.T) {
+	a, b, addressA, addressB := encryptedSessionPair(t)
+	datagram := testDatagram(t)
+	encrypted, _ := a.EncryptDatagram(addressB, datagram)
+
+	modify := func(modification func(buf []byte)) []byte {
+		buf := append([]byte{}, encrypted...)
+		modification(buf)
+		return buf
+	}
+	unknownAddress := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10003}
+	// The "No handshake" Error in the clear must be signed by the key of the peer
+	peerPrivateKey := testPrivateKey(t)
+	b.Update(addressA, func(session *Session) { session.PeerKey = CreatePublicKeyEncoded(peerPrivateKey) })
+	noHandshakeError := ErrorDatagram("abcd", []byte(NO_HANDSHAKE_ERROR_MESSAGE), peerPrivateKey)
+	otherKeyError := ErrorDatagram("abcd", []byte(NO_HANDSHAKE_ERROR_MESSAGE), testPrivateKey(t))
+	unsignedError := append([]byte{}, noHandshakeError[:len(noHandshakeError)-SIGNATURE_LENGTH]...)
+
+	tests := []struct {
+		name     string
+		address  *net.UDPAddr
+		buf      []byte
+		expected error // nil : any error
+		accepted bool
+	}{
+		{"modified type", addressA, modify(func(buf []byte) { buf[TYPE_BYTE] = ROOT_REQUEST_TYPE }), ErrForgedDatagram, false},
+		{"modified body", addressA, modify(func(buf []byte) { buf[len(buf)-1] ^= 1 }), ErrForgedDatagram, false},
+		{"valid", addressA, encrypted, nil, true},
+		{"replayed", addressA, encrypted, ErrReplayedDatagram, false},
+		{"counter zero", addressA, modify(func(buf []byte) { copy(buf[BODY_FIRST_BYTE:], make([]byte, ENCRYPTION_COUNTER_LENGTH)) }), ErrReplayedDatagram, false},
+		{"no session", unknownAddress, encrypted, ErrNoSessionKeys, false},
+		{"in the clear", addressA, datagram, ErrUnencryptedDatagram, false},
+		{"no handshake error in the clear", addressA, noHandshakeError, nil, true},
+		{"no handshake error signed by another key", addressA, otherKeyError, ErrUnencryptedDatagram, false},
+		{"unsigned no handshake error", addressA, unsignedError, ErrUnencryptedDatagram, false},
+	}
+	for _, test := range tests {
+		_, err := b.DecryptDatagram(test.address, test.buf)
+		if test.accepted != (err == nil) || (test.expected != nil && !errors.Is(err, test.expected)) {
+			t.Errorf("%s : error %v, expected accepted %v (%v)", test.name, err, test.accepted, test.expected)
+		}
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var window replayWindow
+	for _, counter := range []uint64{1, 3, 2, 100, 40, 37} {
+		if !window.Accepts(counter) {
+			t.Fatalf("the counter %d is refused", counter)
+		}
+		window.Add(counter)
+	}
+	for _, counter := range []uint64{0, 1, 3, 100, 40, 36} {
+		if window.Accepts(counter) {
+			t.Errorf("the counter %d is accepted again (or is too old)", counter)
+		}
+	}
+	if !window.Accepts(99) || !window.Accepts(101) {
+		t.Error("a new counter in the window is refused")
+	}
+}
+
+/* A Hello of the peer (a keepalive) does not drop the keys of the session */
+func TestSessionKeysSurviveHello(t *testing.T) {
+	a, b, addressA, addressB := encryptedSessionPair(t)
+	b.Accept("keyA", EXTENSION_ENCRYPTION, addressA)
+
+	encrypted, _ := a.EncryptDatagram(addressB, testDatagram(t))
+	if _, err := b.DecryptDatagram(addressA, encrypted); err != nil {
+		t.Fatalf("the keys were dropped by the Hello : %v", err)
+	}
+
+	// A peer that no longer supports the encryption : the keys must no longer be used
+	b.Accept("keyA", 0, addressA)
+	if _, err := b.DecryptDatagram(addressA, encrypted); !errors.Is(err, ErrNoSessionKeys) {
+		t.Errorf("the keys are still used without the encryption extension : %v", err)
+	}
+}
+
+/* A new exchange replaces the keys on both sides */
+func TestSessionNewKeyExchange(t *testing.T) {
+	a, b, addressA, addressB := encryptedSessionPair(t)
+	oldEncrypted, _ := a.EncryptDatagram(addressB, testDatagram(t))
+
+	exchangeKeys(t, a, b, addressA, addressB, "efgh")
+	encrypted, _ := a.EncryptDatagram(addressB, testDatagram(t))
+	if _, err := b.DecryptDatagram(addressA, encrypted); err != nil {
+		t.Fatalf("the new keys are not shared : %v", err)
+	}
+	if _, err := b.DecryptDatagram(addressA, oldEncrypted); err == nil {
+		t.Error("a datagram encrypted with the old keys is accepted")
+	}
+}
+
+func TestSimultaneousKeyExchanges(t *testing.T) {
+	a, b, addressA, addressB := encryptedSessionPair(t)
+	privateKeyA, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	privateKeyB, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	a.Update(addressB, func(session *Session) {
+		session.keyExchange = &keyExchange{Id: []byte("aaaa"), Initiator: true, PrivateKey: privateKeyA}
+	})
+	b.Update(addressA, func(session *Session) {
+		session.keyExchange = &keyExchange{Id: []byte("bbbb"), Initiator: true, PrivateKey: privateKeyB}
+	})
+
+	// Each peer receives the SendKeyHello of the other : only the exchange of the smallest key is answered
+	var errA, errB error
+	a.Update(addressB, func(session *Session) {
+		_, errA = session.answerKeyExchange([]byte("bbbb"), privateKeyB.PublicKey().Bytes())
+	})
+	b.Update(addressA, func(session *Session) {
+		_, errB = session.answerKeyExchange([]byte("aaaa"), privateKeyA.PublicKey().Bytes())
+	})
+	if (errA == nil) == (errB == nil) {
+		t.Errorf("the two exchanges are answered the same way : %v, %v", errA, errB)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* The sessions with the other peers, one per peer. A peer is identified by its public key (as given by the server),
+ * so that the addresses it uses (IPv4 and IPv6 for example) share the same session.
+ * A peer whose key we do not know (the server, or a peer that does not sign its messages) is identified by its address.
+ *
+ * A session has two directions : the peer opened a session with us (it sent a Hello, we can answer its requests),
+ * and we opened a session with the peer (we sent a Hello and got a HelloReply, we can download its Merkle tree).
+ * All the fields are protected by the mutex of the SessionManager : the other goroutines get copies (Find, List),
+ * and change a session with Update.
+ */
+
+const SESSION_TIMEOUT = 55 * time.Minute            // A session is valid for an hour after the last Hello, we keep a margin
+const SESSION_KEEPALIVE_INTERVAL = 30 * time.Minute // We send a Hello again to the peers we opened a session with, well before they forget us
+const SESSION_KEEPALIVE_CHECK_INTERVAL = time.Minute
+
+/* The state of a session we opened */
+const SESSION_STATE_ALIVE = "alive"
+const SESSION_STATE_EXPIRED = "expired"
+const SESSION_STATE_HANDSHAKING = "handshaking"
+
+type Session struct {
+	Identity          string         // "key:<key>" or "address:<address>"
+	PeerKey           string         // The key of the peer (base64, as given by the server), or "" if we do not know it
+	Username          string         // The name the peer gave in its HelloReply
+	Addresses         []*net.UDPAddr // The addresses from which the peer did a handshake
+	LastHelloReceived time.Time      // The last Hello of the peer : it opened a session with us
+	LastHelloReply    time.Time      // The last HelloReply of the peer : we opened a session with it
+	LastDatagramTime  time.Time
+	Merkle            *MerkleTree // Protected by sessionTreesMutex, not by the mutex of the SessionManager
+	RootHash          []byte      // The last root hash the peer gave us. It may not be the root of Merkle yet.
+	PeerExtensions    Extensions  // The extensions the peer advertised in its last Hello or HelloReply
+	Extensions        Extensions  // The extensions both peers support : the optional datagrams and behaviours are only used for them
+
+	handshaking   bool         // We sent a Hello and are waiting for the HelloReply
+	keyExchange   *keyExchange // See sessionCrypto.go
+	sendCipher    cipher.AEAD  // nil while the session is not encrypted
+	receiveCipher cipher.AEAD
+	sendCounter   uint64
+	receiveWindow replayWindow
+}
+
+type SessionManager struct {
+	mutex     sync.Mutex
+	sessions  map[string]*Session // By identity
+	byAddress map[string]*Session // By address (UDPAddr.String())
+}
+
+var sessionManager = NewSessionManager()
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{sessions: make(map[string]*Session), byAddress: make(map[string]*Session)}
+}
+
+func sessionIdentity(peerKey string, address *net.UDPAddr) string {
+	if peerKey != "" {
+		return "key:" + peerKey
+	}
+	return "address:" + address.String()
+}
+
+/* We opened a session with the peer */
+func (session *Session) WeOpened() bool {
+	return !session.LastHelloReply.IsZero()
+}
+
+/* The state of the session we opened with the peer. A session we never opened is expired. */
+func (session *Session) State() string {
+	if session.handshaking {
+		return SESSION_STATE_HANDSHAKING
+	}
+	if session.WeOpened() && time.Since(session.LastHelloReply) < SESSION_TIMEOUT {
+		return SESSION_STATE_ALIVE
+	}
+	return SESSION_STATE_EXPIRED
+}
+
+/* The peer opened a session with us, less than SESSION_TIMEOUT ago */
+func (session *Session) Accepted() bool {
+	return !session.LastHelloReceived.IsZero() && time.Since(session.LastHelloReceived) < SESSION_TIMEOUT
+}
+
+/* The name of the peer for the user */
+func (session *Session) Name() string {
+	if session.Username != "" {
+		return session.Username
+	}
+	if len(session.Addresses) > 0 {
+		return session.Addresses[0].String()
+	}
+	return session.Identity
+}
+
+func (session *Session) HasAddress(address string) bool {
+	for _, sessionAddress := range session.Addresses {
+		if sessionAddress.String() == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (session *Session) copy() Session {
+	sessionCopy := *session
+	sessionCopy.Addresses = append([]*net.UDPAddr{}, session.Addresses...)
+	return sessionCopy
+}
+
+/* Returns the session of the peer (created if needed), after adding address to its addresses.
+ * An address belongs to one peer only : if another session had it, it is removed from that session.
+ * Called with the mutex locked.
+ */
+func (manager *SessionManager) sessionFor(peerKey string, address *net.UDPAddr) *Session {
+	previous := manager.byAddress[address.String()]
+
+	var session *Session
+	if peerKey == "" && previous != nil {
+		// We do not know who the peer is : it is the peer that used this address so far
+		session = previous
+	} else {
+		identity := sessionIdentity(peerKey, address)
+		session = manager.sessions[identity]
+		if session == nil && previous != nil && previous.PeerKey == "" {
+			// We now know the key of a peer we only knew by its address : the session (and its Merkle tree) is kept
+			delete(manager.sessions, previous.Identity)
+			previous.Identity = identity
+			previous.PeerKey = peerKey
+			session = previous
+		}
+		if session == nil {
+			session = &Session{Identity: identity, PeerKey: peerKey}
+		}
+		manager.sessions[identity] = session
+	}
+
+	if previous != nil && previous != session {
+		manager.removeAddress(previous, address.String())
+	}
+	if !session.HasAddress(address.String()) {
+		session.Addresses = append(session.Addresses, address)
+	}
+	manager.byAddress[address.String()] = session
+	return session
+}
+
+/* Called with the mutex locked. A session without address is removed. */
+func (manager *SessionManager) removeAddress(session *Session, address string) {
+	for i, sessionAddress := range session.Addresses {
+		if sessionAddress.String() == address {
+			session.Addresses = append(session.Addresses[:i], session.Addresses[i+1:]...)
+			break
+		}
+	}
+	if manager.byAddress[address] == session {
+		delete(manager.byAddress, address)
+	}
+	if len(session.Addresses) == 0 {
+		delete(manager.sessions, session.Identity)
+	}
+}
+
+/* Called with the mutex locked */
+func (manager *SessionManager) remove(session *Session) {
+	for _, address := range session.Addresses {
+		if manager.byAddress[address.String()] == session {
+			delete(manager.byAddress, address.String())
+		}
+	}
+	delete(manager.sessions, session.Identity)
+}
+
+/* The peer sent a Hello : it opened a session with us */
+func (manager *SessionManager) Accept(peerKey string, peerExtensions Extensions, address *net.UDPAddr) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session := manager.sessionFor(peerKey, address)
+	session.LastHelloReceived = time.Now()
+	session.LastDatagramTime = session.LastHelloReceived
+	// The keys are kept : a Hello may only be a keepalive, and the keys also protect the session we opened.
+	// They are replaced when the peer starts a new exchange of keys (answerKeyExchange), or dropped if it no longer supports the encryption.
+	session.negotiate(peerExtensions)
+}
+
+/* The peer answered our Hello : we opened a session with it */
+func (manager *SessionManager) Open(peerKey string, username string, peerExtensions Extensions, address *net.UDPAddr) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session := manager.sessionFor(peerKey, address)
+	session.Username = username
+	session.LastHelloReply = time.Now()
+	session.LastDatagramTime = session.LastHelloReply
+	session.negotiate(peerExtensions)
+}
+
+/* The last Hello or HelloReply gives the extensions of the peer (it may have been restarted with other ones) */
+func (session *Session) negotiate(peerExtensions Extensions) {
+	session.PeerExtensions = peerExtensions
+	session.Extensions = LOCAL_EXTENSIONS.Negotiate(peerExtensions)
+	if !session.Extensions.Has(EXTENSION_ENCRYPTION) {
+		// The keys of a previous encrypted session must no longer be used
+		session.resetEncryption()
+	}
+}
+
+/* A datagram of the session arrived */
+func (manager *SessionManager) Touch(address *net.UDPAddr) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if session, found := manager.byAddress[address.String()]; found {
+		session.LastDatagramTime = time.Now()
+	}
+}
+
+/* A copy of the session of the peer that uses this address */
+func (manager *SessionManager) Find(address *net.UDPAddr) (Session, bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session, found := manager.byAddress[address.String()]
+	if !found {
+		return Session{}, false
+	}
+	return session.copy(), true
+}
+
+/* We sent a Hello and wait for the HelloReply. The session is created for a peer we never talked to, so that its state is shown. */
+func (manager *SessionManager) SetHandshaking(address *net.UDPAddr, handshaking bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if handshaking {
+		manager.sessionFor("", address).handshaking = true
+	} else if session, found := manager.byAddress[address.String()]; found {
+		session.handshaking = false
+	}
+}
+
+/* Changes the session of the peer that uses this address. Returns false if there is no such session.
+ * The function is called with the mutex locked : it must not call the other methods of the SessionManager.
+ */
+func (manager *SessionManager) Update(address *net.UDPAddr, update func(session *Session)) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session, found := manager.byAddress[address.String()]
+	if !found {
+		return false
+	}
+	update(session)
+	return true
+}
+
+/* Copies of all the sessions, sorted by name */
+func (manager *SessionManager) List() []Session {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	sessions := make([]Session, 0, len(manager.sessions))
+	for _, session := range manager.sessions {
+		sessions = append(sessions, session.copy())
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Name() == sessions[j].Name() {
+			return sessions[i].Identity < sessions[j].Identity
+		}
+		return sessions[i].Name() < sessions[j].Name()
+	})
+	return sessions
+}
+
+/* Removes the sessions without a handshake (in either direction) for more than timeout, and returns them.
+ * The sessions with a Merkle tree are kept : the messages of the peer are still shown in the conversations and the timeline.
+ */
+func (manager *SessionManager) Expire(timeout time.Duration) []Session {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	var expired []Session
+	for _, session := range manager.sessions {
+		lastHandshake := session.LastHelloReceived
+		if session.LastHelloReply.After(lastHandshake) {
+			lastHandshake = session.LastHelloReply
+		}
+		if time.Since(lastHandshake) > timeout && session.Merkle == nil {
+			expired = append(expired, session.copy())
+			manager.remove(session)
+		}
+	}
+	return expired
+}
+
+/* Removes the session of the peer that uses this address (with all its addresses). Returns false if there is no such session. */
+func (manager *SessionManager) Close(address *net.UDPAddr) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session, found := manager.byAddress[address.String()]
+	if !found {
+		return false
+	}
+	manager.remove(session)
+	return true
+}
+
+/******************************************** HANDSHAKE AND KEEPALIVE ********************************************/
+
+/* Sends a Hello and waits for the HelloReply (UdpRead() updates the session), then exchanges the keys if both peers support the encryption.
+ * If the exchange of keys fails, the session is used in the clear.
+ */
+func Handshake(conn net.PacketConn, address *net.UDPAddr, privateKey *ecdsa.PrivateKey) error {
+	sessionManager.SetHandshaking(address, true)
+	defer sessionManager.SetHandshaking(address, false)
+
+	response, err := UdpWrite(conn, NewDatagramId(), HELLO_TYPE, address, nil, privateKey)
+	if err != nil {
+		return err
+	}
+	helloReply, ok := response.(*ParsedHelloReply)
+	if !ok {
+		return fmt.Errorf("unexpected answer of type %d to our Hello", response.Header().Type)
+	}
+
+	if LOCAL_EXTENSIONS.Negotiate(Extensions(helloReply.Flags)).Has(EXTENSION_ENCRYPTION) {
+		if err := StartKeyExchange(conn, address, privateKey); err != nil {
+			log.Printf("THE EXCHANGE OF KEYS WITH %s FAILED, THE SESSION IS NOT ENCRYPTED : %v \n", address.String(), err)
+		}
+	}
+	return nil
+}
+
+/* Until the program stops : sends a Hello to the peers of the sessions we opened before they forget us,
+ * and removes the sessions that expired in both directions.
+ * A session that expired anyway (the peer did not answer) is opened again when we need it.
+ */
+func RunSessionKeepalive(conn net.PacketConn, privateKey *ecdsa.PrivateKey) {
+	for {
+		time.Sleep(SESSION_KEEPALIVE_CHECK_INTERVAL)
+
+		for _, session := range sessionManager.List() {
+			if session.State() != SESSION_STATE_ALIVE || time.Since(session.LastHelloReply) < SESSION_KEEPALIVE_INTERVAL {
+				continue
+			}
+			var err error
+			for _, address := range session.Addresses {
+				if err = Handshake(conn, address, privateKey); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				log.Printf("KEEPALIVE OF THE SESSION WITH %s FAILED : %v \n", session.Name(), err)
+			} else if DEBUG_MODE {
+				log.Printf("KEEPALIVE OF THE SESSION WITH %s \n", session.Name())
+			}
+		}
+
+		for _, session := range sessionManager.Expire(SESSION_TIMEOUT) {
+			if DEBUG_MODE {
+				log.Printf("THE SESSION WITH %s EXPIRED \n", session.Name())
+			}
+		}
+	}
+}
+
+func PrintSessions() {
+	sessions := sessionManager.List()
+	if len(sessions) == 0 {
+		fmt.Println("No sessions.")
+		return
+	}
+	for _, session := range sessions {
+		fmt.Println()
+		fmt.Printf("%s : %s \n", session.Name(), session.State())
+		if session.WeOpened() {
+			fmt.Printf("  Opened by us, last HelloReply %v ago \n", time.Since(session.LastHelloReply).Round(time.Second))
+		}
+		if session.Accepted() {
+			fmt.Printf("  Opened by the peer, last Hello %v ago \n", time.Since(session.LastHelloReceived).Round(time.Second))
+		}
+		fmt.Printf("  Last datagram %v ago \n", time.Since(session.LastDatagramTime).Round(time.Second))
+		fmt.Printf("  Extensions : %v (advertised by the peer : %v) \n", session.Extensions, session.PeerExtensions)
+		if session.Encrypted() {
+			fmt.Printf("  Encrypted (AES-256-GCM), %d datagrams sent \n", session.sendCounter)
+		}
+		for _, address := range session.Addresses {
+			fmt.Printf("  Address : %s \n", address.String())
+		}
+		if session.Merkle != nil {
+			fmt.Printf("  Root : %x \n", session.RootHash)
+		}
+	}
+}
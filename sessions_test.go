@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionIdentity(t *testing.T) {
+	manager := NewSessionManager()
+	ipv4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+	ipv6 := &net.UDPAddr{IP: net.IPv6loopback, Port: 10001}
+
+	// A peer we only know by its address, then by its key : the session is kept
+	manager.Accept("", EXTENSION_ENCRYPTION, ipv4)
+	manager.Open("keyA", "A", EXTENSION_ENCRYPTION, ipv4)
+	manager.Accept("keyA", EXTENSION_ENCRYPTION, ipv6)
+
+	sessions := manager.List()
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions, expected 1", len(sessions))
+	}
+	session := sessions[0]
+	if session.Identity != "key:keyA" || len(session.Addresses) != 2 || !session.WeOpened() || !session.Accepted() {
+		t.Errorf("session : %+v", session)
+	}
+	if session.State() != SESSION_STATE_ALIVE {
+		t.Errorf("state %s, expected %s", session.State(), SESSION_STATE_ALIVE)
+	}
+
+	// The address is used by another peer now
+	manager.Accept("keyB", EXTENSION_ENCRYPTION, ipv6)
+	if found, _ := manager.Find(ipv6); found.PeerKey != "keyB" {
+		t.Errorf("the address %s belongs to %q, expected keyB", ipv6, found.PeerKey)
+	}
+	if found, _ := manager.Find(ipv4); len(found.Addresses) != 1 {
+		t.Errorf("the session of keyA has the addresses %v", found.Addresses)
+	}
+}
+
+/* The handshake with a peer we never talked to is shown */
+func TestSessionHandshaking(t *testing.T) {
+	manager := NewSessionManager()
+	address := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+
+	manager.SetHandshaking(address, true)
+	session, found := manager.Find(address)
+	if !found || session.State() != SESSION_STATE_HANDSHAKING {
+		t.Fatalf("state of a first handshake : found %v, %s", found, session.State())
+	}
+
+	manager.Open("keyA", "A", 0, address)
+	manager.SetHandshaking(address, false)
+	session, _ = manager.Find(address)
+	if session.State() != SESSION_STATE_ALIVE || session.PeerKey != "keyA" || len(manager.List()) != 1 {
+		t.Errorf("state after the handshake : %s, %+v", session.State(), session)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	manager := NewSessionManager()
+	ipv4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+	ipv6 := &net.UDPAddr{IP: net.IPv6loopback, Port: 10001}
+	manager.Open("keyA", "A", 0, ipv4)
+	manager.Open("keyA", "A", 0, ipv6)
+
+	if !manager.Close(ipv6) {
+		t.Fatal("the session was not found")
+	}
+	if _, found := manager.Find(ipv4); found {
+		t.Error("the other address of the peer still has a session")
+	}
+	if manager.Close(ipv4) {
+		t.Error("a closed session was closed again")
+	}
+}
+
+/* The name is given by the peer : two peers with the same name are two sessions, with their own tree */
+func TestSessionsWithTheSameName(t *testing.T) {
+	tests := []struct {
+		name           string
+		firstKey       string
+		secondKey      string
+		firstIdentity  string
+		secondIdentity string
+	}{
+		{"without keys", "", "", "address:127.0.0.1:10001", "address:127.0.0.1:10002"},
+		{"with keys", "keyA", "keyB", "key:keyA", "key:keyB"},
+	}
+	for _, test := range tests {
+		manager := NewSessionManager()
+		first := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+		second := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10002}
+		manager.Open(test.firstKey, "alice", 0, first)
+		manager.Open(test.secondKey, "alice", 0, second)
+		manager.Update(first, func(session *Session) { session.Merkle = CreateTree(testMessages(1), 4) })
+
+		if sessions := manager.List(); len(sessions) != 2 {
+			t.Fatalf("%s : %d sessions, expected 2", test.name, len(sessions))
+		}
+		firstSession, _ := manager.Find(first)
+		secondSession, _ := manager.Find(second)
+		if firstSession.Identity != test.firstIdentity || secondSession.Identity != test.secondIdentity {
+			t.Errorf("%s : the sessions are %s and %s", test.name, firstSession.Identity, secondSession.Identity)
+		}
+		if firstSession.Merkle == nil || secondSession.Merkle != nil || len(secondSession.Addresses) != 1 {
+			t.Errorf("%s : the tree of the first peer is in the session %+v", test.name, secondSession)
+		}
+	}
+}
+
+/* A session with a Merkle tree is kept after its timeout : the tree is the only copy of the messages we downloaded */
+func TestSessionExpire(t *testing.T) {
+	manager := NewSessionManager()
+	withTree := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+	withoutTree := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10002}
+	recent := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10003}
+	manager.Open("keyA", "A", 0, withTree)
+	manager.Accept("keyB", 0, withoutTree)
+	manager.Open("keyC", "C", 0, recent)
+
+	old := time.Now().Add(-2 * time.Hour)
+	manager.Update(withTree, func(session *Session) {
+		session.LastHelloReply = old
+		session.Merkle = CreateTree(testMessages(1), 4)
+	})
+	manager.Update(withoutTree, func(session *Session) { session.LastHelloReceived = old })
+
+	expired := manager.Expire(time.Hour)
+	if len(expired) != 1 || expired[0].PeerKey != "keyB" {
+		t.Errorf("%d sessions expired, expected the one of keyB", len(expired))
+	}
+	if session, found := manager.Find(withTree); !found || session.Merkle == nil {
+		t.Error("the session with a Merkle tree has expired")
+	}
+	if _, found := manager.Find(withoutTree); found {
+		t.Error("the session without a Merkle tree has not expired")
+	}
+	if _, found := manager.Find(recent); !found {
+		t.Error("a recent session has expired")
+	}
+}
+
+/* A closed session takes its tree with it : the next session with the peer starts without one */
+func TestSessionCloseDropsTheTree(t *testing.T) {
+	manager := NewSessionManager()
+	address := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+	manager.Open("keyA", "A", 0, address)
+	manager.Update(address, func(session *Session) { session.Merkle = CreateTree(testMessages(1), 4) })
+
+	if !manager.Close(address) {
+		t.Fatal("the session was not found")
+	}
+	manager.Open("keyA", "A", 0, address)
+	if session, _ := manager.Find(address); session.Merkle != nil {
+		t.Error("the tree of the closed session is kept")
+	}
+}
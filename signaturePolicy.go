@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* The signature policy : which datagrams must be signed, how we find the key of the sender, and what we do when the check fails.
+ * Every datagram we send is signed. For the datagrams we receive :
+ *  - a type in Required must carry a valid signature of its sender. By default : the handshake, the exchange of keys and the root.
+ *    The nodes (Datum) are checked anyway by their hashes, from the signed root.
+ *  - a type not in Required is accepted without a signature, but a signature that is present must be valid.
+ *    64 zero bytes (the place left for a signature by the first versions of this peer) are not a signature.
+ * The key of the sender is the key of the server for its addresses, the key the server gave for a peer at this address,
+ * or the key of the session at this address. For a sender we do not know (UnknownSender) :
+ *  - lookup : for a Hello or a HelloReply, the key of its username is asked to the server (and checked against its pin),
+ *    the other datagrams fail if they must be signed
+ *  - accept : the datagram is used without checking its signature (like the first versions)
+ *  - reject : the datagram fails if it must be signed
+ * When the check fails (OnFailure) :
+ *  - drop : the datagram is counted and dropped
+ *  - error : in addition, a request gets an Error datagram
+ *  - blocklist : in addition, all the datagrams of the address are dropped for SIGNATURE_BLOCKLIST_DURATION.
+ *    The source address of a UDP datagram can be forged : an address is only blocked for a datagram encrypted with the keys
+ *    of the session at this address, which only the peer of the session can send. The addresses of the server are never blocked.
+ */
+
+const UNKNOWN_SENDER_LOOKUP = "lookup"
+const UNKNOWN_SENDER_ACCEPT = "accept"
+const UNKNOWN_SENDER_REJECT = "reject"
+
+const SIGNATURE_FAILURE_DROP = "drop"
+const SIGNATURE_FAILURE_ERROR = "error"
+const SIGNATURE_FAILURE_BLOCKLIST = "blocklist"
+
+const SIGNATURE_BLOCKLIST_DURATION = 10 * time.Minute
+const SIGNATURE_LOOKUP_RETRY = time.Minute // A name the server could not give is not asked again before
+const SIGNATURE_MAX_LOOKUPS = 4            // The lookups at the same time : the others are dropped, the peer sends its Hello again
+
+var ErrSignatureMissing = errors.New("the datagram is not signed")
+var ErrSignatureInvalid = errors.New("the signature does not match the key of the sender")
+var ErrUnknownSender = errors.New("we do not know the key of the sender")
+
+var DATAGRAM_TYPE_NAMES = []struct {
+	Type int
+	Name string
+}{
+	{HELLO_TYPE, "hello"},
+	{HELLO_REPLY_TYPE, "hello-reply"},
+	{ROOT_REQUEST_TYPE, "root-request"},
+	{ROOT_TYPE, "root"},
+	{GET_DATUM_TYPE, "get-datum"},
+	{DATUM_TYPE, "datum"},
+	{NO_DATUM_TYPE, "no-datum"},
+	{SEND_KEY_HELLO_TYPE, "send-key"},
+	{SEND_KEY_HELLO_REPLY_TYPE, "send-key-reply"},
+	{ERROR_TYPE, "error"},
+}
+
+type SignaturePolicy struct {
+	Required      map[int]bool // The types that must be signed
+	UnknownSender string
+	OnFailure     string
+}
+
+var SIGNATURE_POLICY SignaturePolicy
+
+func init() {
+	var err error
+	SIGNATURE_POLICY, err = ParseSignaturePolicy(DEFAULT_CONFIG.SignatureRequired, DEFAULT_CONFIG.UnknownSender, DEFAULT_CONFIG.SignatureFailure)
+	if err != nil {
+		log.Fatalf("Invalid default signature policy : %v \n", err)
+	}
+}
+
+/* required : a comma separated list of names of types, "all" or "none" */
+func ParseSignaturePolicy(required string, unknownSender string, onFailure string) (SignaturePolicy, error) {
+	policy := SignaturePolicy{Required: make(map[int]bool), UnknownSender: unknownSender, OnFailure: onFailure}
+
+	for _, name := range strings.Split(required, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		found := false
+		for _, datagramType := range DATAGRAM_TYPE_NAMES {
+			if name == datagramType.Name || name == "all" {
+				policy.Required[datagramType.Type] = true
+				found = true
+			}
+		}
+		if !found {
+			return policy, fmt.Errorf("unknown datagram type %q in the signed types", name)
+		}
+	}
+
+	switch unknownSender {
+	case UNKNOWN_SENDER_LOOKUP, UNKNOWN_SENDER_ACCEPT, UNKNOWN_SENDER_REJECT:
+	default:
+		return policy, fmt.Errorf("the policy for an unknown sender must be %s, %s or %s", UNKNOWN_SENDER_LOOKUP, UNKNOWN_SENDER_ACCEPT, UNKNOWN_SENDER_REJECT)
+	}
+	switch onFailure {
+	case SIGNATURE_FAILURE_DROP, SIGNATURE_FAILURE_ERROR, SIGNATURE_FAILURE_BLOCKLIST:
+	default:
+		return policy, fmt.Errorf("the action on a signature failure must be %s, %s or %s", SIGNATURE_FAILURE_DROP, SIGNATURE_FAILURE_ERROR, SIGNATURE_FAILURE_BLOCKLIST)
+	}
+	return policy, nil
+}
+
+/* The sender of a datagram, as far as we know it */
+type datagramSender struct {
+	Known     bool
+	IsServer  bool
+	Name      string
+	Key       string           // The key given by the server (base64), "" if the peer has none
+	PublicKey *ecdsa.PublicKey // nil if the sender does not sign its datagrams
+	Encrypted bool             // The datagram was decrypted with the keys of the session at its address : it does come from this address
+}
+
+func identifySender(udpAddress *net.UDPAddr, addressesFromServer []Address, publicKeyFromServer *ecdsa.PublicKey) datagramSender {
+	for _, addr := range addressesFromServer {
+		if int(addr.Port) == udpAddress.Port && net.ParseIP(addr.Ip).Equal(udpAddress.IP) {
+			// If the server does not sign its messages, we do not have its key
+			return datagramSender{Known: true, IsServer: true, Name: DIRECTORY_SERVER_NAME, PublicKey: publicKeyFromServer}
+		}
+	}
+
+	mutex.Lock() // The list of peers is also updated by the background synchronization
+	defer mutex.Unlock()
+	for _, peer := range peers {
+		for _, addr := range peer.Addresses {
+			if int(addr.Port) == udpAddress.Port && net.ParseIP(addr.Ip).Equal(udpAddress.IP) {
+				return peerSender(peer.Username, peer.Key)
+			}
+		}
+	}
+
+	// A peer we know by its Hello, at an address the server did not give
+	if session, found := sessionManager.Find(udpAddress); found && session.PeerKey != "" {
+		return peerSender(session.Name(), session.PeerKey)
+	}
+	return datagramSender{}
+}
+
+/* An invalid key is kept as no key : the datagrams that must be signed will fail */
+func peerSender(name string, key string) datagramSender {
+	sender := datagramSender{Known: true, Name: name, Key: key}
+	if key != "" {
+		publicKey, err := DecodePublicKey(key)
+		if err != nil {
+			log.Printf("THE KEY OF %s IS NOT VALID : %v \n", name, err)
+		}
+		sender.PublicKey = publicKey
+	}
+	return sender
+}
+
+/* The place of the signature may be filled with zeros by the peers that do not sign */
+func hasSignature(header *DatagramHeader) bool {
+	for _, b := range header.Signature {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/* nil if the datagram can be used. ErrUnknownSender if it must be signed and we do not know the key of its sender. */
+func (policy *SignaturePolicy) Check(buf []byte, header *DatagramHeader, sender datagramSender) error {
+	signed := hasSignature(header)
+	required := policy.Required[header.Type]
+
+	switch {
+	case !signed && !required:
+		return nil
+	case sender.IsServer && sender.PublicKey == nil:
+		return nil // The server does not sign its datagrams
+	case !sender.Known:
+		if !required {
+			return nil // We cannot check the signature, and the datagram does not need one
+		}
+		return ErrUnknownSender
+	case sender.PublicKey == nil:
+		if !required {
+			return nil
+		}
+		return fmt.Errorf("%w : %s has no key", ErrSignatureMissing, sender.Name)
+	case !signed:
+		return fmt.Errorf("%w : a datagram of type %d from %s must be signed", ErrSignatureMissing, header.Type, sender.Name)
+	case !VerifySignature(buf, sender.PublicKey):
+		return fmt.Errorf("%w %s", ErrSignatureInvalid, sender.Name)
+	}
+	return nil
+}
+
+func (policy *SignaturePolicy) Reject(conn net.PacketConn, udpAddress *net.UDPAddr, buf []byte, sender datagramSender, err error, privateKey *ecdsa.PrivateKey) {
+	reason := REJECTED_INVALID_SIGNATURE
+	if errors.Is(err, ErrUnknownSender) {
+		reason = REJECTED_UNKNOWN_SENDER
+	}
+
+	switch policy.OnFailure {
+	case SIGNATURE_FAILURE_DROP:
+		countRejectedDatagram(reason)
+		log.Printf("WE DROP A DATAGRAM FROM %s (%s) : %v \n", udpAddress.String(), reason, err)
+	case SIGNATURE_FAILURE_ERROR:
+		rejectDatagram(conn, udpAddress, buf, reason, err, privateKey)
+	case SIGNATURE_FAILURE_BLOCKLIST:
+		rejectDatagram(conn, udpAddress, buf, reason, err, privateKey)
+		if sender.Encrypted && !sender.IsServer {
+			blocklistAddress(udpAddress)
+		}
+	}
+}
+
+/* The username of a Hello or a HelloReply, the only datagrams that say who sent them */
+func helloUsername(datagram Datagram) (string, bool) {
+	switch datagram := datagram.(type) {
+	case *ParsedHello:
+		return datagram.Username, true
+	case *ParsedHelloReply:
+		return datagram.Username, true
+	}
+	return "", false
+}
+
+/************************************ THE KEYS OF THE UNKNOWN SENDERS ************************************/
+
+var senderLookupsMutex sync.Mutex
+var senderLookupsInProgress = make(map[string]bool)
+var senderLookupsFailed = make(map[string]time.Time) // The names the server could not give, and when
+
+/* The key of a sender we do not know, from the username of its Hello. The peer is remembered, and its key checked against its pin. */
+func lookupSender(httpClient *http.Client, name string) (datagramSender, error) {
+	senderLookupsMutex.Lock()
+	if failed, found := senderLookupsFailed[name]; found && time.Since(failed) < SIGNATURE_LOOKUP_RETRY {
+		senderLookupsMutex.Unlock()
+		return datagramSender{}, fmt.Errorf("%w : the server could not give the key of %s less than %v ago", ErrUnknownSender, name, SIGNATURE_LOOKUP_RETRY)
+	}
+	if senderLookupsInProgress[name] {
+		senderLookupsMutex.Unlock()
+		return datagramSender{}, fmt.Errorf("%w : the key of %s is already asked to the server", ErrUnknownSender, name)
+	}
+	if len(senderLookupsInProgress) >= SIGNATURE_MAX_LOOKUPS {
+		senderLookupsMutex.Unlock()
+		return datagramSender{}, fmt.Errorf("%w : too many keys are asked to the server at the same time", ErrUnknownSender)
+	}
+	senderLookupsInProgress[name] = true
+	senderLookupsMutex.Unlock()
+
+	peer, err := LookupPeer(httpClient, name)
+	if err == nil {
+		err = rememberPeer(peer)
+	}
+
+	senderLookupsMutex.Lock()
+	delete(senderLookupsInProgress, name)
+	if err != nil {
+		senderLookupsFailed[name] = time.Now()
+	} else {
+		delete(senderLookupsFailed, name)
+	}
+	senderLookupsMutex.Unlock()
+
+	if err != nil {
+		return datagramSender{}, fmt.Errorf("%w : %v", ErrUnknownSender, err)
+	}
+	return peerSender(peer.Username, peer.Key), nil
+}
+
+/* Outside of the loop of UdpRead(), which must not wait for the server. The datagram is used once its signature is checked. */
+func checkUnknownSender(conn net.PacketConn, httpClient *http.Client, udpAddress *net.UDPAddr, buf []byte, datagram Datagram, name string, privateKey *ecdsa.PrivateKey) {
+	sender, err := lookupSender(httpClient, name)
+	if err == nil {
+		err = SIGNATURE_POLICY.Check(buf, datagram.Header(), sender)
+	}
+	if err != nil {
+		SIGNATURE_POLICY.Reject(conn, udpAddress, buf, sender, err, privateKey)
+		return
+	}
+	handleDatagram(conn, udpAddress, buf, datagram, sender.Key, privateKey)
+}
+
+/************************************ BLOCKLIST ************************************/
+
+var signatureBlocklist = make(map[string]time.Time) // Address -> end of the block
+var signatureBlocklistMutex sync.Mutex
+
+func blocklistAddress(udpAddress *net.UDPAddr) {
+	signatureBlocklistMutex.Lock()
+	signatureBlocklist[udpAddress.String()] = time.Now().Add(SIGNATURE_BLOCKLIST_DURATION)
+	signatureBlocklistMutex.Unlock()
+	log.Printf("THE ADDRESS %s IS BLOCKED FOR %v \n", udpAddress.String(), SIGNATURE_BLOCKLIST_DURATION)
+}
+
+func isBlocklisted(udpAddress *net.UDPAddr) bool {
+	signatureBlocklistMutex.Lock()
+	defer signatureBlocklistMutex.Unlock()
+
+	end, found := signatureBlocklist[udpAddress.String()]
+	if found && time.Now().After(end) {
+		delete(signatureBlocklist, udpAddress.String())
+		return false
+	}
+	return found
+}
+
+func PrintBlocklist() {
+	signatureBlocklistMutex.Lock()
+	defer signatureBlocklistMutex.Unlock()
+
+	var addresses []string
+	for address, end := range signatureBlocklist {
+		if time.Now().Before(end) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		fmt.Printf("%s is blocked until %s \n", address, signatureBlocklist[address].Format(time.TimeOnly))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseSignaturePolicy(t *testing.T) {
+	tests := []struct {
+		required, unknownSender, onFailure string
+		expected                           []int // The types that must be signed
+		valid                              bool
+	}{
+		{DEFAULT_CONFIG.SignatureRequired, DEFAULT_CONFIG.UnknownSender, DEFAULT_CONFIG.SignatureFailure, nil, true},
+		{"none", UNKNOWN_SENDER_ACCEPT, SIGNATURE_FAILURE_DROP, []int{}, true},
+		{"", UNKNOWN_SENDER_REJECT, SIGNATURE_FAILURE_ERROR, []int{}, true},
+		{"hello, root ,datum", UNKNOWN_SENDER_LOOKUP, SIGNATURE_FAILURE_BLOCKLIST, []int{HELLO_TYPE, ROOT_TYPE, DATUM_TYPE}, true},
+		{"all", UNKNOWN_SENDER_LOOKUP, SIGNATURE_FAILURE_DROP, []int{HELLO_TYPE, HELLO_REPLY_TYPE, ROOT_REQUEST_TYPE, ROOT_TYPE, GET_DATUM_TYPE, DATUM_TYPE, NO_DATUM_TYPE, SEND_KEY_HELLO_TYPE, SEND_KEY_HELLO_REPLY_TYPE, ERROR_TYPE}, true},
+		{"hello,roots", UNKNOWN_SENDER_LOOKUP, SIGNATURE_FAILURE_DROP, nil, false},
+		{"HELLO", UNKNOWN_SENDER_LOOKUP, SIGNATURE_FAILURE_DROP, nil, false},
+		{"hello", "ask", SIGNATURE_FAILURE_DROP, nil, false},
+		{"hello", "", SIGNATURE_FAILURE_DROP, nil, false},
+		{"hello", UNKNOWN_SENDER_LOOKUP, "ban", nil, false},
+		{"hello", UNKNOWN_SENDER_LOOKUP, "", nil, false},
+	}
+	for _, test := range tests {
+		policy, err := ParseSignaturePolicy(test.required, test.unknownSender, test.onFailure)
+		if (err == nil) != test.valid {
+			t.Errorf("%q %q %q : error %v, valid %v expected", test.required, test.unknownSender, test.onFailure, err, test.valid)
+			continue
+		}
+		if err != nil || test.expected == nil {
+			continue
+		}
+		if len(policy.Required) != len(test.expected) {
+			t.Errorf("%q : %d types must be signed, expected %d", test.required, len(policy.Required), len(test.expected))
+		}
+		for _, datagramType := range test.expected {
+			if !policy.Required[datagramType] {
+				t.Errorf("%q : the type %d does not have to be signed", test.required, datagramType)
+			}
+		}
+	}
+}
+
+func TestSignaturePolicyCheck(t *testing.T) {
+	aliceKey, otherKey := testPrivateKey(t), testPrivateKey(t)
+	hash := bytes.Repeat([]byte{1}, HASH_LENGTH)
+
+	signedByAlice := NoDatumDatagram("abcd", hash, aliceKey)
+	signedByOther := NoDatumDatagram("abcd", hash, otherKey)
+	zeroSignature := append([]byte{}, signedByAlice...)
+	clear(zeroSignature[len(zeroSignature)-SIGNATURE_LENGTH:])
+	noSignature := signedByAlice[:len(signedByAlice)-SIGNATURE_LENGTH]
+
+	alice := peerSender("alice", CreatePublicKeyEncoded(aliceKey))
+	withoutKey := peerSender("alice", "")
+	unknown := datagramSender{}
+	serverWithoutKey := datagramSender{Known: true, IsServer: true, Name: DIRECTORY_SERVER_NAME}
+	serverWithKey := datagramSender{Known: true, IsServer: true, Name: DIRECTORY_SERVER_NAME, PublicKey: &aliceKey.PublicKey}
+
+	tests := []struct {
+		name     string
+		required bool
+		buf      []byte
+		sender   datagramSender
+		expected error
+	}{
+		{"not signed", false, noSignature, alice, nil},
+		{"zero signature", false, zeroSignature, alice, nil},
+		{"signed", false, signedByAlice, alice, nil},
+		{"signed by another key", false, signedByOther, alice, ErrSignatureInvalid},
+		{"unknown sender", false, signedByOther, unknown, nil},
+		{"sender without key", false, signedByAlice, withoutKey, nil},
+		{"required : not signed", true, noSignature, alice, ErrSignatureMissing},
+		{"required : zero signature", true, zeroSignature, alice, ErrSignatureMissing},
+		{"required : signed", true, signedByAlice, alice, nil},
+		{"required : signed by another key", true, signedByOther, alice, ErrSignatureInvalid},
+		{"required : unknown sender", true, signedByAlice, unknown, ErrUnknownSender},
+		{"required : sender without key", true, signedByAlice, withoutKey, ErrSignatureMissing},
+		{"required : server that does not sign", true, noSignature, serverWithoutKey, nil},
+		{"required : server", true, signedByAlice, serverWithKey, nil},
+		{"required : server signed by another key", true, signedByOther, serverWithKey, ErrSignatureInvalid},
+		{"required : server not signed", true, noSignature, serverWithKey, ErrSignatureMissing},
+	}
+	for _, test := range tests {
+		policy, err := ParseSignaturePolicy("none", UNKNOWN_SENDER_REJECT, SIGNATURE_FAILURE_DROP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy.Required[NO_DATUM_TYPE] = test.required
+
+		datagram, err := ParseDatagram(test.buf)
+		if err != nil {
+			t.Fatalf("%s : %v", test.name, err)
+		}
+		err = policy.Check(test.buf, datagram.Header(), test.sender)
+		if (test.expected == nil) != (err == nil) || (test.expected != nil && !errors.Is(err, test.expected)) {
+			t.Errorf("%s : error %v, expected %v", test.name, err, test.expected)
+		}
+	}
+}
+
+/* The source address of a datagram in the clear can be forged : only a datagram of the session blocks its address */
+func TestSignaturePolicyBlocklist(t *testing.T) {
+	policy, err := ParseSignaturePolicy("all", UNKNOWN_SENDER_REJECT, SIGNATURE_FAILURE_BLOCKLIST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := NoDatumDatagram("abcd", bytes.Repeat([]byte{1}, HASH_LENGTH), testPrivateKey(t)) // An answer : no Error is sent
+
+	tests := []struct {
+		name    string
+		sender  datagramSender
+		blocked bool
+	}{
+		{"in the clear", datagramSender{Known: true, Name: "alice"}, false},
+		{"unknown sender", datagramSender{}, false},
+		{"server", datagramSender{Known: true, IsServer: true, Encrypted: true}, false},
+		{"encrypted", datagramSender{Known: true, Name: "alice", Encrypted: true}, true},
+	}
+	for i, test := range tests {
+		address := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 19990 + i}
+		policy.Reject(nil, address, buf, test.sender, ErrSignatureInvalid, nil)
+		if blocked := isBlocklisted(address); blocked != test.blocked {
+			t.Errorf("%s : blocked %v, expected %v", test.name, blocked, test.blocked)
+		}
+		signatureBlocklistMutex.Lock()
+		delete(signatureBlocklist, address.String())
+		signatureBlocklistMutex.Unlock()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/* The conversations : the messages of every Merkle tree we have (ours and the ones we downloaded from the sessions we opened),
+ * linked by their In-reply-to field. A reply whose parent is in none of the trees is shown at the top level, with a warning.
+ * So is a reply to one of its own replies (or to itself) : the hashes make it impossible, but a peer can send any tree.
+ */
+
+type ThreadMessage struct {
+	Hash          []byte
+	Author        string
+	Message       *Message
+	Replies       []*ThreadMessage
+	MissingParent bool // A reply to a message we have not fetched (yet)
+	ReplyLoop     bool // A reply to one of its own replies, or to itself
+}
+
+type Threads struct {
+	Roots  []*ThreadMessage // The messages that are not replies, and the replies whose parent is missing
+	byHash map[[HASH_LENGTH]byte]*ThreadMessage
+}
+
+/* The messages of all the trees we have. A message present in several trees is kept once. */
+func CollectMessages() []*ThreadMessage {
+	var messages []*ThreadMessage
+	seen := make(map[[HASH_LENGTH]byte]bool)
+
+	collect := func(merkleTree *MerkleTree, author string) {
+		merkleTree.DepthFirstSearch(0, func(nodeHeight int, merkleNode *MerkleNode, hashSearch []byte) bool {
+			if len(merkleNode.Data) == 0 || merkleNode.Data[NODE_TYPE_BYTE] != NODE_TYPE_MESSAGE {
+				return false
+			}
+			key, ok := hashKey(merkleNode.Hash)
+			if !ok || seen[key] {
+				return false
+			}
+			message, err := ParseMessage(merkleNode.Data)
+			if err != nil {
+				return false
+			}
+			seen[key] = true
+			messages = append(messages, &ThreadMessage{Hash: merkleNode.Hash, Author: author, Message: message})
+			return false
+		}, nil)
+	}
+
+	ThisPeerMerkleTreeMutex.RLock()
+	collect(ThisPeerMerkleTree, NAME_FOR_SERVER_REGISTRATION)
+	ThisPeerMerkleTreeMutex.RUnlock()
+
+	sessions := sessionManager.List()
+
+	sessionTreesMutex.RLock()
+	defer sessionTreesMutex.RUnlock()
+
+	for _, session := range sessions {
+		if session.Merkle == nil {
+			continue
+		}
+		collect(session.Merkle, session.Name())
+	}
+
+	return messages
+}
+
+func BuildThreads(messages []*ThreadMessage) *Threads {
+	threads := &Threads{byHash: make(map[[HASH_LENGTH]byte]*ThreadMessage)}
+	for _, message := range messages {
+		threads.byHash[[HASH_LENGTH]byte(message.Hash)] = message
+	}
+
+	for _, message := range messages {
+		if !message.Message.IsReply() {
+			threads.Roots = append(threads.Roots, message)
+			continue
+		}
+		parent, found := threads.byHash[[HASH_LENGTH]byte(message.Message.InReplyTo)]
+		if !found {
+			message.MissingParent = true
+			threads.Roots = append(threads.Roots, message)
+			continue
+		}
+		if threads.inReplyChain(message, parent) {
+			message.ReplyLoop = true
+			threads.Roots = append(threads.Roots, message)
+			continue
+		}
+		parent.Replies = append(parent.Replies, message)
+	}
+
+	sortByDate(threads.Roots)
+	for _, message := range messages {
+		sortByDate(message.Replies)
+	}
+	return threads
+}
+
+/* Whether message is found by following the In-reply-to fields from start. The chain may itself end in a loop. */
+func (threads *Threads) inReplyChain(message *ThreadMessage, start *ThreadMessage) bool {
+	visited := make(map[*ThreadMessage]bool)
+	for current := start; current != nil && !visited[current]; {
+		if current == message {
+			return true
+		}
+		visited[current] = true
+		if !current.Message.IsReply() {
+			return false
+		}
+		current = threads.byHash[[HASH_LENGTH]byte(current.Message.InReplyTo)]
+	}
+	return false
+}
+
+func sortByDate(messages []*ThreadMessage) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Message.Date.Before(messages[j].Message.Date)
+	})
+}
+
+func (threads *Threads) Print() {
+	if len(threads.Roots) == 0 {
+		fmt.Println("No messages.")
+		return
+	}
+	for _, message := range threads.Roots {
+		fmt.Println()
+		message.print(0)
+	}
+}
+
+func (message *ThreadMessage) print(depth int) {
+	indentation := strings.Repeat("    ", depth)
+
+	fmt.Printf("%s[%s] %s : \n", indentation, message.Message.DateString(), message.Author)
+	fmt.Printf("%s  Hash : %x \n", indentation, message.Hash)
+	if message.MissingParent {
+		fmt.Printf("%s  (reply to %x, a message we have not fetched) \n", indentation, message.Message.InReplyTo)
+	}
+	if message.ReplyLoop {
+		fmt.Printf("%s  (reply to %x, which is itself a reply to this message) \n", indentation, message.Message.InReplyTo)
+	}
+	for _, line := range strings.Split(string(message.Message.Body), "\n") {
+		fmt.Printf("%s  %s \n", indentation, line)
+	}
+
+	for _, reply := range message.Replies {
+		reply.print(depth + 1)
+	}
+}
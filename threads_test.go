@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* A message found by its body : a reply to the message with the body parent, or not a reply if parent is "" */
+func threadMessage(body string, parent string, minute int) *ThreadMessage {
+	message := timelineMessage(body, time.Date(2025, 6, 1, 12, minute, 0, 0, time.UTC))
+	message.Message.InReplyTo = inReplyToZeroes()
+	if parent != "" {
+		parentHash := sha256.Sum256([]byte(parent))
+		message.Message.InReplyTo = parentHash[:]
+	}
+	return message
+}
+
+/* The threads written as "a(b(c) d) e!" : ! for a missing parent, ~ for a reply loop. The depth is limited, so that a loop ends. */
+func describeThreads(messages []*ThreadMessage, maxDepth int) string {
+	var descriptions []string
+	for _, message := range messages {
+		description := string(message.Message.Body)
+		if message.MissingParent {
+			description += "!"
+		}
+		if message.ReplyLoop {
+			description += "~"
+		}
+		if len(message.Replies) > 0 {
+			if maxDepth == 0 {
+				return "..."
+			}
+			description += "(" + describeThreads(message.Replies, maxDepth-1) + ")"
+		}
+		descriptions = append(descriptions, description)
+	}
+	return strings.Join(descriptions, " ")
+}
+
+func TestBuildThreads(t *testing.T) {
+	type entry struct {
+		body   string
+		parent string
+		minute int
+	}
+
+	tests := []struct {
+		name     string
+		messages []entry
+		expected string
+	}{
+		{"no messages", nil, ""},
+		{"not replies", []entry{{"b", "", 2}, {"a", "", 1}}, "a b"},
+		{"reply chain", []entry{{"a", "", 1}, {"b", "a", 2}, {"c", "b", 3}}, "a(b(c))"},
+		{"replies before their parent", []entry{{"c", "b", 3}, {"b", "a", 2}, {"a", "", 1}}, "a(b(c))"},
+		{"replies sorted by date", []entry{{"a", "", 1}, {"c", "a", 3}, {"b", "a", 2}}, "a(b c)"},
+		{"reply to an unknown parent", []entry{{"a", "", 1}, {"b", "x", 2}}, "a b!"},
+		{"reply to a reply to an unknown parent", []entry{{"b", "x", 2}, {"c", "b", 3}}, "b!(c)"},
+		{"self-reply", []entry{{"a", "a", 1}}, "a~"},
+		{"self-reply with replies", []entry{{"a", "a", 1}, {"b", "a", 2}}, "a~(b)"},
+		{"loop of two", []entry{{"a", "b", 1}, {"b", "a", 2}}, "a~ b~"},
+		{"reply to a loop", []entry{{"a", "b", 1}, {"b", "a", 2}, {"c", "a", 3}}, "a~(c) b~"},
+		{"loop of three", []entry{{"a", "c", 1}, {"b", "a", 2}, {"c", "b", 3}, {"d", "c", 4}}, "a~ b~ c~(d)"},
+	}
+
+	for _, test := range tests {
+		messages := make([]*ThreadMessage, len(test.messages))
+		for i, entry := range test.messages {
+			messages[i] = threadMessage(entry.body, entry.parent, entry.minute)
+		}
+
+		done := make(chan *Threads, 1)
+		go func() { done <- BuildThreads(messages) }()
+		select {
+		case threads := <-done:
+			if description := describeThreads(threads.Roots, len(messages)); description != test.expected {
+				t.Errorf("%s : the threads are %q, expected %q", test.name, description, test.expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s : BuildThreads() does not end", test.name)
+		}
+	}
+}
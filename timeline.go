@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* The timeline : the messages of all the Merkle trees we have, the most recent first, shown page by page.
+ * The hashes of the messages displayed are saved in NAME_FILE_TIMELINE, so that at the next run the other messages are marked as new.
+ * We do not keep a date : the date of a message is chosen by its author, a message dated in the future would hide all the others.
+ */
+
+const TIMELINE_PAGE_SIZE = 10
+const TIMELINE_REPLY_CONTEXT_LENGTH = 40 // The number of characters of the parent message shown with a reply
+const TIMELINE_SEEN_MAX = 100000         // Above, we forget the messages that are no longer in the timeline
+
+type TimelineState struct {
+	Seen       []string  `json:"seen"`                 // The hashes (hexadecimal) of the messages displayed in the timeline
+	LastViewed time.Time `json:"last_viewed,omitzero"` // Written by the first versions : the messages up to this date were seen
+}
+
+func LoadTimelineState(fileName string) (TimelineState, error) {
+	var state TimelineState
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func SaveTimelineState(fileName string, state TimelineState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(fileName, data, 0600)
+}
+
+/* The hashes of the messages already displayed */
+func (state *TimelineState) seenMessages(timeline []*ThreadMessage) map[string]bool {
+	seen := make(map[string]bool, len(state.Seen))
+	for _, hash := range state.Seen {
+		seen[hash] = true
+	}
+	if !state.LastViewed.IsZero() {
+		// The state of a first version : it is read once, then replaced by the hashes
+		for _, message := range timeline {
+			if !message.Message.Date.After(state.LastViewed) {
+				seen[hex.EncodeToString(message.Hash)] = true
+			}
+		}
+		state.LastViewed = time.Time{}
+	}
+	return seen
+}
+
+func (state *TimelineState) setSeenMessages(seen map[string]bool, timeline []*ThreadMessage) {
+	if len(seen) > TIMELINE_SEEN_MAX {
+		inTimeline := make(map[string]bool, len(timeline))
+		for _, message := range timeline {
+			inTimeline[hex.EncodeToString(message.Hash)] = true
+		}
+		for hash := range seen {
+			if !inTimeline[hash] {
+				delete(seen, hash)
+			}
+		}
+	}
+	state.Seen = make([]string, 0, len(seen))
+	for hash := range seen {
+		state.Seen = append(state.Seen, hash)
+	}
+	sort.Strings(state.Seen)
+}
+
+/* All the messages, the most recent first */
+func BuildTimeline(threads *Threads) []*ThreadMessage {
+	timeline := make([]*ThreadMessage, 0, len(threads.byHash))
+	for _, message := range threads.byHash {
+		timeline = append(timeline, message)
+	}
+	sort.Slice(timeline, func(i, j int) bool {
+		if timeline[i].Message.Date.Equal(timeline[j].Message.Date) {
+			return bytes.Compare(timeline[i].Hash, timeline[j].Hash) < 0
+		}
+		return timeline[i].Message.Date.After(timeline[j].Message.Date)
+	})
+	return timeline
+}
+
+/* Displays the timeline page by page, then saves the messages displayed */
+func ShowTimeline() {
+	state, err := LoadTimelineState(NAME_FILE_TIMELINE)
+	if err != nil {
+		fmt.Printf("The timeline state %s could not be read, all the messages are shown as new : %v \n", NAME_FILE_TIMELINE, err)
+	}
+
+	threads := BuildThreads(CollectMessages())
+	timeline := BuildTimeline(threads)
+	if len(timeline) == 0 {
+		fmt.Println("No messages.")
+		return
+	}
+
+	seen := state.seenMessages(timeline)
+	newMessages := 0
+	for _, message := range timeline {
+		if !seen[hex.EncodeToString(message.Hash)] {
+			newMessages++
+		}
+	}
+	fmt.Printf("%d messages, %d new since the last time \n", len(timeline), newMessages)
+
+	// Only the messages of the pages we display are seen
+	displayed := make(map[string]bool)
+
+	page := 0
+	pages := (len(timeline) + TIMELINE_PAGE_SIZE - 1) / TIMELINE_PAGE_SIZE
+	for {
+		fmt.Println()
+		fmt.Printf("----- TIMELINE, PAGE %d / %d ----- \n", page+1, pages)
+		for i := page * TIMELINE_PAGE_SIZE; i < len(timeline) && i < (page+1)*TIMELINE_PAGE_SIZE; i++ {
+			hash := hex.EncodeToString(timeline[i].Hash)
+			printTimelineEntry(threads, timeline[i], !seen[hash])
+			displayed[hash] = true
+		}
+
+		fmt.Println()
+		fmt.Println("n - Next page, p - Previous page, any other key - Back to the menu")
+		choice := strings.TrimSpace(readLine())
+		if choice == "n" && page+1 < pages {
+			page++
+		} else if choice == "p" && page > 0 {
+			page--
+		} else if choice != "n" && choice != "p" {
+			break
+		}
+	}
+
+	for hash := range displayed {
+		seen[hash] = true
+	}
+	state.setSeenMessages(seen, timeline)
+	if err := SaveTimelineState(NAME_FILE_TIMELINE, state); err != nil {
+		fmt.Printf("The timeline state could not be saved in %s : %v \n", NAME_FILE_TIMELINE, err)
+	}
+}
+
+func printTimelineEntry(threads *Threads, message *ThreadMessage, isNew bool) {
+	marker := ""
+	if isNew {
+		marker = "[NEW] "
+	}
+	fmt.Println()
+	fmt.Printf("%s%s, %s : \n", marker, message.Author, message.Message.DateString())
+
+	if message.Message.IsReply() {
+		parent, found := threads.byHash[[HASH_LENGTH]byte(message.Message.InReplyTo)]
+		if found {
+			context := []rune(string(parent.Message.Body))
+			if len(context) > TIMELINE_REPLY_CONTEXT_LENGTH {
+				context = append(context[:TIMELINE_REPLY_CONTEXT_LENGTH], []rune("...")...)
+			}
+			fmt.Printf("  In reply to %s : \"%s\" \n", parent.Author, strings.ReplaceAll(string(context), "\n", " "))
+		} else {
+			fmt.Printf("  In reply to %x (a message we have not fetched) \n", message.Message.InReplyTo)
+		}
+	}
+
+	for _, line := range strings.Split(string(message.Message.Body), "\n") {
+		fmt.Printf("  %s \n", line)
+	}
+	fmt.Printf("  Hash : %x \n", message.Hash)
+}
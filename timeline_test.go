@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func timelineMessage(body string, date time.Time) *ThreadMessage {
+	hash := sha256.Sum256([]byte(body))
+	return &ThreadMessage{Hash: hash[:], Message: &Message{Date: date, Body: []byte(body)}}
+}
+
+func TestTimelineSeenMessages(t *testing.T) {
+	now := time.Now()
+	future := timelineMessage("from the future", now.Add(365*24*time.Hour))
+	old := timelineMessage("old", now.Add(-time.Hour))
+	recent := timelineMessage("recent", now)
+	timeline := []*ThreadMessage{future, recent, old}
+
+	// A message dated in the future does not hide the messages published after it was seen
+	state := TimelineState{Seen: []string{hex.EncodeToString(future.Hash)}}
+	seen := state.seenMessages(timeline)
+	if !seen[hex.EncodeToString(future.Hash)] || seen[hex.EncodeToString(recent.Hash)] || seen[hex.EncodeToString(old.Hash)] {
+		t.Errorf("seen messages : %v", seen)
+	}
+
+	// The state of a first version : the messages up to the date are seen, the date is replaced by the hashes
+	state = TimelineState{LastViewed: now.Add(-time.Minute)}
+	seen = state.seenMessages(timeline)
+	if !seen[hex.EncodeToString(old.Hash)] || seen[hex.EncodeToString(recent.Hash)] || len(seen) != 1 {
+		t.Errorf("seen messages of a first version : %v", seen)
+	}
+	state.setSeenMessages(seen, timeline)
+	if !state.LastViewed.IsZero() || len(state.Seen) != 1 || state.Seen[0] != hex.EncodeToString(old.Hash) {
+		t.Errorf("state after a first version : %+v", state)
+	}
+}
+
+func TestTimelineStateIsSaved(t *testing.T) {
+	fileName := t.TempDir() + "/timeline.json"
+	state := TimelineState{Seen: []string{"aa", "bb"}}
+	if err := SaveTimelineState(fileName, state); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTimelineState(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Seen) != 2 || loaded.Seen[0] != "aa" || loaded.Seen[1] != "bb" || !loaded.LastViewed.IsZero() {
+		t.Errorf("loaded state : %+v", loaded)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"log"
 )
@@ -43,6 +45,17 @@ const DATUM_VALUE_FIRST_BYTE = BODY_FIRST_BYTE + HASH_LENGTH
 const HASH_LENGTH = 32
 const SIGNATURE_LENGTH = 64
 
+/* Each request gets its own random Id, so that the replies to several outstanding requests
+to the same peer can be told apart. A reply carries the Id of the request it answers.
+*/
+func NewDatagramId() string {
+	id := make([]byte, ID_LENGTH)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatalf("The method rand.Read() failed at the stage of generating a datagram id : %v \n", err)
+	}
+	return string(id)
+}
+
 /* General structure of a datagram
 Each datagram includes the Id, Type and Length fields before the Body.
 n order not to repeat these definitions in every function that handles the construction
@@ -64,7 +77,7 @@ Since the structures of the Hello and HelloReply datagrams are completely identi
 the construction of both is done using a single function. When the parameter isHelloDatagram is true, the function returns a datagram of type Hello.
 Otherwise, the function returns a datagram of type HelloReply.
 */
-func HelloOrHelloReplyDatagram(isHelloDatagram bool, id string, userName string, privateKey *ecdsa.PrivateKey) []byte {
+func HelloOrHelloReplyDatagram(isHelloDatagram bool, id string, userName string, extensions Extensions, privateKey *ecdsa.PrivateKey) []byte {
 	usernameLength := len(userName)
 	datagramBodyLength := HELLO_DATAGRAM_BODY_MIN_LENGTH + usernameLength
 	datagramLength := DATAGRAM_MIN_LENGTH + datagramBodyLength + SIGNATURE_LENGTH
@@ -74,7 +87,7 @@ func HelloOrHelloReplyDatagram(isHelloDatagram bool, id string, userName string,
 	}
 	datagram := datagramGeneralStructure([]byte(id), datagramType, datagramBodyLength, datagramLength)
 
-	copy(datagram[FLAGS_FIRST_BYTE:FLAGS_FIRST_BYTE+FLAGS_LENGTH], []byte{0, 0, 0, 8})
+	binary.BigEndian.PutUint32(datagram[FLAGS_FIRST_BYTE:FLAGS_FIRST_BYTE+FLAGS_LENGTH], uint32(extensions))
 	datagram[USER_NAME_LENGTH_BYTE] = byte(usernameLength)
 	copy(datagram[USER_NAME_FIRST_BYTE:USER_NAME_FIRST_BYTE+usernameLength], userName)
 
@@ -97,7 +110,9 @@ func RootDatagram(id string, privateKey *ecdsa.PrivateKey) []byte {
 	datagramLength := DATAGRAM_MIN_LENGTH + ROOT_BODY_LENGTH + SIGNATURE_LENGTH
 	datagram := datagramGeneralStructure([]byte(id), ROOT_TYPE, ROOT_BODY_LENGTH, datagramLength)
 
+	ThisPeerMerkleTreeMutex.RLock()
 	copy(datagram[BODY_FIRST_BYTE:], ThisPeerMerkleTree.Root.Hash)
+	ThisPeerMerkleTreeMutex.RUnlock()
 
 	datagramWithSignature := CreateSignature(datagram, datagramLength, privateKey)
 
@@ -123,18 +138,24 @@ func SendKeyDatagram(id string, publicKey []byte, privateKey *ecdsa.PrivateKey,
 }
 
 /********************************************** DATUM, GET_DATUM, NO_DATUM **********************************************/
-func GetDatumDatagram(id string, hash []byte) []byte {
+func GetDatumDatagram(id string, hash []byte, privateKey *ecdsa.PrivateKey) []byte {
 	datagramLength := DATAGRAM_MIN_LENGTH + GET_DATUM_BODY_LENGTH + SIGNATURE_LENGTH
 	datagram := datagramGeneralStructure([]byte(id), GET_DATUM_TYPE, GET_DATUM_BODY_LENGTH, datagramLength)
 
 	copy(datagram[BODY_FIRST_BYTE:], hash)
-	return datagram
+
+	datagramWithSignature := CreateSignature(datagram, datagramLength, privateKey)
+
+	return datagramWithSignature
 }
 
-func DatumDatagram(id string, hash []byte) []byte {
-	node := ThisPeerMerkleTree.DepthFirstSearch(0, ThisPeerMerkleTree.GetNodeByHash, hash)
+func DatumDatagram(id string, hash []byte, privateKey *ecdsa.PrivateKey) []byte {
+	// The node is copied in the datagram under the lock, the signature is done after
+	ThisPeerMerkleTreeMutex.RLock()
+	node := ThisPeerMerkleTree.FindNode(hash)
 	if node == nil {
-		return NoDatumDatagram(id, hash)
+		ThisPeerMerkleTreeMutex.RUnlock()
+		return NoDatumDatagram(id, hash, privateKey)
 	}
 
 	datagramBodyLength := HASH_LENGTH + len(node.Data)
@@ -143,25 +164,35 @@ func DatumDatagram(id string, hash []byte) []byte {
 
 	copy(datagram[BODY_FIRST_BYTE:BODY_FIRST_BYTE+HASH_LENGTH], node.Hash)
 	copy(datagram[DATUM_VALUE_FIRST_BYTE:], node.Data)
-	return datagram
+	ThisPeerMerkleTreeMutex.RUnlock()
+
+	datagramWithSignature := CreateSignature(datagram, datagramLength, privateKey)
+
+	return datagramWithSignature
 }
 
-func NoDatumDatagram(id string, hash []byte) []byte {
+func NoDatumDatagram(id string, hash []byte, privateKey *ecdsa.PrivateKey) []byte {
 	datagramLength := DATAGRAM_MIN_LENGTH + NO_DATUM_BODY_LENGTH + SIGNATURE_LENGTH
 	datagram := datagramGeneralStructure([]byte(id), NO_DATUM_TYPE, NO_DATUM_BODY_LENGTH, datagramLength)
 
 	copy(datagram[BODY_FIRST_BYTE:], hash)
-	return datagram
+
+	datagramWithSignature := CreateSignature(datagram, datagramLength, privateKey)
+
+	return datagramWithSignature
 }
 
 /********************************************** ERROR **********************************************/
-func ErrorDatagram(id string, errorMessage []byte) []byte {
+func ErrorDatagram(id string, errorMessage []byte, privateKey *ecdsa.PrivateKey) []byte {
 	datagramBodyLength := len(errorMessage)
 	datagramLength := DATAGRAM_MIN_LENGTH + datagramBodyLength + SIGNATURE_LENGTH
 	datagram := datagramGeneralStructure([]byte(id), ERROR_TYPE, datagramBodyLength, datagramLength)
 
 	copy(datagram[BODY_FIRST_BYTE:], errorMessage)
-	return datagram
+
+	datagramWithSignature := CreateSignature(datagram, datagramLength, privateKey)
+
+	return datagramWithSignature
 }
 
 /******************************** DATAGRAM TO STRING / PRINT DATAGRAM **************************************/
@@ -169,9 +200,6 @@ func ErrorDatagram(id string, errorMessage []byte) []byte {
 func PrintDatagram(isDatagramWeSent bool, address string, datagram []byte, timeOut float64) {
 	var str string
 	str = ""
-	bodyLength := int(datagram[LENGTH_FIRST_BYTE])<<8 | int(datagram[LENGTH_FIRST_BYTE+1])
-	id := datagram[ID_FIRST_BYTE : ID_FIRST_BYTE+ID_LENGTH]
-	datagramType := datagram[TYPE_BYTE]
 
 	if !isDatagramWeSent {
 		str += fmt.Sprintf("WE RECEIVE A DATAGRAM FROM %s :\n", address)
@@ -179,33 +207,35 @@ func PrintDatagram(isDatagramWeSent bool, address string, datagram []byte, timeO
 		str += fmt.Sprintf("WE SEND A DATAGRAM TO : %s :\n", address)
 	}
 
-	str += fmt.Sprintf("THE DATAGRAM AS BYTES : %v \n", datagram[:(DATAGRAM_MIN_LENGTH+bodyLength+SIGNATURE_LENGTH)])
-	str += fmt.Sprintf("ID : %v TYPE : %d LENGTH : %d  \n", id, datagramType, bodyLength)
+	str += fmt.Sprintf("THE DATAGRAM AS BYTES : %v \n", datagram)
 
-	if len(datagram[BODY_FIRST_BYTE:]) > bodyLength { // If there is a signature after the body
-		str += fmt.Sprintf("SIGNATURE : %x  \n", datagram[:(DATAGRAM_MIN_LENGTH+bodyLength)])
-	}
-
-	switch datagramType {
-	case byte(HELLO_TYPE):
-		userNameLength := datagram[USER_NAME_LENGTH_BYTE]
-		str += fmt.Sprintf("BODY : Flags : %v Username Length : %d Username : %s \n", datagram[FLAGS_FIRST_BYTE:FLAGS_FIRST_BYTE+FLAGS_LENGTH], userNameLength,
-			datagram[USER_NAME_FIRST_BYTE:USER_NAME_FIRST_BYTE+userNameLength])
-
-	case byte(HELLO_REPLY_TYPE):
-		userNameLength := datagram[USER_NAME_LENGTH_BYTE]
-		str += fmt.Sprintf("BODY : Flags : %v Username Length : %d Username : %s \n", datagram[FLAGS_FIRST_BYTE:FLAGS_FIRST_BYTE+FLAGS_LENGTH], userNameLength,
-			datagram[USER_NAME_FIRST_BYTE:USER_NAME_FIRST_BYTE+userNameLength])
-	case byte(ROOT_TYPE):
-		str += fmt.Sprintf("BODY : %x \n", datagram[BODY_FIRST_BYTE:BODY_FIRST_BYTE+bodyLength])
-	case byte(ERROR_TYPE):
-		str += fmt.Sprintf("BODY : %s \n", datagram[BODY_FIRST_BYTE:BODY_FIRST_BYTE+bodyLength])
-	case byte(DATUM_TYPE):
-		str += fmt.Sprintf("BODY : %s ", datumDatagramToString(datagram[BODY_FIRST_BYTE:BODY_FIRST_BYTE+bodyLength]))
-	case byte(GET_DATUM_TYPE):
-		str += fmt.Sprintf("BODY : %x \n", datagram[BODY_FIRST_BYTE:BODY_FIRST_BYTE+bodyLength])
-	case byte(NO_DATUM_TYPE):
-		str += fmt.Sprintf("BODY : %x \n", datagram[BODY_FIRST_BYTE:BODY_FIRST_BYTE+bodyLength])
+	parsedDatagram, err := ParseDatagram(datagram)
+	if err != nil {
+		str += fmt.Sprintf("INVALID DATAGRAM : %v \n", err)
+	} else {
+		header := parsedDatagram.Header()
+		str += fmt.Sprintf("ID : %v TYPE : %d LENGTH : %d  \n", header.Id, header.Type, header.Length)
+
+		if header.Signature != nil {
+			str += fmt.Sprintf("SIGNATURE : %x  \n", header.Signature)
+		}
+
+		switch parsed := parsedDatagram.(type) {
+		case *ParsedHello:
+			str += fmt.Sprintf("BODY : Flags : %v (%v) Username Length : %d Username : %s \n", parsed.Flags, Extensions(parsed.Flags), len(parsed.Username), parsed.Username)
+		case *ParsedHelloReply:
+			str += fmt.Sprintf("BODY : Flags : %v (%v) Username Length : %d Username : %s \n", parsed.Flags, Extensions(parsed.Flags), len(parsed.Username), parsed.Username)
+		case *ParsedRoot:
+			str += fmt.Sprintf("BODY : %x \n", parsed.Hash)
+		case *ParsedError:
+			str += fmt.Sprintf("BODY : %s \n", parsed.Message)
+		case *ParsedDatum:
+			str += fmt.Sprintf("BODY : %s ", datumDatagramToString(parsed.Body))
+		case *ParsedGetDatum:
+			str += fmt.Sprintf("BODY : %x \n", parsed.Hash)
+		case *ParsedNoDatum:
+			str += fmt.Sprintf("BODY : %x \n", parsed.Hash)
+		}
 	}
 
 	if timeOut > 0 {
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func BenchmarkDatumDatagram(b *testing.B) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	merkleTree := benchmarkMerkleTree(b)
+	hash := lastLeaf(merkleTree).Hash
+
+	ThisPeerMerkleTreeMutex.Lock()
+	previousTree := ThisPeerMerkleTree
+	ThisPeerMerkleTree = merkleTree
+	ThisPeerMerkleTreeMutex.Unlock()
+	defer func() {
+		ThisPeerMerkleTreeMutex.Lock()
+		ThisPeerMerkleTree = previousTree
+		ThisPeerMerkleTreeMutex.Unlock()
+	}()
+
+	for b.Loop() {
+		datagram := DatumDatagram("abcd", hash, privateKey)
+		if datagram[TYPE_BYTE] != DATUM_TYPE {
+			b.Fatalf("datagram of type %d, expected Datum", datagram[TYPE_BYTE])
+		}
+	}
+}